@@ -25,8 +25,10 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/analysis"
 	"github.com/golang/protobuf/proto"
 )
 
@@ -86,35 +88,58 @@ func findBazel() (string) {
 	return "bazel"
 }
 
+// interruptGracePeriod is how long Bazel has to exit after being interrupted
+// by a cancelled context before it is killed.
+var interruptGracePeriod = 10 * time.Second
+
+// Bazel runs Bazel commands.
+//
+// Every command takes a context. When the context is cancelled or its
+// deadline passes, Bazel is sent an interrupt, as if Ctrl-C was pressed, so the
+// server aborts the command cleanly. If it hasn't exited after
+// interruptGracePeriod it is killed. The command then returns the context's
+// error. Use context.WithTimeout to give a single command a timeout.
 type Bazel interface {
 	SetArguments([]string)
 	SetStartupArgs([]string)
-	WriteToStderr(v bool)
-	WriteToStdout(v bool)
-	Info() (map[string]string, error)
-	Query(args ...string) (*blaze_query.QueryResult, error)
-	Build(args ...string) (*bytes.Buffer, error)
-	Test(args ...string) (*bytes.Buffer, error)
-	Run(args ...string) (*exec.Cmd, *bytes.Buffer, error)
+	// SetStdout and SetStderr set where the output of Bazel is streamed while
+	// it runs. Nothing is streamed while they are nil. If both are the same
+	// writer it must be safe for concurrent use.
+	SetStdout(w io.Writer)
+	SetStderr(w io.Writer)
+	// SetOutputListener sets a function that is called with every line of
+	// output while a command runs, in the order the lines were written. It is
+	// called while the output is being read, so it shouldn't block.
+	SetOutputListener(f func(Line))
+	// SetOutputBufferLines sets how many of its last lines of output a command
+	// returns once it has exited. It defaults to DefaultOutputBufferLines.
+	SetOutputBufferLines(n int)
+	Info(ctx context.Context) (map[string]string, error)
+	Query(ctx context.Context, args ...string) (*blaze_query.QueryResult, error)
+	CQuery(ctx context.Context, args ...string) (*analysis.CqueryResult, error)
+	Build(ctx context.Context, args ...string) (*bytes.Buffer, error)
+	Test(ctx context.Context, args ...string) (*bytes.Buffer, error)
+	Coverage(ctx context.Context, args ...string) (*bytes.Buffer, error)
+	Command(ctx context.Context, command string, args ...string) (*bytes.Buffer, error)
+	Run(ctx context.Context, args ...string) (*exec.Cmd, *bytes.Buffer, error)
 	Wait() error
-	Cancel()
 }
 
 type bazel struct {
-	cmd           *exec.Cmd
+	cmd *exec.Cmd
 
-	args          []string
-	startupArgs   []string
+	args        []string
+	startupArgs []string
 
-	ctx           context.Context
-	cancel        context.CancelFunc
+	stdout io.Writer
+	stderr io.Writer
 
-	writeToStderr bool
-	writeToStdout bool
+	outputListener    func(Line)
+	outputBufferLines int
 }
 
 func New() Bazel {
-	return &bazel{}
+	return &bazel{outputBufferLines: DefaultOutputBufferLines}
 }
 
 func (b *bazel) SetArguments(args []string) {
@@ -125,23 +150,39 @@ func (b *bazel) SetStartupArgs(args []string) {
 	b.startupArgs = args
 }
 
-// WriteToStderr when running an operation.
-func (b *bazel) WriteToStderr(v bool) {
-	b.writeToStderr = v
+// SetStdout streams the standard output of Bazel to w.
+func (b *bazel) SetStdout(w io.Writer) {
+	b.stdout = w
+}
+
+// SetStderr streams the standard error of Bazel to w.
+func (b *bazel) SetStderr(w io.Writer) {
+	b.stderr = w
 }
 
-// WriteToStdout when running an operation.
-func (b *bazel) WriteToStdout(v bool) {
-	b.writeToStdout = v
+// SetOutputListener calls f with every line of output.
+func (b *bazel) SetOutputListener(f func(Line)) {
+	b.outputListener = f
 }
 
-func (b *bazel) newCommand(command string, args ...string) (*bytes.Buffer, *bytes.Buffer) {
-	b.ctx, b.cancel = context.WithCancel(context.Background())
+// SetOutputBufferLines keeps the last n lines of output.
+func (b *bazel) SetOutputBufferLines(n int) {
+	b.outputBufferLines = n
+}
 
+// streaming returns whether the output of build-like commands is streamed to
+// the terminal.
+func (b *bazel) streaming() bool {
+	return b.stdout != nil || b.stderr != nil
+}
+
+// newCommand prepares a Bazel command. Colors are turned on if color is set
+// and the arguments don't already say otherwise.
+func (b *bazel) newCommand(color bool, command string, args ...string) {
 	args = append([]string{command}, args...)
-	args = append(b.startupArgs, args...)
+	args = append(append([]string(nil), b.startupArgs...), args...)
 
-	if b.writeToStderr || b.writeToStdout {
+	if color {
 		containsColor := false
 		for _, arg := range args {
 			if strings.HasPrefix(arg, "--color") {
@@ -153,22 +194,54 @@ func (b *bazel) newCommand(command string, args ...string) (*bytes.Buffer, *byte
 		}
 	}
 
-	b.cmd = exec.CommandContext(b.ctx, findBazel(), args...)
+	b.cmd = exec.Command(findBazel(), args...)
+}
 
-	stdoutBuffer := new(bytes.Buffer)
-	stderrBuffer := new(bytes.Buffer)
-	if b.writeToStdout {
-		b.cmd.Stdout = io.MultiWriter(os.Stdout, stdoutBuffer)
-	} else {
-		b.cmd.Stdout = stdoutBuffer
+// newOutput sends both streams of the prepared command to the terminal, the
+// output listener and a new output buffer.
+func (b *bazel) newOutput() *output {
+	out := newOutput(b.stdout, b.stderr, b.outputListener, b.outputBufferLines)
+	b.cmd.Stdout = out.writer(Stdout)
+	b.cmd.Stderr = out.writer(Stderr)
+	return out
+}
+
+// run runs the prepared command until it exits or ctx is done. Once ctx is
+// done Bazel is interrupted, and killed if it doesn't exit in time.
+func (b *bazel) run(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	if b.writeToStderr {
-		b.cmd.Stderr = io.MultiWriter(os.Stderr, stderrBuffer)
-	} else {
-		b.cmd.Stderr = stderrBuffer
+	if err := b.cmd.Start(); err != nil {
+		return err
 	}
 
-	return stdoutBuffer, stderrBuffer
+	process, gracePeriod := b.cmd.Process, interruptGracePeriod
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-exited:
+			return
+		case <-ctx.Done():
+		}
+		// Signal fails where interrupts aren't supported, such as on Windows.
+		if err := process.Signal(os.Interrupt); err != nil {
+			process.Kill()
+			return
+		}
+		select {
+		case <-exited:
+		case <-time.After(gracePeriod):
+			process.Kill()
+		}
+	}()
+
+	err := b.cmd.Wait()
+	close(exited)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
 
 // Displays information about the state of the bazel process in the
@@ -184,13 +257,13 @@ func (b *bazel) newCommand(command string, args ...string) (*bytes.Buffer, *byte
 // the bazel User Manual, and can be programmatically obtained with
 // 'bazel help info-keys'.
 //
-//   res, err := b.Info()
-func (b *bazel) Info() (map[string]string, error) {
-	b.WriteToStderr(false)
-	b.WriteToStdout(false)
-	stdoutBuffer, _ := b.newCommand("info")
+//   res, err := b.Info(ctx)
+func (b *bazel) Info(ctx context.Context) (map[string]string, error) {
+	b.newCommand(false, "info")
+	stdoutBuffer := new(bytes.Buffer)
+	b.cmd.Stdout = stdoutBuffer
 
-	err := b.cmd.Run()
+	err := b.run(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -214,35 +287,45 @@ func (b *bazel) processInfo(info string) (map[string]string, error) {
 }
 
 // Executes a query language expression over a specified subgraph of the
-// build dependency graph.
+// build dependency graph. Only the standard error of Bazel is streamed. Options
+// can follow the expression, and with --keep_going the targets that could be
+// loaded are returned even if others couldn't.
 //
 // For example, to show all C++ test rules in the strings package, use:
 //
-//   res, err := b.Query('kind("cc_.*test", strings:*)')
+//   res, err := b.Query(ctx, 'kind("cc_.*test", strings:*)')
 //
 // or to find all dependencies of //path/to/package:target, use:
 //
-//   res, err := b.Query('deps(//path/to/package:target)')
+//   res, err := b.Query(ctx, 'deps(//path/to/package:target)')
 //
 // or to find a dependency path between //path/to/package:target and //dependency:
 //
-//   res, err := b.Query('somepath(//path/to/package:target, //dependency)')
-func (b *bazel) Query(args ...string) (*blaze_query.QueryResult, error) {
+//   res, err := b.Query(ctx, 'somepath(//path/to/package:target, //dependency)')
+func (b *bazel) Query(ctx context.Context, args ...string) (*blaze_query.QueryResult, error) {
 	blazeArgs := append([]string(nil), "--output=proto", "--order_output=no", "--color=no")
 	blazeArgs = append(blazeArgs, args...)
 
-	b.WriteToStderr(true)
-	b.WriteToStdout(false)
-	stdoutBuffer, _ := b.newCommand("query", blazeArgs...)
+	b.newCommand(false, "query", blazeArgs...)
+	stdoutBuffer := new(bytes.Buffer)
+	b.cmd.Stdout = stdoutBuffer
+	b.cmd.Stderr = b.stderr
 
-	err := b.cmd.Run()
+	err := b.run(ctx)
 
-	if err != nil {
+	if err != nil && !partialQueryResult(err) {
 		return nil, err
 	}
 	return b.processQuery(stdoutBuffer.Bytes())
 }
 
+// partialQueryResult returns whether a query only failed to load part of the
+// graph. With --keep_going the rest of the result is still returned.
+func partialQueryResult(err error) bool {
+	exitErr, ok := err.(*exec.ExitError)
+	return ok && exitErr.ExitCode() == 3
+}
+
 func (b *bazel) processQuery(out []byte) (*blaze_query.QueryResult, error) {
 	var qr blaze_query.QueryResult
 	if err := proto.Unmarshal(out, &qr); err != nil {
@@ -253,37 +336,78 @@ func (b *bazel) processQuery(out []byte) (*blaze_query.QueryResult, error) {
 	return &qr, nil
 }
 
-func (b *bazel) Build(args ...string) (*bytes.Buffer, error) {
-	stdoutBuffer, stderrBuffer := b.newCommand("build", append(b.args, args...)...)
-	err := b.cmd.Run()
+// CQuery runs a query over the configured target graph. Unlike Query, it is
+// given the arguments set with SetArguments, so that only the dependencies of
+// the active configuration are followed. Only the standard error of Bazel is
+// streamed.
+//
+//   res, err := b.CQuery(ctx, 'deps(//path/to/package:target)')
+func (b *bazel) CQuery(ctx context.Context, args ...string) (*analysis.CqueryResult, error) {
+	blazeArgs := append([]string(nil), "--output=proto", "--color=no")
+	blazeArgs = append(blazeArgs, b.args...)
+	blazeArgs = append(blazeArgs, args...)
+
+	b.newCommand(false, "cquery", blazeArgs...)
+	stdoutBuffer := new(bytes.Buffer)
+	b.cmd.Stdout = stdoutBuffer
+	b.cmd.Stderr = b.stderr
+
+	err := b.run(ctx)
+
+	if err != nil && !partialQueryResult(err) {
+		return nil, err
+	}
+	return b.processCQuery(stdoutBuffer.Bytes())
+}
+
+func (b *bazel) processCQuery(out []byte) (*analysis.CqueryResult, error) {
+	var cr analysis.CqueryResult
+	if err := proto.Unmarshal(out, &cr); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read blaze cquery response. Error: %s\nOutput: %s\n", err, out)
+		return nil, err
+	}
+
+	return &cr, nil
+}
+
+func (b *bazel) Build(ctx context.Context, args ...string) (*bytes.Buffer, error) {
+	return b.Command(ctx, "build", args...)
+}
+
+func (b *bazel) Test(ctx context.Context, args ...string) (*bytes.Buffer, error) {
+	return b.Command(ctx, "test", args...)
+}
 
-	_, _ = stdoutBuffer.Write(stderrBuffer.Bytes())
-	return stdoutBuffer, err
+func (b *bazel) Coverage(ctx context.Context, args ...string) (*bytes.Buffer, error) {
+	return b.Command(ctx, "coverage", args...)
 }
 
-func (b *bazel) Test(args ...string) (*bytes.Buffer, error) {
-	stdoutBuffer, stderrBuffer := b.newCommand("test", append(b.args, args...)...)
-	err := b.cmd.Run()
+// Command runs any Bazel command that exits once it is done, such as
+// mobile-install or fetch, and returns the last lines of its output in the
+// order they were written.
+func (b *bazel) Command(ctx context.Context, command string, args ...string) (*bytes.Buffer, error) {
+	b.newCommand(b.streaming(), command, append(b.args, args...)...)
+	out := b.newOutput()
+	err := b.run(ctx)
 
-	_, _ = stdoutBuffer.Write(stderrBuffer.Bytes())
-	return stdoutBuffer, err
+	out.flush()
+	return out.buffer.Bytes(), err
 }
 
 // Build the specified target (singular) and run it with the given arguments.
-func (b *bazel) Run(args ...string) (*exec.Cmd, *bytes.Buffer, error) {
-	b.WriteToStderr(true)
-	b.WriteToStdout(true)
-	stdoutBuffer, stderrBuffer := b.newCommand("run", append(b.args, args...)...)
+// The last lines of its standard error are returned.
+func (b *bazel) Run(ctx context.Context, args ...string) (*exec.Cmd, *bytes.Buffer, error) {
+	b.newCommand(b.streaming(), "run", append(b.args, args...)...)
+	out := b.newOutput()
 	b.cmd.Stdin = os.Stdin
 
-	_, _ = stdoutBuffer.Write(stderrBuffer.Bytes())
-
-	err := b.cmd.Run()
+	err := b.run(ctx)
+	out.flush()
 	if err != nil {
-		return nil, stderrBuffer, err
+		return nil, out.buffer.Bytes(Stderr), err
 	}
 
-	return b.cmd, stderrBuffer, err
+	return b.cmd, out.buffer.Bytes(Stderr), err
 }
 
 func (b *bazel) Wait() error {
@@ -295,13 +419,3 @@ func (b *bazel) Wait() error {
 	}
 	return res
 }
-
-// Cancel the currently running operation. Useful if you call Run(target) and
-// would like to stop the action running in a goroutine.
-func (b *bazel) Cancel() {
-	if b.cancel == nil {
-		return
-	}
-
-	b.cancel()
-}
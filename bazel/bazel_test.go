@@ -16,11 +16,20 @@ package bazel
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/analysis"
+	"github.com/golang/protobuf/proto"
 )
 
 func TestNew(t *testing.T) {
@@ -50,47 +59,215 @@ KEY3: value`)
 	}
 }
 
-func TestWriteToStderrAndStdout(t *testing.T) {
+func TestProcessCQuery(t *testing.T) {
+	expected := &analysis.CqueryResult{
+		Results: []*analysis.ConfiguredTarget{
+			{Target: &blaze_query.Target{
+				Type:       blaze_query.Target_SOURCE_FILE.Enum(),
+				SourceFile: &blaze_query.SourceFile{Name: proto.String("//path/to:file.go")},
+			}},
+		},
+	}
+	out, err := proto.Marshal(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &bazel{}
+	got, err := b.processCQuery(out)
+	if err != nil {
+		t.Errorf("Error processing cquery: %v", err)
+	}
+	if !proto.Equal(got, expected) {
+		t.Errorf("Objects were unequal. Got:\n%s\nExpected:\n%s", got, expected)
+	}
+}
+
+func TestNewCommand_color(t *testing.T) {
 	b := &bazel{}
-	stdoutBuffer := new(bytes.Buffer)
-	stderrBuffer := new(bytes.Buffer)
 
-	// By default it should write to its own pipe.
-	b.newCommand("version")
-	if reflect.DeepEqual(b.cmd.Stdout, io.MultiWriter(os.Stdout, stderrBuffer)) {
-		t.Errorf("Set stdout to os.Stdout and stderrBuffer")
+	b.newCommand(false, "version")
+	if contains(b.cmd.Args, "--color=yes") {
+		t.Errorf("Asked for colors without streaming the output: %v", b.cmd.Args)
 	}
-	if reflect.DeepEqual(b.cmd.Stderr, io.MultiWriter(os.Stderr, stdoutBuffer)) {
-		t.Errorf("Set stderr to os.Stderr and stdoutBuffer")
+
+	b.newCommand(true, "version")
+	if !contains(b.cmd.Args, "--color=yes") {
+		t.Errorf("Didn't ask for colors when streaming the output: %v", b.cmd.Args)
 	}
 
-	// If set to true it should write to the os version
-	b.WriteToStderr(true)
-	b.WriteToStdout(true)
-	b.newCommand("version")
-	if !reflect.DeepEqual(b.cmd.Stdout, io.MultiWriter(os.Stdout, stderrBuffer)) {
-		t.Errorf("Didn't set stdout to os.Stdout and stderrBuffer")
+	// An explicit color setting is left alone.
+	b.newCommand(true, "version", "--color=no")
+	if contains(b.cmd.Args, "--color=yes") {
+		t.Errorf("Overrode --color=no: %v", b.cmd.Args)
 	}
-	if !reflect.DeepEqual(b.cmd.Stderr, io.MultiWriter(os.Stderr, stdoutBuffer)) {
-		t.Errorf("Didn't set stderr to os.Stderr and stdoutBuffer")
+}
+
+func contains(l []string, e string) bool {
+	for _, s := range l {
+		if s == e {
+			return true
+		}
 	}
+	return false
+}
 
-	// If set to false it should not write to the os version
-	b.WriteToStderr(false)
-	b.WriteToStdout(false)
-	b.newCommand("version")
-	if reflect.DeepEqual(b.cmd.Stdout, io.MultiWriter(os.Stdout, stderrBuffer)) {
-		t.Errorf("Set stdout to os.Stdout and stderrBuffer")
+// fakeBazel makes findBazel return a shell script with the given body.
+func fakeBazel(t *testing.T, script string) func() {
+	if runtime.GOOS == "windows" {
+		t.Skip("The fake bazel is a shell script")
 	}
-	if reflect.DeepEqual(b.cmd.Stderr, io.MultiWriter(os.Stderr, stdoutBuffer)) {
-		t.Errorf("Set stderr to os.Stderr and stdoutBuffer")
+	dir, err := ioutil.TempDir("", "fake_bazel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "bazel")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := *bazelPathFlag
+	*bazelPathFlag = path
+	return func() {
+		*bazelPathFlag = oldPath
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCommand_streamsOutput(t *testing.T) {
+	// The sleeps make the order the lines arrive in predictable.
+	defer fakeBazel(t, "echo out $1; sleep 0.1; echo err >&2; sleep 0.1; printf 'no newline'")()
+
+	var stdout, stderr bytes.Buffer
+	var lines []Line
+	b := New()
+	b.SetStdout(&stdout)
+	b.SetStderr(&stderr)
+	b.SetOutputListener(func(line Line) {
+		lines = append(lines, line)
+	})
+	output, err := b.Build(context.Background(), "//path/to:target")
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if stdout.String() != "out build\nno newline" {
+		t.Errorf("Streamed stdout = %q, want %q", stdout.String(), "out build\nno newline")
+	}
+	if stderr.String() != "err\n" {
+		t.Errorf("Streamed stderr = %q, want %q", stderr.String(), "err\n")
+	}
+	expected := []Line{
+		{Stdout, "out build"},
+		{Stderr, "err"},
+		{Stdout, "no newline"},
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Listener got %v, want %v", lines, expected)
+	}
+	if output.String() != "out build\nerr\nno newline\n" {
+		t.Errorf("Output = %q, want %q", output.String(), "out build\nerr\nno newline\n")
 	}
 }
 
-// Test that cancel doesn't NPE if there is no command running.
-func TestCancel(t *testing.T) {
+func TestCommand_boundedOutput(t *testing.T) {
+	defer fakeBazel(t, "for i in 1 2 3 4 5; do echo $i; done")()
+
 	b := New()
-	b.Cancel()
+	b.SetOutputBufferLines(2)
+	output, err := b.Build(context.Background())
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if output.String() != "4\n5\n" {
+		t.Errorf("Output = %q, want the last two lines", output.String())
+	}
+}
+
+func TestInfo_doesNotStream(t *testing.T) {
+	defer fakeBazel(t, "echo 'output_base: /tmp/base'; echo err >&2")()
+
+	var stdout, stderr bytes.Buffer
+	b := New()
+	b.SetStdout(&stdout)
+	b.SetStderr(&stderr)
+	info, err := b.Info(context.Background())
+	if err != nil {
+		t.Fatalf("Info failed: %v", err)
+	}
+	if info["output_base"] != "/tmp/base" {
+		t.Errorf("Info = %v", info)
+	}
+	if stdout.Len() != 0 || stderr.Len() != 0 {
+		t.Errorf("Info streamed %q and %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestCommand_cancelInterrupts(t *testing.T) {
+	defer fakeBazel(t, `trap 'echo interrupted; exit 8' INT
+while true; do sleep 0.05; done`)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	output, err := New().Build(ctx, "//path/to:target")
+	if err != context.DeadlineExceeded {
+		t.Errorf("Build returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !strings.Contains(output.String(), "interrupted") {
+		t.Errorf("Bazel wasn't interrupted. Output: %q", output.String())
+	}
+}
+
+func TestCommand_cancelKillsAfterGracePeriod(t *testing.T) {
+	defer fakeBazel(t, `trap '' INT
+while true; do sleep 0.05; done`)()
+
+	oldGracePeriod := interruptGracePeriod
+	interruptGracePeriod = 100 * time.Millisecond
+	defer func() { interruptGracePeriod = oldGracePeriod }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	done := make(chan error)
+	go func() {
+		_, err := New().Build(ctx, "//path/to:target")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Build returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Bazel wasn't killed after ignoring the interrupt")
+	}
+}
+
+func TestQuery_keepGoing(t *testing.T) {
+	defer fakeBazel(t, "exit 3")()
+
+	if _, err := New().Query(context.Background(), "deps(//path/to:target)", "--keep_going"); err != nil {
+		t.Errorf("A partial result failed the query: %v", err)
+	}
+	if _, err := New().CQuery(context.Background(), "deps(//path/to:target)", "--keep_going"); err != nil {
+		t.Errorf("A partial result failed the cquery: %v", err)
+	}
+}
+
+func TestQuery_failure(t *testing.T) {
+	defer fakeBazel(t, "exit 7")()
+
+	if _, err := New().Query(context.Background(), "deps(//path/to:target)"); err == nil {
+		t.Errorf("Expected a failed query to return an error")
+	}
+}
+
+func TestCommand_alreadyCancelled(t *testing.T) {
+	defer fakeBazel(t, "echo ran")()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := New().Build(ctx); err != context.Canceled {
+		t.Errorf("Build returned %v, want %v", err, context.Canceled)
+	}
 }
 
 var bazelNpmPathTests = []struct {
@@ -0,0 +1,205 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazel
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// DefaultOutputBufferLines is how many lines of output a command keeps for
+// after it has exited, unless SetOutputBufferLines says otherwise.
+const DefaultOutputBufferLines = 10000
+
+// Stream is one of the output streams of Bazel.
+type Stream int
+
+const (
+	Stdout Stream = iota
+	Stderr
+)
+
+func (s Stream) String() string {
+	if s == Stderr {
+		return "stderr"
+	}
+	return "stdout"
+}
+
+// Line is a line of output written by Bazel, without its line ending.
+type Line struct {
+	Stream Stream
+	Text   string
+}
+
+// OutputBuffer keeps the last lines written by a command, in the order they
+// were written, so memory doesn't grow with chatty commands. It is safe for
+// concurrent use.
+type OutputBuffer struct {
+	lock    sync.Mutex
+	lines   []Line
+	next    int // where the next line goes once lines is full
+	dropped int
+}
+
+// NewOutputBuffer returns a buffer that keeps at most size lines.
+func NewOutputBuffer(size int) *OutputBuffer {
+	if size < 1 {
+		size = 1
+	}
+	return &OutputBuffer{lines: make([]Line, 0, size)}
+}
+
+// Add appends a line, dropping the oldest line once the buffer is full.
+func (o *OutputBuffer) Add(line Line) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if len(o.lines) < cap(o.lines) {
+		o.lines = append(o.lines, line)
+		return
+	}
+	o.lines[o.next] = line
+	o.next = (o.next + 1) % len(o.lines)
+	o.dropped++
+}
+
+// Lines returns the lines in the buffer, oldest first.
+func (o *OutputBuffer) Lines() []Line {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	lines := make([]Line, 0, len(o.lines))
+	lines = append(lines, o.lines[o.next:]...)
+	return append(lines, o.lines[:o.next]...)
+}
+
+// Dropped returns how many lines no longer fit in the buffer.
+func (o *OutputBuffer) Dropped() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.dropped
+}
+
+// Bytes returns the lines in the buffer of the given streams, each followed by
+// a newline. All the lines are returned when no stream is given.
+func (o *OutputBuffer) Bytes(streams ...Stream) *bytes.Buffer {
+	var b bytes.Buffer
+	for _, line := range o.Lines() {
+		if len(streams) > 0 && !hasStream(streams, line.Stream) {
+			continue
+		}
+		b.WriteString(line.Text)
+		b.WriteByte('\n')
+	}
+	return &b
+}
+
+func hasStream(streams []Stream, s Stream) bool {
+	for _, stream := range streams {
+		if stream == s {
+			return true
+		}
+	}
+	return false
+}
+
+// output receives both streams of a command. The raw output is copied to the
+// terminal as it arrives, so progress messages still render, while complete
+// lines are passed to the listener and kept in the buffer. Writes to both
+// streams are serialized so lines keep the order they arrived in.
+type output struct {
+	lock     sync.Mutex
+	terminal [2]io.Writer
+	partial  [2][]byte
+	listener func(Line)
+	buffer   *OutputBuffer
+}
+
+func newOutput(stdout, stderr io.Writer, listener func(Line), bufferLines int) *output {
+	return &output{
+		terminal: [2]io.Writer{stdout, stderr},
+		listener: listener,
+		buffer:   NewOutputBuffer(bufferLines),
+	}
+}
+
+// NewOutputWriters returns the writers of the stdout and stderr of a command
+// that isn't Bazel, such as the one ibazel exec runs. What is written to them
+// is copied to stdout and stderr, and the last bufferLines lines are kept in
+// buffer. flush must be called once the command exited, for a last line
+// without a line ending.
+func NewOutputWriters(stdout, stderr io.Writer, bufferLines int) (outWriter, errWriter io.Writer, buffer *OutputBuffer, flush func()) {
+	o := newOutput(stdout, stderr, nil, bufferLines)
+	return o.writer(Stdout), o.writer(Stderr), o.buffer, o.flush
+}
+
+// writer returns the writer a stream of the command should write to.
+func (o *output) writer(s Stream) io.Writer {
+	return streamWriter{o, s}
+}
+
+type streamWriter struct {
+	o *output
+	s Stream
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	return w.o.write(w.s, p)
+}
+
+func (o *output) write(s Stream, p []byte) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if t := o.terminal[s]; t != nil {
+		// Failing to write to the terminal shouldn't fail the command.
+		t.Write(p)
+	}
+
+	data := append(o.partial[s], p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		o.emit(s, data[:i])
+		data = data[i+1:]
+	}
+	o.partial[s] = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// flush emits whatever is left of a line the command didn't end.
+func (o *output) flush() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for s := range o.partial {
+		if len(o.partial[s]) > 0 {
+			o.emit(Stream(s), o.partial[s])
+			o.partial[s] = nil
+		}
+	}
+}
+
+func (o *output) emit(s Stream, text []byte) {
+	line := Line{Stream: s, Text: string(bytes.TrimSuffix(text, []byte("\r")))}
+	o.buffer.Add(line)
+	if o.listener != nil {
+		o.listener(line)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazel
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestOutputBuffer(t *testing.T) {
+	o := NewOutputBuffer(3)
+	for _, text := range []string{"a", "b"} {
+		o.Add(Line{Stdout, text})
+	}
+	if got := o.Lines(); !reflect.DeepEqual(got, []Line{{Stdout, "a"}, {Stdout, "b"}}) {
+		t.Errorf("Lines of a buffer that isn't full = %v", got)
+	}
+
+	for _, text := range []string{"c", "d", "e"} {
+		o.Add(Line{Stderr, text})
+	}
+	expected := []Line{{Stderr, "c"}, {Stderr, "d"}, {Stderr, "e"}}
+	if got := o.Lines(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Lines of a full buffer = %v, want %v", got, expected)
+	}
+	if o.Dropped() != 2 {
+		t.Errorf("Dropped = %d, want 2", o.Dropped())
+	}
+}
+
+func TestOutputBuffer_bytes(t *testing.T) {
+	o := NewOutputBuffer(10)
+	o.Add(Line{Stdout, "out"})
+	o.Add(Line{Stderr, "err"})
+
+	if got := o.Bytes().String(); got != "out\nerr\n" {
+		t.Errorf("Bytes() = %q", got)
+	}
+	if got := o.Bytes(Stderr).String(); got != "err\n" {
+		t.Errorf("Bytes(Stderr) = %q", got)
+	}
+}
+
+func TestOutput(t *testing.T) {
+	var terminal bytes.Buffer
+	var lines []Line
+	out := newOutput(&terminal, nil, func(line Line) {
+		lines = append(lines, line)
+	}, 10)
+	stdout, stderr := out.writer(Stdout), out.writer(Stderr)
+
+	stdout.Write([]byte("one\ntw"))
+	stderr.Write([]byte("warning\r\n"))
+	stdout.Write([]byte("o\nthree"))
+	out.flush()
+
+	expected := []Line{
+		{Stdout, "one"},
+		{Stderr, "warning"},
+		{Stdout, "two"},
+		{Stdout, "three"},
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Lines = %v, want %v", lines, expected)
+	}
+	if !reflect.DeepEqual(out.buffer.Lines(), expected) {
+		t.Errorf("Buffered lines = %v, want %v", out.buffer.Lines(), expected)
+	}
+	// The terminal gets the output as it was written.
+	if terminal.String() != "one\ntwo\nthree" {
+		t.Errorf("Terminal got %q", terminal.String())
+	}
+}
+
+func TestNewOutputWriters(t *testing.T) {
+	var terminal bytes.Buffer
+	stdout, stderr, buffer, flush := NewOutputWriters(&terminal, &terminal, 2)
+
+	stdout.Write([]byte("one\ntwo\n"))
+	stderr.Write([]byte("three\nfour"))
+	flush()
+
+	expected := []Line{
+		{Stderr, "three"},
+		{Stderr, "four"},
+	}
+	if !reflect.DeepEqual(buffer.Lines(), expected) {
+		t.Errorf("Buffered lines = %v, want %v", buffer.Lines(), expected)
+	}
+	if terminal.String() != "one\ntwo\nthree\nfour" {
+		t.Errorf("Terminal got %q", terminal.String())
+	}
+}
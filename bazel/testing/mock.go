@@ -16,21 +16,33 @@ package testing
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"os/exec"
 	"regexp"
 	"testing"
 
+	"github.com/bazelbuild/bazel-watcher/bazel"
 	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/analysis"
 )
 
 type MockBazel struct {
 	actions       [][]string
 	queryResponse map[string]*blaze_query.QueryResult
+	queryError    error
 	args          []string
 	startupArgs   []string
 
+	cqueryResponse map[string]*analysis.CqueryResult
+	cqueryError    error
+
 	buildError error
 	waitError  error
+
+	output         []bazel.Line
+	outputListener func(bazel.Line)
+	stdout, stderr io.Writer
 }
 
 func (b *MockBazel) SetArguments(args []string) {
@@ -41,13 +53,45 @@ func (b *MockBazel) SetStartupArgs(args []string) {
 	b.startupArgs = args
 }
 
-func (b *MockBazel) WriteToStderr(v bool) {
-	b.actions = append(b.actions, []string{"WriteToStderr"})
+func (b *MockBazel) SetStdout(w io.Writer) {
+	b.actions = append(b.actions, []string{"SetStdout"})
+	b.stdout = w
+}
+func (b *MockBazel) SetStderr(w io.Writer) {
+	b.actions = append(b.actions, []string{"SetStderr"})
+	b.stderr = w
 }
-func (b *MockBazel) WriteToStdout(v bool) {
-	b.actions = append(b.actions, []string{"WriteToStdout"})
+func (b *MockBazel) SetOutputListener(f func(bazel.Line)) {
+	b.outputListener = f
+}
+func (b *MockBazel) SetOutputBufferLines(n int) {}
+
+// Output makes the commands that build write these lines, to the writers
+// given by SetStdout and SetStderr too.
+func (b *MockBazel) Output(lines ...bazel.Line) {
+	b.output = lines
+}
+func (b *MockBazel) writeOutput() *bytes.Buffer {
+	if b.output == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, line := range b.output {
+		if b.outputListener != nil {
+			b.outputListener(line)
+		}
+		w := b.stdout
+		if line.Stream == bazel.Stderr {
+			w = b.stderr
+		}
+		if w != nil {
+			io.WriteString(w, line.Text+"\n")
+		}
+		buf.WriteString(line.Text + "\n")
+	}
+	return &buf
 }
-func (b *MockBazel) Info() (map[string]string, error) {
+func (b *MockBazel) Info(ctx context.Context) (map[string]string, error) {
 	b.actions = append(b.actions, []string{"Info"})
 	return map[string]string{}, nil
 }
@@ -57,7 +101,7 @@ func (b *MockBazel) AddQueryResponse(query string, res *blaze_query.QueryResult)
 	}
 	b.queryResponse[query] = res
 }
-func (b *MockBazel) Query(args ...string) (*blaze_query.QueryResult, error) {
+func (b *MockBazel) Query(ctx context.Context, args ...string) (*blaze_query.QueryResult, error) {
 	b.actions = append(b.actions, append([]string{"Query"}, args...))
 	query := args[0]
 	res, ok := b.queryResponse[query]
@@ -66,22 +110,55 @@ func (b *MockBazel) Query(args ...string) (*blaze_query.QueryResult, error) {
 		res = &blaze_query.QueryResult{}
 	}
 
+	return res, b.queryError
+}
+func (b *MockBazel) QueryError(e error) {
+	b.queryError = e
+}
+func (b *MockBazel) AddCQueryResponse(query string, res *analysis.CqueryResult) {
+	if b.cqueryResponse == nil {
+		b.cqueryResponse = map[string]*analysis.CqueryResult{}
+	}
+	b.cqueryResponse[query] = res
+}
+func (b *MockBazel) CQueryError(e error) {
+	b.cqueryError = e
+}
+func (b *MockBazel) CQuery(ctx context.Context, args ...string) (*analysis.CqueryResult, error) {
+	b.actions = append(b.actions, append([]string{"CQuery"}, args...))
+	if b.cqueryError != nil {
+		return nil, b.cqueryError
+	}
+	res, ok := b.cqueryResponse[args[0]]
+
+	if !ok || res == nil {
+		res = &analysis.CqueryResult{}
+	}
+
 	return res, nil
 }
-func (b *MockBazel) Build(args ...string) (*bytes.Buffer, error) {
+func (b *MockBazel) Build(ctx context.Context, args ...string) (*bytes.Buffer, error) {
 	b.actions = append(b.actions, append([]string{"Build"}, args...))
-	return nil, b.buildError
+	return b.writeOutput(), b.buildError
 }
 func (b *MockBazel) BuildError(e error) {
 	b.buildError = e
 }
-func (b *MockBazel) Test(args ...string) (*bytes.Buffer, error) {
+func (b *MockBazel) Test(ctx context.Context, args ...string) (*bytes.Buffer, error) {
 	b.actions = append(b.actions, append([]string{"Test"}, args...))
-	return nil, nil
+	return b.writeOutput(), nil
+}
+func (b *MockBazel) Coverage(ctx context.Context, args ...string) (*bytes.Buffer, error) {
+	b.actions = append(b.actions, append([]string{"Coverage"}, args...))
+	return b.writeOutput(), nil
 }
-func (b *MockBazel) Run(args ...string) (*exec.Cmd, *bytes.Buffer, error) {
+func (b *MockBazel) Command(ctx context.Context, command string, args ...string) (*bytes.Buffer, error) {
+	b.actions = append(b.actions, append([]string{"Command", command}, args...))
+	return b.writeOutput(), b.buildError
+}
+func (b *MockBazel) Run(ctx context.Context, args ...string) (*exec.Cmd, *bytes.Buffer, error) {
 	b.actions = append(b.actions, append([]string{"Run"}, args...))
-	return nil, nil, nil
+	return nil, b.writeOutput(), nil
 }
 func (b *MockBazel) WaitError(e error) {
 	b.waitError = e
@@ -89,9 +166,6 @@ func (b *MockBazel) WaitError(e error) {
 func (b *MockBazel) Wait() error {
 	return b.waitError
 }
-func (b *MockBazel) Cancel() {
-	b.actions = append(b.actions, []string{"Cancel"})
-}
 func (b *MockBazel) AssertActions(t *testing.T, expected [][]string) {
 	failed := false
 	if len(b.actions) == len(expected) {
@@ -2,10 +2,11 @@ module github.com/bazelbuild/bazel-watcher
 
 require (
 	github.com/bazelbuild/rules_go v0.20.3
+	github.com/creack/pty v1.1.11
 	github.com/fsnotify/fsnotify v1.4.7
 	github.com/golang/protobuf v1.3.2
 	github.com/google/go-cmp v0.3.1 // indirect
 	github.com/gorilla/websocket v1.4.1 // indirect
 	github.com/jaschaephraim/lrserver v0.0.0-20171129202958-50d19f603f71
-	golang.org/x/sys v0.0.0-20191029155521-f43be2a4598c // indirect
+	golang.org/x/sys v0.0.0-20191029155521-f43be2a4598c
 )
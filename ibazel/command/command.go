@@ -16,14 +16,19 @@ package command
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/bazelbuild/bazel-watcher/bazel"
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
 	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
 )
 
@@ -33,15 +38,94 @@ var bazelNew = bazel.New
 // Command is an object that wraps the logic of running a task in Bazel and
 // manipulating it.
 type Command interface {
-	Start() (*bytes.Buffer, error)
+	// Start builds the target and starts it. The build is interrupted once ctx
+	// is done.
+	Start(ctx context.Context) (*bytes.Buffer, error)
 	Terminate()
-	NotifyOfChanges() *bytes.Buffer
+	NotifyOfChanges(ctx context.Context, changes []string) *bytes.Buffer
+	// Restart starts the subprocess again without rebuilding it.
+	Restart() error
 	IsSubprocessRunning() bool
 }
 
-// start will be called by most implementations since this logic is extremely
-// common.
-func start(b bazel.Bazel, target string, args []string) (*bytes.Buffer, process_group.ProcessGroup) {
+// Options holds the per-target settings that change how a Command launches
+// its subprocess. The zero value launches the subprocess with no extras.
+type Options struct {
+	// EnvFiles are dotenv files read every time the subprocess starts. Env
+	// holds KEY=VALUE overrides, and IBazelEnv returns the variables iBazel
+	// exports to the subprocess.
+	EnvFiles  []string
+	Env       []string
+	IBazelEnv func() []string
+
+	// Sockets are passed to every subprocess using systemd style socket
+	// activation (LISTEN_FDS and LISTEN_PID).
+	Sockets *Sockets
+
+	// NotifyProtocol is the format a notify command uses to describe builds
+	// to its subprocess. Defaults to NotifyProtocolV1.
+	NotifyProtocol NotifyProtocol
+
+	// NotifyDelivery is how a notify command sends notifications to its
+	// subprocess. Defaults to NotifyDeliveryStdin.
+	NotifyDelivery NotifyDelivery
+
+	// Log receives a copy of everything the subprocess writes to stdout and
+	// stderr. Nothing is logged if it is nil.
+	Log *OutputLog
+
+	// PTY runs the subprocess in a pseudo-terminal owned by iBazel.
+	PTY bool
+
+	// StopSignal is sent to the process group to stop it. If it doesn't exit
+	// within GracePeriod it is killed. By default the process group is killed
+	// straight away.
+	StopSignal  syscall.Signal
+	GracePeriod time.Duration
+
+	// ReadinessProbe is checked after every start of the subprocess, and
+	// OnReady is called once it succeeds.
+	ReadinessProbe *ReadinessProbe
+	OnReady        func()
+
+	// Control receives the messages the subprocess writes to the file
+	// descriptor advertised in IBAZEL_CONTROL_FD. No control channel is opened
+	// if it is nil.
+	Control chan<- ControlMessage
+
+	// Stdout and Stderr show the output of the builds of the target. They
+	// default to os.Stdout and os.Stderr.
+	Stdout io.Writer
+	Stderr io.Writer
+	// OutputListener is given each line of output of those builds as it is
+	// written, if it is set.
+	OutputListener func(bazel.Line)
+}
+
+// newBazel returns a Bazel that builds the target of a command.
+func (o Options) newBazel(startupArgs []string, bazelArgs []string) bazel.Bazel {
+	b := bazelNew()
+	b.SetStartupArgs(startupArgs)
+	b.SetArguments(bazelArgs)
+	stdout, stderr := o.Stdout, o.Stderr
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	b.SetStdout(stdout)
+	b.SetStderr(stderr)
+	if o.OutputListener != nil {
+		b.SetOutputListener(o.OutputListener)
+	}
+	return b
+}
+
+// buildScript will be called by most implementations since this logic is
+// extremely common. It builds the target and returns the path of a script that
+// runs it.
+func buildScript(ctx context.Context, b bazel.Bazel, target string) (*bytes.Buffer, string) {
 	var filePattern strings.Builder
 	filePattern.WriteString("bazel_script_path*")
 	if runtime.GOOS == "windows" {
@@ -58,17 +142,65 @@ func start(b bazel.Bazel, target string, args []string) (*bytes.Buffer, process_
 	}
 
 	// Start by building the binary
-	_, outputBuffer, _ := b.Run("--script_path="+tmpfile.Name(), target)
+	_, outputBuffer, _ := b.Run(ctx, "--script_path="+tmpfile.Name(), target)
 
-	runScriptPath := tmpfile.Name()
+	return outputBuffer, tmpfile.Name()
+}
 
-	// Now that we have built the target, construct a executable form of it for
-	// execution in a go routine.
+// newProcess constructs an executable form of the built target for execution
+// in a go routine.
+func newProcess(runScriptPath string, args []string) process_group.ProcessGroup {
 	cmd := execCommand(runScriptPath, args...)
 	cmd.RootProcess().Stdout = os.Stdout
 	cmd.RootProcess().Stderr = os.Stderr
 
-	return outputBuffer, cmd
+	return cmd
+}
+
+// Used when only one of StopSignal and GracePeriod is set.
+const (
+	defaultStopSignal  = syscall.SIGTERM
+	defaultGracePeriod = 5 * time.Second
+)
+
+// stop ends every process in the process group and releases it.
+func stop(pg process_group.ProcessGroup, opts Options) {
+	sig, grace := opts.StopSignal, opts.GracePeriod
+	if sig == 0 && grace > 0 {
+		sig = defaultStopSignal
+	}
+	if sig != 0 && sig != syscall.SIGKILL {
+		if grace == 0 {
+			grace = defaultGracePeriod
+		}
+		if err := pg.Signal(sig); err != nil {
+			log.Errorf("Error sending %v to process: %v", sig, err)
+		} else {
+			exited := make(chan struct{})
+			go func() {
+				pg.Wait()
+				close(exited)
+			}()
+			select {
+			case <-exited:
+			case <-time.After(grace):
+				log.Logf("Process didn't exit within %v of %v, killing it", grace, sig)
+				pg.Kill()
+				<-exited
+			}
+			pg.Close()
+			return
+		}
+	}
+
+	// Kill it with fire by sending SIGKILL to the process PID which should
+	// propagate down to any subprocesses in the PGID (Process Group ID). To
+	// send to the PGID, send the signal to the negative of the process PID.
+	// Normally I would do this by calling c.cmd.Process.Signal, but that
+	// only goes to the PID not the PGID.
+	pg.Kill()
+	pg.Wait()
+	pg.Close()
 }
 
 func subprocessRunning(cmd *exec.Cmd) bool {
@@ -15,8 +15,14 @@
 package command
 
 import (
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/bazelbuild/bazel-watcher/bazel"
 	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
@@ -63,3 +69,47 @@ func TestSubprocessRunning(t *testing.T) {
 		t.Errorf("Subprocess finished with error: %v State: %v", err, cmd.ProcessState)
 	}
 }
+
+func TestStop(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Only SIGKILL can be sent on Windows")
+	}
+
+	dir, err := ioutil.TempDir("", "stop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stopped := filepath.Join(dir, "stopped")
+
+	for _, c := range []struct {
+		name      string
+		script    string
+		opts      Options
+		cleanExit bool
+	}{
+		{"kill", `trap 'touch "$0"; exit 0' TERM; sleep 10 & wait`, Options{}, false},
+		{"signal", `trap 'touch "$0"; exit 0' INT; sleep 10 & wait`, Options{StopSignal: syscall.SIGINT}, true},
+		{"grace period", `trap 'touch "$0"; exit 0' TERM; sleep 10 & wait`, Options{GracePeriod: 5 * time.Second}, true},
+		{"ignored", `trap '' TERM; while true; do sleep 0.1; done`, Options{GracePeriod: 100 * time.Millisecond}, false},
+	} {
+		os.Remove(stopped)
+		pg := process_group.Command("sh", "-c", c.script, stopped)
+		if err := pg.Start(); err != nil {
+			t.Fatal(err)
+		}
+		// Give the shell a moment to set up its trap.
+		time.Sleep(100 * time.Millisecond)
+
+		start := time.Now()
+		stop(pg, c.opts)
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("%s: stopping took %v", c.name, elapsed)
+		}
+
+		_, err := os.Stat(stopped)
+		if cleanExit := err == nil; cleanExit != c.cleanExit {
+			t.Errorf("%s: process exited cleanly = %v, want %v", c.name, cleanExit, c.cleanExit)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+)
+
+// errControlUnsupported is returned by openControl where there is no control
+// channel. The subprocess is started without one.
+var errControlUnsupported = errors.New("The control channel is not supported on this platform")
+
+// Verbs a subprocess can write to its control channel.
+const (
+	ControlReady   = "ready"
+	ControlRebuild = "rebuild"
+	ControlRestart = "restart"
+	ControlReload  = "reload"
+	ControlEvent   = "event"
+)
+
+// ControlMessage is a request written by the subprocess to its control
+// channel, one per line:
+//
+//   ready
+//   rebuild
+//   restart
+//   reload
+//   event <type> [data]
+type ControlMessage struct {
+	Verb string
+
+	// Type and Data are only set for "event" messages.
+	Type string
+	Data string
+}
+
+func parseControlMessage(line string) (ControlMessage, error) {
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	msg := ControlMessage{Verb: strings.ToLower(fields[0])}
+	switch msg.Verb {
+	case ControlReady, ControlRebuild, ControlRestart, ControlReload:
+		if len(fields) > 1 {
+			return msg, fmt.Errorf("%q doesn't take any arguments", msg.Verb)
+		}
+	case ControlEvent:
+		if len(fields) < 2 {
+			return msg, fmt.Errorf("%q needs an event type", msg.Verb)
+		}
+		msg.Type = fields[1]
+		if len(fields) > 2 {
+			msg.Data = fields[2]
+		}
+	default:
+		return msg, fmt.Errorf("Unknown control message %q", line)
+	}
+	return msg, nil
+}
+
+// readControlMessages forwards the messages read from r until it is closed.
+func readControlMessages(r io.ReadCloser, messages chan<- ControlMessage) {
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		msg, err := parseControlMessage(scanner.Text())
+		if err != nil {
+			log.Errorf("Error reading control message: %v", err)
+			continue
+		}
+		messages <- msg
+	}
+}
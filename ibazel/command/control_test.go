@@ -0,0 +1,82 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
+)
+
+func TestParseControlMessage(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want ControlMessage
+		err  bool
+	}{
+		{"ready", ControlMessage{Verb: ControlReady}, false},
+		{"REBUILD\r", ControlMessage{Verb: ControlRebuild}, false},
+		{"restart", ControlMessage{Verb: ControlRestart}, false},
+		{"reload", ControlMessage{Verb: ControlReload}, false},
+		{"event HMR_APPLIED", ControlMessage{Verb: ControlEvent, Type: "HMR_APPLIED"}, false},
+		{"event HMR_APPLIED {\"modules\": 3}", ControlMessage{Verb: ControlEvent, Type: "HMR_APPLIED", Data: "{\"modules\": 3}"}, false},
+		{"event", ControlMessage{Verb: ControlEvent}, true},
+		{"reload now", ControlMessage{Verb: ControlReload}, true},
+		{"moo", ControlMessage{Verb: "moo"}, true},
+	} {
+		got, err := parseControlMessage(c.in)
+		if (err != nil) != c.err {
+			t.Errorf("parseControlMessage(%q) error = %v, wanted error: %v", c.in, err, c.err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseControlMessage(%q)\nGot:  %+v\nWant: %+v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestOpenControl(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The control channel is not supported on Windows")
+	}
+
+	messages := make(chan ControlMessage, 10)
+	pg := process_group.Command("sh", "-c", `printf 'ready\nbogus\nevent PING 1\n' >&$IBAZEL_CONTROL_FD`)
+	w, err := openControl(pg, messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pg.Start(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	pg.Wait()
+
+	for _, want := range []ControlMessage{
+		{Verb: ControlReady},
+		{Verb: ControlEvent, Type: "PING", Data: "1"},
+	} {
+		select {
+		case got := <-messages:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Got %+v, want %+v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %+v", want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package command
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
+)
+
+// openControl passes the write end of a new pipe to the subprocess and
+// forwards everything it writes there to messages. The returned file must be
+// closed once the subprocess has started.
+func openControl(pg process_group.ProcessGroup, messages chan<- ControlMessage) (*os.File, error) {
+	if messages == nil {
+		return nil, nil
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := pg.RootProcess()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	// ExtraFiles[i] becomes file descriptor 3+i.
+	cmd.Env = append(cmd.Env, fmt.Sprintf("IBAZEL_CONTROL_FD=%d", 2+len(cmd.ExtraFiles)))
+
+	go readControlMessages(r, messages)
+	return w, nil
+}
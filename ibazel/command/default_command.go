@@ -16,7 +16,7 @@ package command
 
 import (
 	"bytes"
-	"os"
+	"context"
 
 	"github.com/bazelbuild/bazel-watcher/ibazel/log"
 	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
@@ -27,18 +27,23 @@ type defaultCommand struct {
 	startupArgs []string
 	bazelArgs   []string
 	args        []string
+	opts        Options
+	term        terminal
+	stopProbe   func()
+	script      string
 	pg          process_group.ProcessGroup
 }
 
 // DefaultCommand is the normal mode of interacting with iBazel. If you start a
 // server in this mode and notify of changes the server will be killed and
 // restarted.
-func DefaultCommand(startupArgs []string, bazelArgs []string, target string, args []string) Command {
+func DefaultCommand(startupArgs []string, bazelArgs []string, target string, args []string, opts Options) Command {
 	return &defaultCommand{
 		target:      target,
 		startupArgs: startupArgs,
 		bazelArgs:   bazelArgs,
 		args:        args,
+		opts:        opts,
 	}
 }
 
@@ -47,42 +52,83 @@ func (c *defaultCommand) Terminate() {
 		return
 	}
 
-	// Kill it with fire by sending SIGKILL to the process PID which should
-	// propagate down to any subprocesses in the PGID (Process Group ID). To
-	// send to the PGID, send the signal to the negative of the process PID.
-	// Normally I would do this by calling c.cmd.Process.Signal, but that
-	// only goes to the PID not the PGID.
-	c.pg.Kill()
-	c.pg.Wait()
-	c.pg.Close()
+	if c.stopProbe != nil {
+		c.stopProbe()
+		c.stopProbe = nil
+	}
+	// Give ibazel's terminal back before the subprocess is stopped.
+	c.term.detach()
+	stop(c.pg, c.opts)
 	c.pg = nil
 }
 
-func (c *defaultCommand) Start() (*bytes.Buffer, error) {
-	b := bazelNew()
-	b.SetStartupArgs(c.startupArgs)
-	b.SetArguments(c.bazelArgs)
-
-	b.WriteToStderr(true)
-	b.WriteToStdout(true)
+func (c *defaultCommand) Start(ctx context.Context) (*bytes.Buffer, error) {
+	b := c.opts.newBazel(c.startupArgs, c.bazelArgs)
 
 	var outputBuffer *bytes.Buffer
-	outputBuffer, c.pg = start(b, c.target, c.args)
+	outputBuffer, c.script = buildScript(ctx, b, c.target)
+	return outputBuffer, c.launch()
+}
 
-	c.pg.RootProcess().Env = os.Environ()
+// Restart starts the subprocess again without rebuilding it.
+func (c *defaultCommand) Restart() error {
+	if c.pg != nil {
+		c.Terminate()
+	}
+	if c.script == "" {
+		_, err := c.Start(context.Background())
+		return err
+	}
+	return c.launch()
+}
+
+// launch starts a new subprocess from the script that was last built.
+func (c *defaultCommand) launch() error {
+	c.pg = newProcess(c.script, c.args)
+
+	c.pg.RootProcess().Env = c.opts.environment()
 
 	var err error
+	if err = c.opts.Sockets.apply(c.pg); err != nil {
+		log.Errorf("Error passing sockets to process: %v", err)
+		return err
+	}
+
+	control, err := openControl(c.pg, c.opts.Control)
+	if err == errControlUnsupported {
+		log.Errorf("Warning: %v, starting the target without it", err)
+	} else if err != nil {
+		log.Errorf("Error opening control channel: %v", err)
+		return err
+	}
+	if control != nil {
+		// The subprocess has its own copy once it has started.
+		defer control.Close()
+	}
+
+	c.opts.Log.apply(c.pg, c.target)
+
+	if c.opts.PTY {
+		tty, err := c.term.attach(c.pg)
+		if err != nil {
+			log.Errorf("Error creating pseudo-terminal: %v", err)
+			return err
+		}
+		defer tty.Close()
+	}
+
 	if err = c.pg.Start(); err != nil {
 		log.Errorf("Error starting process: %v", err)
-		return outputBuffer, err
+		return err
 	}
+	c.stopProbe = c.opts.ReadinessProbe.start(c.opts.OnReady)
 	log.Log("Starting...")
-	return outputBuffer, nil
+	return nil
 }
 
-func (c *defaultCommand) NotifyOfChanges() *bytes.Buffer {
+func (c *defaultCommand) NotifyOfChanges(ctx context.Context, changes []string) *bytes.Buffer {
 	c.Terminate()
-	c.Start()
+	c.Start(ctx)
 	return nil
 }
 
@@ -15,10 +15,13 @@
 package command
 
 import (
+	"bytes"
+	"context"
 	"os"
 	"runtime"
 	"testing"
 
+	"github.com/bazelbuild/bazel-watcher/bazel"
 	mock_bazel "github.com/bazelbuild/bazel-watcher/bazel/testing"
 	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
 )
@@ -60,7 +63,7 @@ func TestDefaultCommand(t *testing.T) {
 	}
 
 	// This is synonymous with killing the job so use it to kill the job and test everything.
-	c.NotifyOfChanges()
+	c.NotifyOfChanges(context.Background(), nil)
 	assertKilled(t, toKill.RootProcess())
 }
 
@@ -77,7 +80,8 @@ func TestDefaultCommand_Start(t *testing.T) {
 
 	b := &mock_bazel.MockBazel{}
 
-	_, pg := start(b, "//path/to:target", []string{"moo"})
+	_, script := buildScript(context.Background(), b, "//path/to:target")
+	pg := newProcess(script, []string{"moo"})
 	pg.Start()
 
 	if pg.RootProcess().Stdout != os.Stdout {
@@ -91,3 +95,41 @@ func TestDefaultCommand_Start(t *testing.T) {
 		[]string{"Run", "--script_path=.*", "//path/to:target"},
 	})
 }
+
+func TestDefaultCommand_output(t *testing.T) {
+	execCommand = func(name string, args ...string) process_group.ProcessGroup {
+		if runtime.GOOS == "windows" {
+			// TODO(jchw): Remove hardcoded path.
+			return oldExecCommand("C:\\windows\\system32\\where")
+		}
+		return oldExecCommand("ls") // Every system has ls.
+	}
+	defer func() { execCommand = oldExecCommand }()
+
+	b := &mock_bazel.MockBazel{}
+	b.Output(
+		bazel.Line{Stream: bazel.Stdout, Text: "out"},
+		bazel.Line{Stream: bazel.Stderr, Text: "err"},
+	)
+	bazelNew = func() bazel.Bazel { return b }
+	defer func() { bazelNew = oldBazelNew }()
+
+	var stdout, stderr bytes.Buffer
+	c := &defaultCommand{
+		bazelArgs: []string{},
+		target:    "//path/to:target",
+		opts:      Options{Stdout: &stdout, Stderr: &stderr},
+	}
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.pg.Wait()
+	c.Terminate()
+
+	if got := stdout.String(); got != "out\n" {
+		t.Errorf("Stdout: got %q, want %q", got, "out\n")
+	}
+	if got := stderr.String(); got != "err\n" {
+		t.Errorf("Stderr: got %q, want %q", got, "err\n")
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+)
+
+var envKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ParseEnvFile reads a dotenv style file of KEY=VALUE lines and returns them
+// in the KEY=VALUE form used by exec.Cmd.Env. Blank lines and lines starting
+// with # are ignored, keys may be preceded by "export", and values may be
+// single quoted to be taken literally or double quoted to expand \n, \t, \"
+// and \\.
+func ParseEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv, err := parseEnvLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		env = append(env, kv)
+	}
+	return env, scanner.Err()
+}
+
+// ParseEnvVar checks an environment variable of the form KEY=VALUE.
+func ParseEnvVar(kv string) error {
+	i := strings.Index(kv, "=")
+	if i < 0 {
+		return fmt.Errorf("%q isn't of the form KEY=VALUE", kv)
+	}
+	if !envKeyRegex.MatchString(kv[:i]) {
+		return fmt.Errorf("%q isn't a valid environment variable name", kv[:i])
+	}
+	return nil
+}
+
+func parseEnvLine(line string) (string, error) {
+	line = strings.TrimPrefix(line, "export ")
+	i := strings.Index(line, "=")
+	if i < 0 {
+		return "", fmt.Errorf("%q isn't of the form KEY=VALUE", line)
+	}
+	key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+	if !envKeyRegex.MatchString(key) {
+		return "", fmt.Errorf("%q isn't a valid environment variable name", key)
+	}
+
+	switch {
+	case strings.HasPrefix(value, "'"):
+		end := strings.Index(value[1:], "'")
+		if end < 0 {
+			return "", fmt.Errorf("Unterminated quote in the value of %s", key)
+		}
+		value = value[1 : end+1]
+	case strings.HasPrefix(value, `"`):
+		var b strings.Builder
+		escaped, closed := false, false
+		for _, r := range value[1:] {
+			if escaped {
+				switch r {
+				case 'n':
+					b.WriteRune('\n')
+				case 't':
+					b.WriteRune('\t')
+				default:
+					b.WriteRune(r)
+				}
+				escaped = false
+				continue
+			}
+			if r == '\\' {
+				escaped = true
+				continue
+			}
+			if r == '"' {
+				closed = true
+				break
+			}
+			b.WriteRune(r)
+		}
+		if !closed {
+			return "", fmt.Errorf("Unterminated quote in the value of %s", key)
+		}
+		value = b.String()
+	default:
+		// Unquoted values end at a comment.
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+	}
+	return key + "=" + value, nil
+}
+
+// environment returns the environment of a subprocess: iBazel's own
+// environment, then the env files, then the overrides, then iBazel's
+// variables. Later values win.
+func (o Options) environment() []string {
+	env := os.Environ()
+	for _, path := range o.EnvFiles {
+		vars, err := ParseEnvFile(path)
+		if err != nil {
+			log.Errorf("Error reading env file: %v", err)
+			continue
+		}
+		env = append(env, vars...)
+	}
+	env = append(env, o.Env...)
+	if o.IBazelEnv != nil {
+		env = append(env, o.IBazelEnv()...)
+	}
+	return env
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeEnvFile(t *testing.T, dir string, contents string) string {
+	f, err := ioutil.TempFile(dir, "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestParseEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeEnvFile(t, dir, `
+# Comments and blank lines are skipped.
+PORT=8080
+export DEBUG = true
+EMPTY=
+URL=http://localhost:8080/#anchor # comment
+SINGLE='$HOME \n # not a comment'
+DOUBLE="line one\nline \"two\"" # comment
+`)
+	got, err := ParseEnvFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"PORT=8080",
+		"DEBUG=true",
+		"EMPTY=",
+		"URL=http://localhost:8080/#anchor",
+		`SINGLE=$HOME \n # not a comment`,
+		"DOUBLE=line one\nline \"two\"",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseEnvFile()\nGot:  %q\nWant: %q", got, want)
+	}
+
+	for _, contents := range []string{
+		"NO_EQUALS",
+		"1ABC=x",
+		"A B=x",
+		`QUOTE="unterminated`,
+		"QUOTE='unterminated",
+	} {
+		path := writeEnvFile(t, dir, contents)
+		if _, err := ParseEnvFile(path); err == nil {
+			t.Errorf("Expected %q to be invalid", contents)
+		} else if !strings.Contains(err.Error(), path+":1:") {
+			t.Errorf("Expected the error for %q to point at its line, got %v", contents, err)
+		}
+	}
+}
+
+func TestOptions_environment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("IBAZEL_ENV_TEST", "from ibazel")
+	defer os.Unsetenv("IBAZEL_ENV_TEST")
+
+	opts := Options{
+		EnvFiles: []string{
+			writeEnvFile(t, dir, "A=file\nB=file\nC=file\nIBAZEL_ENV_TEST=file"),
+			filepath.Join(dir, "missing"),
+		},
+		Env:       []string{"B=override", "C=override"},
+		IBazelEnv: func() []string { return []string{"C=ibazel"} },
+	}
+
+	// The last value of each variable is the one exec.Cmd uses.
+	got := map[string]string{}
+	for _, kv := range opts.environment() {
+		i := strings.Index(kv, "=")
+		got[kv[:i]] = kv[i+1:]
+	}
+	for key, want := range map[string]string{
+		"IBAZEL_ENV_TEST": "file",
+		"A":               "file",
+		"B":               "override",
+		"C":               "ibazel",
+	} {
+		if got[key] != want {
+			t.Errorf("%s = %q, want %q", key, got[key], want)
+		}
+	}
+}
@@ -16,8 +16,11 @@ package command
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/bazelbuild/bazel-watcher/ibazel/log"
 	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
@@ -28,96 +31,182 @@ type notifyCommand struct {
 	startupArgs []string
 	bazelArgs   []string
 	args        []string
-
-	pg    process_group.ProcessGroup
-	stdin io.WriteCloser
+	opts        Options
+	term        terminal
+	stopProbe   func()
+	script      string
+
+	pg process_group.ProcessGroup
+	// Notifications are written here. This is the subprocess's stdin unless
+	// they are delivered on a dedicated file descriptor.
+	notify io.WriteCloser
 }
 
 // NotifyCommand is an alternate mode for starting a command. In this mode the
-// command will be notified on stdin that the source files have changed.
-func NotifyCommand(startupArgs []string, bazelArgs []string, target string, args []string) Command {
+// command will be notified on stdin, or the file descriptor in IBAZEL_NOTIFY_FD
+// if opts.NotifyDelivery is NotifyDeliveryFD, that the source files have
+// changed, using the format selected by opts.NotifyProtocol.
+func NotifyCommand(startupArgs []string, bazelArgs []string, target string, args []string, opts Options) Command {
 	return &notifyCommand{
 		startupArgs: startupArgs,
 		target:      target,
 		bazelArgs:   bazelArgs,
 		args:        args,
+		opts:        opts,
 	}
 }
 
 func (c *notifyCommand) Terminate() {
-	if c.pg != nil && !subprocessRunning(c.pg.RootProcess()) {
-		return
+	if c.stopProbe != nil {
+		c.stopProbe()
+		c.stopProbe = nil
+	}
+	// Give ibazel's terminal back before the subprocess is stopped.
+	c.term.detach()
+	// Closing the notifications lets the subprocess see EOF, and keeps the
+	// pipe from leaking across restarts.
+	if c.notify != nil {
+		c.notify.Close()
+		c.notify = nil
+	}
+	if c.pg != nil && subprocessRunning(c.pg.RootProcess()) {
+		stop(c.pg, c.opts)
 	}
-
-	// Kill it with fire by sending SIGKILL to the process PID which should
-	// propagate down to any subprocesses in the PGID (Process Group ID). To
-	// send to the PGID, send the signal to the negative of the process PID.
-	// Normally I would do this by calling c.cmd.Process.Signal, but that
-	// only goes to the PID not the PGID.
-	c.pg.Kill()
-	c.pg.Wait()
-	c.pg.Close()
 	c.pg = nil
 }
 
-func (c *notifyCommand) Start() (*bytes.Buffer, error) {
-	b := bazelNew()
-	b.SetStartupArgs(c.startupArgs)
-	b.SetArguments(c.bazelArgs)
-
-	b.WriteToStderr(true)
-	b.WriteToStdout(true)
+func (c *notifyCommand) Start(ctx context.Context) (*bytes.Buffer, error) {
+	b := c.opts.newBazel(c.startupArgs, c.bazelArgs)
 
 	var outputBuffer *bytes.Buffer
-	outputBuffer, c.pg = start(b, c.target, c.args)
-	// Keep the writer around.
+	outputBuffer, c.script = buildScript(ctx, b, c.target)
+	return outputBuffer, c.launch()
+}
+
+// Restart starts the subprocess again without rebuilding it.
+func (c *notifyCommand) Restart() error {
+	if c.pg != nil {
+		c.Terminate()
+	}
+	if c.script == "" {
+		_, err := c.Start(context.Background())
+		return err
+	}
+	return c.launch()
+}
+
+// launch starts a new subprocess from the script that was last built.
+func (c *notifyCommand) launch() error {
+	c.pg = newProcess(c.script, c.args)
+
+	c.pg.RootProcess().Env = append(c.opts.environment(),
+		"IBAZEL_NOTIFY_CHANGES=y",
+		fmt.Sprintf("IBAZEL_NOTIFY_PROTOCOL=%d", c.protocol()))
+
 	var err error
-	c.stdin, err = c.pg.RootProcess().StdinPipe()
-	if err != nil {
-		log.Errorf("Error getting stdin pipe: %v", err)
-		return outputBuffer, err
+	if err = c.opts.Sockets.apply(c.pg); err != nil {
+		log.Errorf("Error passing sockets to process: %v", err)
+		return err
+	}
+
+	control, err := openControl(c.pg, c.opts.Control)
+	if err == errControlUnsupported {
+		log.Errorf("Warning: %v, starting the target without it", err)
+	} else if err != nil {
+		log.Errorf("Error opening control channel: %v", err)
+		return err
+	}
+	if control != nil {
+		// The subprocess has its own copy once it has started.
+		defer control.Close()
 	}
 
-	c.pg.RootProcess().Env = append(os.Environ(), "IBAZEL_NOTIFY_CHANGES=y")
+	c.opts.Log.apply(c.pg, c.target)
+
+	// Keep the writer around.
+	if c.opts.NotifyDelivery == NotifyDeliveryFD {
+		var notifyFD *os.File
+		c.notify, notifyFD, err = openNotifyFD(c.pg)
+		if err != nil {
+			log.Errorf("Error opening notification pipe: %v", err)
+			return err
+		}
+		defer notifyFD.Close()
+		// Leave stdin connected to the terminal.
+		c.pg.RootProcess().Stdin = os.Stdin
+
+		if c.opts.PTY {
+			tty, err := c.term.attach(c.pg)
+			if err != nil {
+				log.Errorf("Error creating pseudo-terminal: %v", err)
+				return err
+			}
+			defer tty.Close()
+		}
+	} else {
+		if c.opts.PTY {
+			log.Errorf("Not running in a pseudo-terminal because notifications are delivered on stdin. Use ibazel_notify_delivery=fd.")
+		}
+		c.notify, err = c.pg.RootProcess().StdinPipe()
+		if err != nil {
+			log.Errorf("Error getting stdin pipe: %v", err)
+			return err
+		}
+	}
 
 	if err = c.pg.Start(); err != nil {
 		log.Errorf("Error starting process: %v", err)
-		return outputBuffer, err
+		return err
 	}
+	c.stopProbe = c.opts.ReadinessProbe.start(c.opts.OnReady)
 	log.Log("Starting...")
-	return outputBuffer, nil
+	return nil
 }
 
-func (c *notifyCommand) NotifyOfChanges() *bytes.Buffer {
-	b := bazelNew()
-	b.SetStartupArgs(c.startupArgs)
-	b.SetArguments(c.bazelArgs)
+func (c *notifyCommand) NotifyOfChanges(ctx context.Context, changes []string) *bytes.Buffer {
+	b := c.opts.newBazel(c.startupArgs, c.bazelArgs)
 
-	b.WriteToStderr(true)
-	b.WriteToStdout(true)
+	if c.notify == nil {
+		// The subprocess was terminated, so there is nobody to notify.
+		outputBuffer, err := c.Start(ctx)
+		if err != nil {
+			log.Errorf("Error starting process: %v", err)
+		}
+		return outputBuffer
+	}
 
-	_, err := c.stdin.Write([]byte("IBAZEL_BUILD_STARTED\n"))
+	targets := []string{c.target}
+	_, err := c.notify.Write(c.protocol().buildStarted(targets, changes))
 	if err != nil {
-		log.Errorf("Error writing build to stdin: %s", err)
+		log.Errorf("Error writing build notification: %s", err)
 	}
 
-	outputBuffer, res := b.Build(c.target)
+	buildStart := time.Now()
+	outputBuffer, res := b.Build(ctx, c.target)
+	duration := time.Since(buildStart)
 	if res != nil {
 		log.Errorf("IBAZEL BUILD FAILURE: %v", res)
-		_, err := c.stdin.Write([]byte("IBAZEL_BUILD_COMPLETED FAILURE\n"))
+		_, err := c.notify.Write(c.protocol().buildCompleted(targets, changes, false, duration, outputBuffer))
 		if err != nil {
-			log.Errorf("Error writing failure to stdin: %s", err)
+			log.Errorf("Error writing failure notification: %s", err)
 		}
 	} else {
 		log.Log("IBAZEL BUILD SUCCESS")
-		_, err := c.stdin.Write([]byte("IBAZEL_BUILD_COMPLETED SUCCESS\n"))
+		_, err := c.notify.Write(c.protocol().buildCompleted(targets, changes, true, duration, outputBuffer))
 		if err != nil {
-			log.Errorf("Error writing success to stdin: %v", err)
+			log.Errorf("Error writing success notification: %v", err)
 		}
 	}
 	return outputBuffer
 }
 
+func (c *notifyCommand) protocol() NotifyProtocol {
+	if c.opts.NotifyProtocol == 0 {
+		return NotifyProtocolV1
+	}
+	return c.opts.NotifyProtocol
+}
+
 func (c *notifyCommand) IsSubprocessRunning() bool {
 	return c.pg != nil && subprocessRunning(c.pg.RootProcess())
 }
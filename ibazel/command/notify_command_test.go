@@ -15,7 +15,14 @@
 package command
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/bazelbuild/bazel-watcher/bazel"
@@ -38,7 +45,7 @@ func TestNotifyCommand(t *testing.T) {
 	}
 
 	var err error
-	c.stdin, err = pg.RootProcess().StdinPipe()
+	c.notify, err = pg.RootProcess().StdinPipe()
 	if err != nil {
 		t.Error(err)
 	}
@@ -49,25 +56,25 @@ func TestNotifyCommand(t *testing.T) {
 	bazelNew = func() bazel.Bazel { return b }
 	defer func() { bazelNew = oldBazelNew }()
 
-	c.NotifyOfChanges()
+	c.NotifyOfChanges(context.Background(), nil)
 	b.BuildError(errors.New("Demo error"))
-	c.NotifyOfChanges()
+	c.NotifyOfChanges(context.Background(), nil)
 	b.BuildError(nil)
-	c.NotifyOfChanges()
+	c.NotifyOfChanges(context.Background(), nil)
 
 	b.AssertActions(t, [][]string{
-		[]string{"WriteToStderr"},
-		[]string{"WriteToStdout"},
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
 		[]string{"Build", "//path/to:target"},
-		[]string{"WriteToStderr"},
-		[]string{"WriteToStdout"},
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
 		[]string{"Build", "//path/to:target"},
-		[]string{"WriteToStderr"},
-		[]string{"WriteToStdout"},
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
 		[]string{"Build", "//path/to:target"},
 	})
 
-	err = c.stdin.Close()
+	err = c.notify.Close()
 	if err != nil {
 		t.Error(err)
 	}
@@ -83,3 +90,212 @@ func TestNotifyCommand(t *testing.T) {
 		t.Errorf("Not equal.\nGot:  %s\nWant: %s", string(out), expected)
 	}
 }
+
+// closingBuffer is a notification pipe that keeps what it is sent.
+type closingBuffer struct {
+	bytes.Buffer
+}
+
+func (b *closingBuffer) Close() error { return nil }
+
+func TestNotifyCommand_output(t *testing.T) {
+	b := &mock_bazel.MockBazel{}
+	b.Output(
+		bazel.Line{Stream: bazel.Stdout, Text: "out"},
+		bazel.Line{Stream: bazel.Stderr, Text: "err"},
+	)
+	bazelNew = func() bazel.Bazel { return b }
+	defer func() { bazelNew = oldBazelNew }()
+
+	var stdout, stderr bytes.Buffer
+	var lines []bazel.Line
+	c := &notifyCommand{
+		bazelArgs: []string{},
+		target:    "//path/to:target",
+		notify:    &closingBuffer{},
+		opts: Options{
+			Stdout:         &stdout,
+			Stderr:         &stderr,
+			OutputListener: func(line bazel.Line) { lines = append(lines, line) },
+		},
+	}
+	c.NotifyOfChanges(context.Background(), nil)
+
+	if got := stdout.String(); got != "out\n" {
+		t.Errorf("Stdout: got %q, want %q", got, "out\n")
+	}
+	if got := stderr.String(); got != "err\n" {
+		t.Errorf("Stderr: got %q, want %q", got, "err\n")
+	}
+	want := []bazel.Line{
+		{Stream: bazel.Stdout, Text: "out"},
+		{Stream: bazel.Stderr, Text: "err"},
+	}
+	if !reflect.DeepEqual(want, lines) {
+		t.Errorf("Lines: got %v, want %v", lines, want)
+	}
+}
+
+func TestNotifyCommand_v2(t *testing.T) {
+	pg := process_group.Command("cat")
+
+	c := &notifyCommand{
+		bazelArgs: []string{},
+		opts:      Options{NotifyProtocol: NotifyProtocolV2},
+		pg:        pg,
+		target:    "//path/to:target",
+	}
+
+	var err error
+	c.notify, err = pg.RootProcess().StdinPipe()
+	if err != nil {
+		t.Error(err)
+	}
+
+	b := &mock_bazel.MockBazel{}
+	b.BuildError(errors.New("Demo error"))
+	bazelNew = func() bazel.Bazel { return b }
+	defer func() { bazelNew = oldBazelNew }()
+
+	c.NotifyOfChanges(context.Background(), []string{"/path/to/file.go"})
+
+	err = c.notify.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	out, err := pg.CombinedOutput()
+	if err != nil {
+		t.Error(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got: %s", out)
+	}
+	if !strings.HasPrefix(lines[0], `{"type":"BUILD_STARTED","targets":["//path/to:target"],"changes":["/path/to/file.go"]`) {
+		t.Errorf("Unexpected start message: %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], `{"type":"BUILD_COMPLETED","status":"FAILURE"`) {
+		t.Errorf("Unexpected completed message: %s", lines[1])
+	}
+}
+
+func TestNotifyCommand_deliverOnFD(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Notifying on a file descriptor is not supported on Windows")
+	}
+
+	out, err := ioutil.TempFile("", "notify_fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	execCommand = func(name string, args ...string) process_group.ProcessGroup {
+		return oldExecCommand("sh", "-c", `cat <&$IBAZEL_NOTIFY_FD >"$0"`, out.Name())
+	}
+	defer func() { execCommand = oldExecCommand }()
+
+	b := &mock_bazel.MockBazel{}
+	bazelNew = func() bazel.Bazel { return b }
+	defer func() { bazelNew = oldBazelNew }()
+
+	c := &notifyCommand{
+		bazelArgs: []string{},
+		opts:      Options{NotifyDelivery: NotifyDeliveryFD},
+		target:    "//path/to:target",
+	}
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if c.pg.RootProcess().Stdin != os.Stdin {
+		t.Errorf("Stdin should be left connected to ibazel's stdin")
+	}
+
+	c.NotifyOfChanges(context.Background(), nil)
+	c.notify.Close()
+	c.pg.Wait()
+
+	got, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "IBAZEL_BUILD_STARTED\nIBAZEL_BUILD_COMPLETED SUCCESS\n"
+	if string(got) != expected {
+		t.Errorf("Not equal.\nGot:  %s\nWant: %s", got, expected)
+	}
+}
+
+func TestNotifyCommand_terminateClosesNotify(t *testing.T) {
+	for _, exited := range []bool{false, true} {
+		pg := process_group.Command("cat")
+		c := &notifyCommand{
+			bazelArgs: []string{},
+			pg:        pg,
+			target:    "//path/to:target",
+		}
+		notify, err := pg.RootProcess().StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.notify = notify
+		if err := pg.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if exited {
+			// cat exits on EOF.
+			notify.Close()
+			pg.Wait()
+		}
+
+		c.Terminate()
+		if c.notify != nil || c.pg != nil {
+			t.Errorf("Terminate (exited %v) left notify %v and process group %v behind", exited, c.notify, c.pg)
+		}
+		if _, err := notify.Write([]byte("x")); err == nil {
+			t.Errorf("Terminate (exited %v) didn't close the notification pipe", exited)
+		}
+	}
+}
+
+func TestNotifyCommand_noControl(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Needs a POSIX shell")
+	}
+
+	out, err := ioutil.TempFile("", "notify_control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+
+	execCommand = func(name string, args ...string) process_group.ProcessGroup {
+		return oldExecCommand("sh", "-c", `echo "${IBAZEL_CONTROL_FD-none}" >"$0"`, out.Name())
+	}
+	defer func() { execCommand = oldExecCommand }()
+
+	b := &mock_bazel.MockBazel{}
+	bazelNew = func() bazel.Bazel { return b }
+	defer func() { bazelNew = oldBazelNew }()
+
+	c := &notifyCommand{
+		bazelArgs: []string{},
+		target:    "//path/to:target",
+	}
+	if _, err := c.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.pg.Wait()
+	c.Terminate()
+
+	got, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "none\n" {
+		t.Errorf("A notify target without ibazel_control got IBAZEL_CONTROL_FD=%s", got)
+	}
+}
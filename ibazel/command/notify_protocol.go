@@ -0,0 +1,196 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// NotifyProtocol is the format used to tell a notify command about builds.
+type NotifyProtocol int
+
+const (
+	// NotifyProtocolV1 writes IBAZEL_BUILD_STARTED and
+	// IBAZEL_BUILD_COMPLETED SUCCESS|FAILURE lines.
+	NotifyProtocolV1 NotifyProtocol = 1
+	// NotifyProtocolV2 writes one JSON object per line describing the build.
+	NotifyProtocolV2 NotifyProtocol = 2
+)
+
+// NotifyDelivery is how notifications reach a notify command.
+type NotifyDelivery int
+
+const (
+	// NotifyDeliveryStdin writes notifications to the subprocess's stdin.
+	NotifyDeliveryStdin NotifyDelivery = iota
+	// NotifyDeliveryFD writes notifications to a pipe whose read end is
+	// inherited by the subprocess as the file descriptor in IBAZEL_NOTIFY_FD.
+	// The subprocess's stdin stays connected to the terminal.
+	NotifyDeliveryFD
+)
+
+// maxNotifyLogBytes is how much of the end of a failed build's output is sent
+// to the subprocess with the v2 protocol.
+const maxNotifyLogBytes = 16 * 1024
+
+// This RegExp will match ANSI escape codes.
+var escapeCodeCleanerRegex = regexp.MustCompile("\\x1B\\[[\\x30-\\x3F]*[\\x20-\\x2F]*[\\x40-\\x7E]")
+
+// Matches the line Bazel prints before listing the outputs of a target.
+var upToDateRegex = regexp.MustCompile(`^Target \S+ up-to-date:?`)
+
+// ParseNotifyProtocol parses the value of the ibazel_notify_protocol tag or
+// the IBAZEL_NOTIFY_PROTOCOL environment variable.
+func ParseNotifyProtocol(v string) (NotifyProtocol, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", "1", "v1":
+		return NotifyProtocolV1, nil
+	case "2", "v2":
+		return NotifyProtocolV2, nil
+	}
+	return NotifyProtocolV1, fmt.Errorf("Unknown notify protocol %q, expected 1 or 2", v)
+}
+
+// ParseNotifyDelivery parses the value of the ibazel_notify_delivery tag or the
+// IBAZEL_NOTIFY_DELIVERY environment variable.
+func ParseNotifyDelivery(v string) (NotifyDelivery, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", "stdin":
+		return NotifyDeliveryStdin, nil
+	case "fd":
+		return NotifyDeliveryFD, nil
+	}
+	return NotifyDeliveryStdin, fmt.Errorf("Unknown notify delivery %q, expected stdin or fd", v)
+}
+
+// notifyMessage is a single line of the v2 protocol.
+type notifyMessage struct {
+	Type         string   `json:"type"`
+	Status       string   `json:"status,omitempty"`
+	Targets      []string `json:"targets"`
+	Changes      []string `json:"changes"`
+	Outputs      []string `json:"outputs,omitempty"`
+	DurationMs   int64    `json:"durationMs,omitempty"`
+	Log          string   `json:"log,omitempty"`
+	LogTruncated bool     `json:"logTruncated,omitempty"`
+}
+
+func (p NotifyProtocol) buildStarted(targets, changes []string) []byte {
+	if p != NotifyProtocolV2 {
+		return []byte("IBAZEL_BUILD_STARTED\n")
+	}
+	return marshalNotifyMessage(&notifyMessage{
+		Type:    "BUILD_STARTED",
+		Targets: nonNil(targets),
+		Changes: nonNil(changes),
+	})
+}
+
+func (p NotifyProtocol) buildCompleted(targets, changes []string, success bool, duration time.Duration, output *bytes.Buffer) []byte {
+	status := "SUCCESS"
+	if !success {
+		status = "FAILURE"
+	}
+	if p != NotifyProtocolV2 {
+		return []byte("IBAZEL_BUILD_COMPLETED " + status + "\n")
+	}
+
+	msg := &notifyMessage{
+		Type:       "BUILD_COMPLETED",
+		Status:     status,
+		Targets:    nonNil(targets),
+		Changes:    nonNil(changes),
+		DurationMs: int64(duration / time.Millisecond),
+	}
+	if output != nil {
+		clean := escapeCodeCleanerRegex.ReplaceAll(output.Bytes(), nil)
+		if success {
+			msg.Outputs = parseOutputs(clean)
+		} else {
+			msg.Log, msg.LogTruncated = tail(clean, maxNotifyLogBytes)
+		}
+	}
+	return marshalNotifyMessage(msg)
+}
+
+func marshalNotifyMessage(msg *notifyMessage) []byte {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		// None of the fields can fail to marshal.
+		panic(err)
+	}
+	return append(b, '\n')
+}
+
+// BuildOutputs returns the output files listed in the output of a successful
+// build, relative to the workspace root.
+func BuildOutputs(output *bytes.Buffer) []string {
+	if output == nil {
+		return nil
+	}
+	return parseOutputs(escapeCodeCleanerRegex.ReplaceAll(output.Bytes(), nil))
+}
+
+// parseOutputs finds the output files Bazel lists after each
+// "Target //foo:bar up-to-date:" line.
+func parseOutputs(output []byte) []string {
+	var outputs []string
+	inTarget := false
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if upToDateRegex.MatchString(line) {
+			inTarget = true
+			continue
+		}
+		if !inTarget {
+			continue
+		}
+		if !strings.HasPrefix(line, "  ") {
+			inTarget = false
+			continue
+		}
+		if f := strings.TrimSpace(line); f != "" && f != "(nothing to build)" {
+			outputs = append(outputs, f)
+		}
+	}
+	return outputs
+}
+
+// tail returns at most the last n bytes of b, starting at a line boundary if
+// it was truncated.
+func tail(b []byte, n int) (string, bool) {
+	if len(b) <= n {
+		return string(b), false
+	}
+	b = b[len(b)-n:]
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		b = b[i+1:]
+	}
+	return string(b), true
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNotifyProtocol(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want NotifyProtocol
+		err  bool
+	}{
+		{"", NotifyProtocolV1, false},
+		{"1", NotifyProtocolV1, false},
+		{"v2", NotifyProtocolV2, false},
+		{" 2 ", NotifyProtocolV2, false},
+		{"3", NotifyProtocolV1, true},
+	} {
+		got, err := ParseNotifyProtocol(c.in)
+		if (err != nil) != c.err || got != c.want {
+			t.Errorf("ParseNotifyProtocol(%q) = %v, %v; want %v, error: %v", c.in, got, err, c.want, c.err)
+		}
+	}
+}
+
+func TestParseNotifyDelivery(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want NotifyDelivery
+		err  bool
+	}{
+		{"", NotifyDeliveryStdin, false},
+		{"stdin", NotifyDeliveryStdin, false},
+		{"FD", NotifyDeliveryFD, false},
+		{"signal", NotifyDeliveryStdin, true},
+	} {
+		got, err := ParseNotifyDelivery(c.in)
+		if (err != nil) != c.err || got != c.want {
+			t.Errorf("ParseNotifyDelivery(%q) = %v, %v; want %v, error: %v", c.in, got, err, c.want, c.err)
+		}
+	}
+}
+
+func TestNotifyProtocolV1(t *testing.T) {
+	p := NotifyProtocolV1
+	if got := string(p.buildStarted([]string{"//a"}, []string{"/a.go"})); got != "IBAZEL_BUILD_STARTED\n" {
+		t.Errorf("buildStarted = %q", got)
+	}
+	if got := string(p.buildCompleted(nil, nil, false, time.Second, nil)); got != "IBAZEL_BUILD_COMPLETED FAILURE\n" {
+		t.Errorf("buildCompleted = %q", got)
+	}
+}
+
+func TestNotifyProtocolV2_success(t *testing.T) {
+	output := bytes.NewBufferString(strings.Join([]string{
+		"INFO: Analyzed target //path/to:target (0 packages loaded).",
+		"\x1b[32mINFO: \x1b[0mFound 1 target...",
+		"Target //path/to:target up-to-date:",
+		"  bazel-bin/path/to/target",
+		"  bazel-bin/path/to/target.runfiles_manifest",
+		"INFO: Elapsed time: 0.123s, Critical Path: 0.01s",
+	}, "\n"))
+
+	line := NotifyProtocolV2.buildCompleted([]string{"//path/to:target"}, []string{"/ws/path/to/main.go"}, true, 1500*time.Millisecond, output)
+	if !bytes.HasSuffix(line, []byte("\n")) || bytes.Count(line, []byte("\n")) != 1 {
+		t.Fatalf("Expected exactly one line, got %q", line)
+	}
+
+	var msg notifyMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		t.Fatal(err)
+	}
+	want := notifyMessage{
+		Type:       "BUILD_COMPLETED",
+		Status:     "SUCCESS",
+		Targets:    []string{"//path/to:target"},
+		Changes:    []string{"/ws/path/to/main.go"},
+		Outputs:    []string{"bazel-bin/path/to/target", "bazel-bin/path/to/target.runfiles_manifest"},
+		DurationMs: 1500,
+	}
+	if !reflect.DeepEqual(msg, want) {
+		t.Errorf("Not equal.\nGot:  %+v\nWant: %+v", msg, want)
+	}
+}
+
+func TestNotifyProtocolV2_failure(t *testing.T) {
+	output := bytes.NewBufferString(strings.Repeat("noise\n", maxNotifyLogBytes) + "ERROR: it broke\n")
+
+	var msg notifyMessage
+	if err := json.Unmarshal(NotifyProtocolV2.buildCompleted(nil, nil, false, 0, output), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Status != "FAILURE" || !msg.LogTruncated {
+		t.Errorf("Unexpected message: %+v", msg)
+	}
+	if len(msg.Log) > maxNotifyLogBytes || !strings.HasPrefix(msg.Log, "noise\n") || !strings.HasSuffix(msg.Log, "ERROR: it broke\n") {
+		t.Errorf("Log wasn't truncated at a line boundary: %q...", msg.Log[:20])
+	}
+	if msg.Targets == nil || msg.Changes == nil {
+		t.Errorf("Targets and changes should be empty lists, not null")
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
+)
+
+// Number of rotated log files kept next to the current one.
+const outputLogBackups = 3
+
+// How long the output has to be idle, or at most pending, before a quiet log
+// shows its tail.
+var (
+	quietSettle  = 500 * time.Millisecond
+	quietMaxWait = 5 * time.Second
+)
+
+// OutputLog tees the output of every subprocess a Command starts into a log
+// file. Each subprocess starts a new section of the log, and the file is
+// rotated once it grows past its maximum size.
+type OutputLog struct {
+	path    string
+	maxSize int64
+
+	lock    sync.Mutex // guards file, size, starts and failing
+	file    *os.File
+	size    int64
+	starts  int
+	failing bool // whether the last write to the log failed
+
+	// When set, the subprocess output only reaches the terminal through tail.
+	tail *quietTail
+}
+
+// OpenOutputLog appends to the log file at path, creating it and its
+// directory if needed. Files are never rotated if maxSize is 0. If quietLines
+// is more than 0 the output isn't shown as it is written, only the last
+// quietLines lines once the subprocess goes quiet.
+func OpenOutputLog(path string, maxSize int64, quietLines int) (*OutputLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	l := &OutputLog{
+		path:    path,
+		maxSize: maxSize,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	if quietLines > 0 {
+		l.tail = newQuietTail(os.Stdout, quietLines, path)
+	}
+	return l, nil
+}
+
+// OutputLogPath returns where the output of target is logged inside dir.
+func OutputLogPath(dir string, target string) string {
+	parts := strings.FieldsFunc(target, func(r rune) bool {
+		return r == '@' || r == '/' || r == ':'
+	})
+	return filepath.Join(dir, strings.Join(parts, "_")+".log")
+}
+
+// Path returns the path of the current log file.
+func (l *OutputLog) Path() string {
+	if l == nil {
+		return ""
+	}
+	return l.path
+}
+
+// Close the log file.
+func (l *OutputLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.tail != nil {
+		l.tail.flushNow()
+	}
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Write appends p to the log, rotating the file first if p doesn't fit. It
+// never fails: errors are logged once, and the subprocess output still has to
+// reach the terminal alongside the log.
+func (l *OutputLog) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := l.write(p); err != nil {
+		if !l.failing {
+			log.Errorf("Error writing to %s: %v", l.path, err)
+		}
+		l.failing = true
+	} else {
+		l.failing = false
+	}
+	return len(p), nil
+}
+
+func (l *OutputLog) write(p []byte) (int, error) {
+	if l.file == nil {
+		return 0, os.ErrClosed
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Errorf("Error rotating %s: %v", l.path, err)
+			// Try again once another maxSize has been written.
+			l.size = 0
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *OutputLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotate moves path to path.1, path.1 to path.2 and so on, and starts a new
+// file at path. If that fails the old file is kept open.
+func (l *OutputLog) rotate() error {
+	for n := outputLogBackups - 1; n > 0; n-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, n), fmt.Sprintf("%s.%d", l.path, n+1))
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	old := l.file
+	if err := l.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// apply starts a new section of the log and tees the output of the subprocess
+// into it. It must be called before the subprocess is started.
+func (l *OutputLog) apply(pg process_group.ProcessGroup, target string) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	l.starts++
+	header := fmt.Sprintf("===== %s: start %d of %s =====\n", time.Now().Format(time.RFC3339), l.starts, target)
+	if l.size > 0 {
+		header = "\n" + header
+	}
+	if _, err := l.write([]byte(header)); err != nil {
+		log.Errorf("Error writing to %s: %v", l.path, err)
+	}
+	l.lock.Unlock()
+
+	cmd := pg.RootProcess()
+	cmd.Env = append(cmd.Env, "IBAZEL_LOG_FILE="+l.path)
+
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if cmd.Stdout != nil {
+		stdout = cmd.Stdout
+	}
+	if cmd.Stderr != nil {
+		stderr = cmd.Stderr
+	}
+	if l.tail != nil {
+		// Whatever the previous subprocess printed last is still worth seeing.
+		l.tail.flushNow()
+		stdout, stderr = l.tail, l.tail
+	}
+	cmd.Stdout = io.MultiWriter(stdout, l)
+	cmd.Stderr = io.MultiWriter(stderr, l)
+}
+
+// quietTail keeps the last lines written to it and shows them once the writes
+// settle down.
+type quietTail struct {
+	out     io.Writer
+	max     int
+	logPath string
+
+	lock    sync.Mutex // guards everything below
+	partial []byte
+	lines   [][]byte
+	dropped int
+	first   time.Time
+	timer   *time.Timer
+}
+
+func newQuietTail(out io.Writer, max int, logPath string) *quietTail {
+	return &quietTail{
+		out:     out,
+		max:     max,
+		logPath: logPath,
+	}
+}
+
+func (t *quietTail) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.add(t.partial[:i+1])
+		t.partial = t.partial[i+1:]
+	}
+
+	if t.first.IsZero() {
+		t.first = time.Now()
+	}
+	if time.Since(t.first) >= quietMaxWait {
+		t.flush()
+		return len(p), nil
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(quietSettle, func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		t.flush()
+	})
+	return len(p), nil
+}
+
+func (t *quietTail) add(line []byte) {
+	t.lines = append(t.lines, append([]byte(nil), line...))
+	if len(t.lines) > t.max {
+		t.lines = t.lines[1:]
+		t.dropped++
+	}
+}
+
+// flush shows the lines kept since the last flush.
+func (t *quietTail) flush() {
+	if len(t.partial) > 0 {
+		t.add(append(t.partial, '\n'))
+		t.partial = nil
+	}
+	if len(t.lines) == 0 {
+		return
+	}
+	if t.dropped > 0 {
+		log.Logf("%d lines of output hidden, see %s", t.dropped, t.logPath)
+	}
+	for _, line := range t.lines {
+		t.out.Write(line)
+	}
+	t.lines = nil
+	t.dropped = 0
+	t.first = time.Time{}
+}
+
+// flushNow shows anything that is still pending without waiting for the
+// output to settle.
+func (t *quietTail) flushNow() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.flush()
+}
@@ -0,0 +1,204 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
+)
+
+func TestOutputLogPath(t *testing.T) {
+	for _, c := range []struct {
+		target string
+		want   string
+	}{
+		{"//foo/bar:baz", "foo_bar_baz.log"},
+		{"@repo//:server", "repo_server.log"},
+		{"//:main", "main.log"},
+	} {
+		if got := OutputLogPath("logs", c.target); got != filepath.Join("logs", c.want) {
+			t.Errorf("OutputLogPath(%q) = %q, want %q", c.target, got, filepath.Join("logs", c.want))
+		}
+	}
+}
+
+func TestOutputLog_rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "logs", "target.log")
+	l, err := OpenOutputLog(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n", "eeeeee\n"} {
+		if _, err := l.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for suffix, want := range map[string]string{
+		"":   "eeeeee\n",
+		".1": "dddddd\n",
+		".2": "cccccc\n",
+		".3": "bbbbbb\n",
+	} {
+		got, err := ioutil.ReadFile(path + suffix)
+		if err != nil {
+			t.Errorf("Error reading %s: %v", path+suffix, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", path+suffix, got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".4"); !os.IsNotExist(err) {
+		t.Errorf("Expected only %d old logs to be kept", outputLogBackups)
+	}
+}
+
+func TestOutputLog_rotateFails(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Uses sh")
+	}
+
+	dir, err := ioutil.TempDir("", "output_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "target.log")
+	l, err := OpenOutputLog(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Non-empty directories in the way of every backup make the renames fail.
+	for n := 1; n <= outputLogBackups; n++ {
+		if err := os.MkdirAll(filepath.Join(fmt.Sprintf("%s.%d", path, n), "x"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stdout bytes.Buffer
+	pg := process_group.Command("sh", "-c", "echo aaaaaa; echo bbbbbb; echo cccccc")
+	pg.RootProcess().Stdout = &stdout
+	l.apply(pg, "//:target")
+	if err := pg.RootProcess().Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "aaaaaa\nbbbbbb\ncccccc\n"; got != want {
+		t.Errorf("Got stdout %q, want %q", got, want)
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(got), "aaaaaa\nbbbbbb\ncccccc\n") {
+		t.Errorf("Expected the output to stay in the old log, got:\n%s", got)
+	}
+}
+
+func TestOutputLog_apply(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Uses sh")
+	}
+
+	dir, err := ioutil.TempDir("", "output_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "target.log")
+	l, err := OpenOutputLog(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for _, s := range []string{"first", "second"} {
+		var stdout, stderr bytes.Buffer
+		pg := process_group.Command("sh", "-c", `echo "$1 out"; echo "$1 err" >&2; echo "$IBAZEL_LOG_FILE" >&2`, "sh", s)
+		pg.RootProcess().Stdout = &stdout
+		pg.RootProcess().Stderr = &stderr
+		l.apply(pg, "//:target")
+		if err := pg.RootProcess().Run(); err != nil {
+			t.Fatal(err)
+		}
+		if got := stdout.String(); got != s+" out\n" {
+			t.Errorf("Got stdout %q, want %q", got, s+" out\n")
+		}
+		if got := stderr.String(); got != s+" err\n"+path+"\n" {
+			t.Errorf("Got stderr %q, want %q", got, s+" err\n"+path+"\n")
+		}
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := strings.Split(string(got), "=====\n")
+	if len(sections) != 3 {
+		t.Fatalf("Expected 2 sections in the log, got:\n%s", got)
+	}
+	for n, want := range []string{"start 1 of //:target", "first out", "start 2 of //:target", "second out"} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("Log section %d is missing %q:\n%s", n, want, got)
+		}
+	}
+}
+
+func TestQuietTail(t *testing.T) {
+	oldSettle := quietSettle
+	quietSettle = 10 * time.Millisecond
+	defer func() { quietSettle = oldSettle }()
+
+	var out bytes.Buffer
+	tail := newQuietTail(&out, 2, "target.log")
+	tail.Write([]byte("one\ntwo\nthr"))
+	tail.Write([]byte("ee\nfour"))
+
+	tail.lock.Lock()
+	if out.Len() != 0 {
+		t.Errorf("Expected nothing to be shown before the output settles, got %q", out.String())
+	}
+	tail.lock.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	tail.lock.Lock()
+	got := out.String()
+	tail.lock.Unlock()
+	if want := "three\nfour\n"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package command
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// How long the output of the previous subprocess may take to drain before its
+// pseudo-terminal is closed from this side.
+const ptyDrainTimeout = time.Second
+
+// How often stdin is checked for input while a subprocess is attached.
+const ptyInputPoll = 100 * time.Millisecond
+
+// terminal runs each subprocess of a command under its own pseudo-terminal.
+// Input and window size changes are forwarded to the current subprocess, and
+// its output is copied to whatever its Stdout was before it was attached.
+// ibazel's own terminal is in raw mode while a subprocess is attached, so
+// every key, including Ctrl-C, reaches the subprocess.
+type terminal struct {
+	lock    sync.Mutex // guards master and restore
+	master  *os.File
+	restore func()
+
+	forwardOnce sync.Once
+	outputDone  chan struct{}
+}
+
+// attach gives the subprocess a new pseudo-terminal. It must be called before
+// the subprocess is started, and the returned file must be closed once it has
+// started.
+func (t *terminal) attach(pg process_group.ProcessGroup) (*os.File, error) {
+	t.drain()
+
+	// The pseudo-terminal becomes the controlling terminal of the subprocess.
+	if err := pg.NewSession(); err != nil {
+		return nil, err
+	}
+	master, tty, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	// This fails harmlessly when ibazel's stdin isn't a terminal.
+	pty.InheritSize(os.Stdin, master)
+
+	cmd := pg.RootProcess()
+	var out io.Writer = os.Stdout
+	if cmd.Stdout != nil {
+		out = cmd.Stdout
+	}
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+
+	t.lock.Lock()
+	t.master = master
+	restore, err := makeRaw(int(os.Stdin.Fd()))
+	if err == nil {
+		t.restore = restore
+	}
+	t.lock.Unlock()
+
+	done := make(chan struct{})
+	t.outputDone = done
+	go func() {
+		defer close(done)
+		// Reading fails with EIO once the subprocess exits.
+		io.Copy(out, master)
+		master.Close()
+		t.lock.Lock()
+		if t.master == master {
+			t.detachLocked()
+		}
+		t.lock.Unlock()
+	}()
+
+	t.forwardOnce.Do(t.forward)
+	return tty, nil
+}
+
+// detach stops forwarding input to the current subprocess and takes ibazel's
+// terminal out of raw mode. Its output is still copied until it exits.
+func (t *terminal) detach() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.detachLocked()
+}
+
+func (t *terminal) detachLocked() {
+	t.master = nil
+	if t.restore != nil {
+		t.restore()
+		t.restore = nil
+	}
+}
+
+// drain waits for the output of the previous subprocess to be copied, so it
+// doesn't mix with the output of the next one.
+func (t *terminal) drain() {
+	if t.outputDone == nil {
+		return
+	}
+	select {
+	case <-t.outputDone:
+		return
+	case <-time.After(ptyDrainTimeout):
+	}
+	// Something the subprocess started still holds the pseudo-terminal open.
+	log.Errorf("Timed out waiting for the output of the previous subprocess")
+	t.detach()
+	<-t.outputDone
+}
+
+// forward copies ibazel's stdin and window size to the current subprocess for
+// as long as ibazel runs. Stdin is only read while a subprocess is attached,
+// so that it is left alone for bazel in between.
+func (t *terminal) forward() {
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			t.lock.Lock()
+			if t.master != nil {
+				pty.InheritSize(os.Stdin, t.master)
+			}
+			t.lock.Unlock()
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, 4096)
+		fds := []unix.PollFd{{Fd: int32(os.Stdin.Fd()), Events: unix.POLLIN}}
+		for {
+			t.lock.Lock()
+			attached := t.master != nil
+			t.lock.Unlock()
+			if !attached {
+				time.Sleep(ptyInputPoll)
+				continue
+			}
+			if n, err := unix.Poll(fds, int(ptyInputPoll/time.Millisecond)); n <= 0 {
+				if err != nil && err != unix.EINTR {
+					log.Errorf("Error waiting for input: %v", err)
+					return
+				}
+				continue
+			}
+
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				t.lock.Lock()
+				if t.master != nil {
+					if _, err := t.master.Write(buf[:n]); err != nil {
+						log.Errorf("Error forwarding input to the subprocess: %v", err)
+					}
+				}
+				t.lock.Unlock()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// makeRaw puts the terminal fd into raw mode, except for output processing so
+// that ibazel's own output still looks right, and returns a function that
+// restores its previous state.
+func makeRaw(fd int) (func(), error) {
+	old, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+	return func() {
+		unix.IoctlSetTermios(fd, ioctlSetTermios, old)
+	}, nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// +build !windows
+
+package command
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
+)
+
+func TestTerminalAttach(t *testing.T) {
+	var out bytes.Buffer
+	pg := process_group.Command("sh", "-c", `test -t 0 && test -t 1 && test -t 2 && printf 'in a terminal\n'`)
+	pg.RootProcess().Stdout = &out
+
+	var term terminal
+	tty, err := term.attach(pg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pg.Start(); err != nil {
+		t.Fatal(err)
+	}
+	tty.Close()
+	if err := pg.Wait(); err != nil {
+		t.Errorf("Subprocess wasn't run in a terminal: %v", err)
+	}
+
+	select {
+	case <-term.outputDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the subprocess output")
+	}
+	term.lock.Lock()
+	if term.master != nil {
+		t.Error("Expected the pseudo-terminal to be detached once the subprocess exited")
+	}
+	term.lock.Unlock()
+	// The terminal translates "\n" into "\r\n".
+	if got := strings.TrimSpace(out.String()); got != "in a terminal" {
+		t.Errorf("Got output %q, want %q", got, "in a terminal")
+	}
+}
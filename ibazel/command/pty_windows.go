@@ -0,0 +1,30 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"errors"
+	"os"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
+)
+
+type terminal struct{}
+
+func (t *terminal) attach(pg process_group.ProcessGroup) (*os.File, error) {
+	return nil, errors.New("Running in a pseudo-terminal is not supported on Windows")
+}
+
+func (t *terminal) detach() {}
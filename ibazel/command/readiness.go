@@ -0,0 +1,109 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// How often a readiness probe is checked, and how long each check may take.
+var (
+	probeInterval = 200 * time.Millisecond
+	probeTimeout  = time.Second
+)
+
+// ReadinessProbe checks whether a subprocess has finished starting up, either
+// by making an HTTP request that has to succeed or by connecting to a TCP
+// port.
+type ReadinessProbe struct {
+	url *url.URL
+}
+
+// ParseReadinessProbe parses a probe of the form "http://host:port/path",
+// "https://host:port/path" or "tcp://host:port".
+func ParseReadinessProbe(s string) (*ReadinessProbe, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return nil, fmt.Errorf("Readiness probe %q needs a host and port: %v", s, err)
+		}
+	default:
+		return nil, fmt.Errorf("Readiness probe %q must start with http://, https:// or tcp://", s)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Readiness probe %q has no host", s)
+	}
+	return &ReadinessProbe{url: u}, nil
+}
+
+func (p *ReadinessProbe) String() string {
+	return p.url.String()
+}
+
+func (p *ReadinessProbe) check() error {
+	if p.url.Scheme == "tcp" {
+		conn, err := net.DialTimeout("tcp", p.url.Host, probeTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := http.Client{Timeout: probeTimeout}
+	res, err := client.Get(p.url.String())
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("%s returned %s", p.url, res.Status)
+	}
+	return nil
+}
+
+// start checks the probe until it succeeds, then calls ready. The returned
+// function stops checking.
+func (p *ReadinessProbe) start(ready func()) func() {
+	if p == nil || ready == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(probeInterval)
+		defer ticker.Stop()
+		for {
+			if p.check() == nil {
+				ready()
+				return
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseReadinessProbe(t *testing.T) {
+	for _, c := range []struct {
+		in  string
+		err bool
+	}{
+		{"http://localhost:8080/healthz", false},
+		{"https://localhost", false},
+		{"tcp://localhost:5432", false},
+		{"tcp://localhost", true},
+		{"localhost:8080", true},
+		{"ftp://localhost", true},
+		{"http://", true},
+	} {
+		_, err := ParseReadinessProbe(c.in)
+		if (err != nil) != c.err {
+			t.Errorf("ParseReadinessProbe(%q) error = %v, wanted error: %v", c.in, err, c.err)
+		}
+	}
+}
+
+func TestReadinessProbe_start(t *testing.T) {
+	oldInterval := probeInterval
+	probeInterval = 10 * time.Millisecond
+	defer func() { probeInterval = oldInterval }()
+
+	healthy := make(chan bool, 1)
+	healthy <- false
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ok := <-healthy
+		healthy <- true
+		if !ok {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	for _, s := range []string{server.URL + "/healthz", "tcp://" + ln.Addr().String()} {
+		p, err := ParseReadinessProbe(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ready := make(chan struct{})
+		stop := p.start(func() { close(ready) })
+		select {
+		case <-ready:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Timed out waiting for %s to be ready", s)
+		}
+		stop()
+	}
+}
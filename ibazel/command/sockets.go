@@ -0,0 +1,76 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// Sockets is a set of listening sockets that iBazel holds open on behalf of a
+// target. They are handed to every new subprocess using systemd style socket
+// activation, so the listening port never goes away across restarts.
+type Sockets struct {
+	listeners []net.Listener
+	files     []*os.File
+}
+
+// OpenSockets starts listening on each of the TCP addresses.
+func OpenSockets(addrs []string) (*Sockets, error) {
+	s := &Sockets{}
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.listeners = append(s.listeners, ln)
+
+		f, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("Error getting file for %s: %v", addr, err)
+		}
+		s.files = append(s.files, f)
+	}
+	return s, nil
+}
+
+// Addrs returns the addresses the sockets are listening on.
+func (s *Sockets) Addrs() []string {
+	addrs := make([]string, 0, len(s.listeners))
+	for _, ln := range s.listeners {
+		addrs = append(addrs, ln.Addr().String())
+	}
+	return addrs
+}
+
+// Close the sockets. Subprocesses that were already handed the sockets keep
+// their copies.
+func (s *Sockets) Close() error {
+	if s == nil {
+		return nil
+	}
+	for _, f := range s.files {
+		f.Close()
+	}
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	s.files = nil
+	s.listeners = nil
+	return nil
+}
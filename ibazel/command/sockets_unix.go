@@ -0,0 +1,44 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package command
+
+import (
+	"fmt"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
+)
+
+// The subprocess has to see its own PID in LISTEN_PID, which isn't known until
+// after it has been forked. Launch it through a shell that exports its own PID
+// and then execs the real command so the PID stays the same.
+const listenPidWrapper = `export LISTEN_PID=$$; exec "$0" "$@"`
+
+// apply passes the sockets to the subprocess. It must be called after the
+// subprocess environment has been set up and before it is started.
+func (s *Sockets) apply(pg process_group.ProcessGroup) error {
+	if s == nil || len(s.files) == 0 {
+		return nil
+	}
+
+	cmd := pg.RootProcess()
+	cmd.ExtraFiles = append(cmd.ExtraFiles, s.files...)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("LISTEN_FDS=%d", len(s.files)))
+
+	cmd.Args = append([]string{"/bin/sh", "-c", listenPidWrapper, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package command
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
+)
+
+func TestSockets_apply(t *testing.T) {
+	s, err := OpenSockets([]string{"localhost:0", "localhost:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The child should see both sockets and its own PID.
+	pg := process_group.Command("sh", "-c", `echo "$LISTEN_FDS $LISTEN_PID $$"`)
+	if err := s.apply(pg); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := pg.RootProcess().Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 3 {
+		t.Fatalf("Unexpected output: %q", out)
+	}
+	if fields[0] != "2" {
+		t.Errorf("LISTEN_FDS = %s, want 2", fields[0])
+	}
+	if fields[1] != fields[2] {
+		t.Errorf("LISTEN_PID = %s, want the child's PID %s", fields[1], fields[2])
+	}
+}
+
+func TestSockets_staysOpen(t *testing.T) {
+	s, err := OpenSockets([]string{"localhost:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Nothing is accepting connections, but they should still be queued instead
+	// of refused.
+	conn, err := net.Dial("tcp", s.Addrs()[0])
+	if err != nil {
+		t.Errorf("Dial with no subprocess running: %v", err)
+		return
+	}
+	conn.Close()
+}
+
+func TestOpenSockets_error(t *testing.T) {
+	s, err := OpenSockets([]string{"localhost:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := OpenSockets([]string{s.Addrs()[0]}); err == nil {
+		t.Errorf("Expected an error listening on %s twice", s.Addrs()[0])
+	}
+	if _, err := OpenSockets([]string{fmt.Sprintf("localhost:%d", 1<<20)}); err == nil {
+		t.Errorf("Expected an error listening on an invalid port")
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package coverage
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+)
+
+var htmlTemplate = template.Must(template.New("coverage").Funcs(template.FuncMap{
+	"percent": func(p float64) string { return fmt.Sprintf("%.1f%%", p) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { padding: 2px 12px; text-align: left; }
+td.number { text-align: right; }
+tr.low td.percent { color: #c00; }
+</style>
+</head>
+<body>
+<h1>Coverage: {{percent .Percent}}</h1>
+<table>
+<tr><th>File</th><th>Lines hit</th><th>Lines found</th><th>Coverage</th></tr>
+{{range .Files}}<tr{{if lt .Percent 50.0}} class="low"{{end}}><td>{{.Path}}</td><td class="number">{{.LinesHit}}</td><td class="number">{{.LinesFound}}</td><td class="number percent">{{percent .Percent}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// WriteHTML writes a page summarizing the coverage of each file in the
+// report.
+func (r *Report) WriteHTML(w io.Writer) error {
+	files := make([]*File, 0, len(r.Files))
+	for _, path := range r.Paths() {
+		files = append(files, r.Files[path])
+	}
+	return htmlTemplate.Execute(w, struct {
+		Percent float64
+		Files   []*File
+	}{r.Percent(), files})
+}
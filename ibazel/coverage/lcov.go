@@ -0,0 +1,164 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Package coverage reads and writes the LCOV reports produced by bazel
+// coverage.
+package coverage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// File is the line coverage of one source file.
+type File struct {
+	Path string
+	// Hits maps line numbers to how many times they were executed.
+	Hits map[int]int
+}
+
+// LinesFound returns the number of instrumented lines.
+func (f *File) LinesFound() int {
+	return len(f.Hits)
+}
+
+// LinesHit returns the number of instrumented lines that were executed.
+func (f *File) LinesHit() int {
+	hit := 0
+	for _, n := range f.Hits {
+		if n > 0 {
+			hit++
+		}
+	}
+	return hit
+}
+
+// Percent returns the percentage of instrumented lines that were executed, or
+// 100 if there are none.
+func (f *File) Percent() float64 {
+	return percent(f.LinesHit(), f.LinesFound())
+}
+
+// Lines returns the instrumented line numbers in order.
+func (f *File) Lines() []int {
+	lines := make([]int, 0, len(f.Hits))
+	for line := range f.Hits {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// Report is the line coverage of a set of source files.
+type Report struct {
+	Files map[string]*File
+}
+
+// Paths returns the paths of the files in the report in order.
+func (r *Report) Paths() []string {
+	paths := make([]string, 0, len(r.Files))
+	for path := range r.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Total returns the number of lines executed and instrumented across all
+// files.
+func (r *Report) Total() (hit int, found int) {
+	for _, f := range r.Files {
+		hit += f.LinesHit()
+		found += f.LinesFound()
+	}
+	return hit, found
+}
+
+// Percent returns the percentage of instrumented lines that were executed
+// across all files.
+func (r *Report) Percent() float64 {
+	return percent(r.Total())
+}
+
+func percent(hit, found int) float64 {
+	if found == 0 {
+		return 100
+	}
+	return 100 * float64(hit) / float64(found)
+}
+
+// Parse reads an LCOV tracefile. Only line coverage is kept; records for the
+// same file are merged.
+func Parse(r io.Reader) (*Report, error) {
+	report := &Report{Files: map[string]*File{}}
+
+	var current *File
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "SF:"):
+			path := strings.TrimPrefix(line, "SF:")
+			current = report.Files[path]
+			if current == nil {
+				current = &File{Path: path, Hits: map[int]int{}}
+				report.Files[path] = current
+			}
+		case strings.HasPrefix(line, "DA:"):
+			if current == nil {
+				return nil, fmt.Errorf("line %d: DA outside of a file record", n)
+			}
+			// DA:<line>,<hits>[,<checksum>]
+			fields := strings.Split(strings.TrimPrefix(line, "DA:"), ",")
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: malformed %q", n, line)
+			}
+			lineNumber, err := strconv.Atoi(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: malformed %q", n, line)
+			}
+			hits, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: malformed %q", n, line)
+			}
+			current.Hits[lineNumber] += hits
+		case line == "end_of_record":
+			current = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// WriteLCOV writes the line coverage of the report as an LCOV tracefile.
+func (r *Report) WriteLCOV(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, path := range r.Paths() {
+		f := r.Files[path]
+		fmt.Fprintf(bw, "SF:%s\n", path)
+		for _, line := range f.Lines() {
+			fmt.Fprintf(bw, "DA:%d,%d\n", line, f.Hits[line])
+		}
+		fmt.Fprintf(bw, "LH:%d\nLF:%d\nend_of_record\n", f.LinesHit(), f.LinesFound())
+	}
+	return bw.Flush()
+}
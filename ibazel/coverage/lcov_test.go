@@ -0,0 +1,138 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package coverage
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testReport = `TN:
+SF:pkg/a.go
+FN:3,Foo
+FNDA:1,Foo
+DA:3,1
+DA:4,1,abcdef
+DA:5,0
+LH:2
+LF:3
+end_of_record
+SF:pkg/b.go
+DA:1,0
+end_of_record
+SF:pkg/a.go
+DA:5,2
+DA:6,0
+end_of_record
+`
+
+func TestParse(t *testing.T) {
+	r, err := Parse(strings.NewReader(testReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Paths(), []string{"pkg/a.go", "pkg/b.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Paths() = %v, want %v", got, want)
+	}
+
+	a := r.Files["pkg/a.go"]
+	if got, want := a.Hits, map[int]int{3: 1, 4: 1, 5: 2, 6: 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Hits = %v, want %v", got, want)
+	}
+	if a.LinesHit() != 3 || a.LinesFound() != 4 || a.Percent() != 75 {
+		t.Errorf("Got %d/%d lines (%v%%), want 3/4 (75%%)", a.LinesHit(), a.LinesFound(), a.Percent())
+	}
+	if hit, found := r.Total(); hit != 3 || found != 5 {
+		t.Errorf("Total() = %d, %d, want 3, 5", hit, found)
+	}
+
+	empty := &File{Hits: map[int]int{}}
+	if empty.Percent() != 100 {
+		t.Errorf("Expected a file without instrumented lines to be fully covered")
+	}
+}
+
+func TestParse_errors(t *testing.T) {
+	for _, report := range []string{
+		"DA:1,1\n",
+		"SF:a.go\nDA:1\n",
+		"SF:a.go\nDA:x,1\n",
+		"SF:a.go\nDA:1,x\n",
+	} {
+		if _, err := Parse(strings.NewReader(report)); err == nil {
+			t.Errorf("Expected %q to be invalid", report)
+		}
+	}
+}
+
+func TestWriteLCOV(t *testing.T) {
+	r, err := Parse(strings.NewReader(testReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := r.WriteLCOV(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `SF:pkg/a.go
+DA:3,1
+DA:4,1
+DA:5,2
+DA:6,0
+LH:3
+LF:4
+end_of_record
+SF:pkg/b.go
+DA:1,0
+LH:0
+LF:1
+end_of_record
+`
+	if b.String() != want {
+		t.Errorf("WriteLCOV() = %q, want %q", b.String(), want)
+	}
+
+	// What is written reads back the same.
+	r2, err := Parse(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, r2) {
+		t.Errorf("Round trip changed the report: %v, want %v", r2, r)
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	r, err := Parse(strings.NewReader(testReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := r.WriteHTML(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<h1>Coverage: 60.0%</h1>",
+		`<tr><td>pkg/a.go</td><td class="number">3</td><td class="number">4</td><td class="number percent">75.0%</td></tr>`,
+		`<tr class="low"><td>pkg/b.go</td>`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("Expected the HTML to contain %q:\n%s", want, b.String())
+		}
+	}
+}
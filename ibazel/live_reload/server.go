@@ -16,7 +16,6 @@ package live_reload
 
 import (
 	"bytes"
-	"flag"
 	"fmt"
 	golog "log"
 	"net"
@@ -24,19 +23,23 @@ import (
 	"strconv"
 
 	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+	"github.com/bazelbuild/bazel-watcher/ibazel/target_config"
 	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
 	"github.com/jaschaephraim/lrserver"
 )
 
-var noLiveReload = flag.Bool("nolive_reload", false, "Disable JavaScript live reload support")
-
 type LiveReloadServer struct {
+	// Whether ibazel_live_reload tags are ignored.
+	disabled bool
+
 	lrserver       *lrserver.Server
 	eventListeners []Events
 }
 
-func New() *LiveReloadServer {
-	l := &LiveReloadServer{}
+// New creates a LiveReloadServer. A disabled one ignores ibazel_live_reload
+// tags.
+func New(disabled bool) *LiveReloadServer {
+	l := &LiveReloadServer{disabled: disabled}
 	l.eventListeners = []Events{}
 	return l
 }
@@ -53,18 +56,18 @@ func (l *LiveReloadServer) Cleanup() {
 	}
 }
 
+// TagKeys registers the ibazel_live_reload tag.
+func (l *LiveReloadServer) TagKeys() []target_config.Key {
+	return []target_config.Key{{Name: "live_reload", Kind: target_config.Flag}}
+}
+
 func (l *LiveReloadServer) TargetDecider(rule *blaze_query.Rule) {
-	for _, attr := range rule.Attribute {
-		if *attr.Name == "tags" && *attr.Type == blaze_query.Attribute_STRING_LIST {
-			if contains(attr.StringListValue, "ibazel_live_reload") {
-				if *noLiveReload {
-					log.Log("Target requests live_reload but liveReload has been disabled with the -nolive_reload flag.")
-					return
-				}
-				l.startLiveReloadServer()
-				return
-			}
+	if contains(target_config.Tags(rule), "ibazel_live_reload") {
+		if l.disabled {
+			log.Log("Target requests live_reload but liveReload has been disabled with the -nolive_reload flag.")
+			return
 		}
+		l.startLiveReloadServer()
 	}
 }
 
@@ -74,7 +77,7 @@ func (l *LiveReloadServer) ChangeDetected(targets []string, changeType string, c
 func (l *LiveReloadServer) BeforeCommand(targets []string, command string) {}
 
 func (l *LiveReloadServer) AfterCommand(targets []string, command string, success bool, output *bytes.Buffer) {
-	l.triggerReload(targets)
+	l.TriggerReload(targets)
 }
 
 func (l *LiveReloadServer) ReloadTriggered(targets []string) {}
@@ -104,7 +107,8 @@ func (l *LiveReloadServer) startLiveReloadServer() {
 	log.Errorf("Could not find open port for live reload server")
 }
 
-func (l *LiveReloadServer) triggerReload(targets []string) {
+// TriggerReload tells any connected browsers to reload.
+func (l *LiveReloadServer) TriggerReload(targets []string) {
 	if l.lrserver != nil {
 		log.Log("Triggering live reload")
 		l.lrserver.Reload("reload")
@@ -15,6 +15,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -22,6 +24,8 @@ import (
 	"time"
 
 	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+	"github.com/bazelbuild/bazel-watcher/ibazel/proxy"
+	"github.com/bazelbuild/bazel-watcher/ibazel/watcher"
 )
 
 var Version = "Development"
@@ -55,8 +59,52 @@ var overrideableBazelFlags []string = []string{
 	"--test_timeout=",
 }
 
+// Other Bazel commands that take targets and exit once they are done, which
+// ibazel repeats on every change.
+var watchableCommands []string = []string{
+	"fetch",
+	"mobile-install",
+}
+
+// Bazel commands that take a query expression rather than targets.
+var queryCommands []string = []string{
+	"aquery",
+	"cquery",
+	"query",
+}
+
 var debounceDuration = flag.Duration("debounce", 100*time.Millisecond, "Debounce duration")
 var logToFile = flag.String("log_to_file", "-", "Log iBazel stderr to a file instead of os.Stderr")
+var runInPTY = flag.Bool("run_in_pty", false, "Run the target of ibazel run in a pseudo-terminal")
+var runOutputLog = flag.Bool("run_output_log", false, "Log the output of the target of ibazel run to a file under Bazel's output base")
+var runOutputLogMaxSize = flag.Int64("run_output_log_max_size", 10<<20, "Size in bytes after which the run output log is rotated, 0 to never rotate")
+var watchPaths = flag.String("watch_paths", "", "Comma separated files, directories or globs, relative to the workspace root, whose changes restart the target of ibazel run without rebuilding it")
+var runEnvFile = flag.String("run_env_file", "", "Comma separated dotenv files, relative to the workspace root, to read the environment of the target of ibazel run from. Changes to them restart the target")
+var runEnv stringList
+var quietRunOutput = flag.Int("quiet_run_output", 0, "Only show the last N lines of output of the target of ibazel run once it goes quiet. Implies -run_output_log")
+var coverageLCOV = flag.String("coverage_lcov", "", "Write an LCOV summary of the coverage of each ibazel coverage iteration to this file, relative to the workspace root")
+var coverageHTML = flag.String("coverage_html", "", "Write an HTML summary of the coverage of each ibazel coverage iteration to this file, relative to the workspace root")
+var cquery = flag.Bool("cquery", false, "Find the source files to watch with cquery and the Bazel flags, so only the files of the active configuration are watched. Falls back to query when cquery fails")
+var sourceQuery = flag.String("source_query", watcher.DefaultSourceQuery, "Query that finds the source files to watch. {targets} is replaced by the targets")
+var buildQuery = flag.String("build_query", watcher.DefaultBuildQuery, "Query that finds the BUILD and .bzl files to watch. {targets} is replaced by the targets")
+var queryArgs stringList
+var incrementalQuery = flag.Bool("incremental_query", false, "After a change to BUILD or .bzl files, only query for the files to watch of the changed packages")
+var queryCache = flag.Bool("query_cache", false, "Cache the files to watch under Bazel's output base, and start from them when none of the BUILD and .bzl files changed")
+var watcherBackend = flag.String("watcher", watcher.WatcherAuto, "How to notice changes: fsnotify, poll, or auto to poll only when the workspace is on a filesystem known not to report changes, such as NFS or a Docker bind mount")
+var pollInterval = flag.Duration("poll_interval", watcher.DefaultPollInterval, "How often to look for changes when polling")
+var pollHash = flag.Bool("poll_hash", false, "When polling, compare the content of files instead of their modification time")
+var fullQueryInterval = flag.Duration("full_query_interval", watcher.DefaultFullQueryInterval, "With -incremental_query, query for all the files to watch when the last full query is older than this")
+var noLiveReload = flag.Bool("nolive_reload", false, "Disable JavaScript live reload support")
+var noProxy = flag.Bool("noproxy", false, "Disable the development proxy requested by ibazel_proxy tags")
+var proxyHoldTimeout = flag.Duration("proxy_hold_timeout", proxy.DefaultHoldTimeout, "How long the development proxy holds a request while waiting for the target to come back up")
+var profileDev = flag.String("profile_dev", "", "Turn on profiling and append report to file")
+var runOutput = flag.Bool("run_output", false, "Search for commands in Bazel output that match a regex and execute them, the default path of file should be in the workspace root .bazel_fix_commands.json")
+var runOutputInteractive = flag.Bool("run_output_interactive", true, "Use an interactive prompt when executing commands in Bazel output")
+
+func init() {
+	flag.Var(&runEnv, "run_env", "KEY=VALUE to set in the environment of the target of ibazel run. May be given several times")
+	flag.Var(&queryArgs, "query_arg", "Option to pass to the queries that find the files to watch, such as --keep_going. May be given several times")
+}
 
 func usage() {
 	fmt.Fprintf(os.Stderr, `iBazel - Version %s
@@ -66,14 +114,23 @@ target, run, build, or test the specified targets.
 
 Usage:
 
-ibazel build|test|run [flags] targets...
+ibazel build|test|coverage|run [flags] targets...
+ibazel exec [flags] targets... -- command args...
+ibazel fetch|mobile-install [flags] targets...
+ibazel aquery|cquery|query [flags] expression
+ibazel pipeline [flags] command targets... then command targets... [-- args...]
 
 Example:
 
 ibazel test //path/to/my/testing:target
 ibazel test //path/to/my/testing/targets/...
+ibazel coverage //path/to/my/testing:target
 ibazel run //path/to/my/runnable:target -- --arguments --for_your=binary
 ibazel build //path/to/my/buildable:target
+ibazel exec //path/to/my:manifests -- kubectl apply -f {outputs}
+ibazel mobile-install //path/to/my/android:app
+ibazel query 'deps(//path/to/my:target) except //third_party/...'
+ibazel pipeline build //... then test //svc/... then run //svc:server
 
 Supported Bazel startup flags:
   %s
@@ -153,14 +210,48 @@ func main() {
 	}
 
 	command := strings.ToLower(flag.Args()[0])
-	args := flag.Args()[1:]
+	targets, startupArgs, bazelArgs, args := parseArgs(flag.Args()[1:])
 	os.Setenv("IBAZEL", "true")
 
-	i, err := New()
+	opts := watcher.Options{
+		StartupArgs:          startupArgs,
+		BazelArgs:            bazelArgs,
+		DebounceDuration:     *debounceDuration,
+		RunInPTY:             *runInPTY,
+		RunOutputLog:         *runOutputLog,
+		RunOutputLogMaxSize:  *runOutputLogMaxSize,
+		QuietRunOutputLines:  *quietRunOutput,
+		RunEnvFiles:          splitList(*runEnvFile),
+		RunEnv:               runEnv,
+		CoverageLCOVPath:     *coverageLCOV,
+		CoverageHTMLPath:     *coverageHTML,
+		SourceQuery:          *sourceQuery,
+		BuildQuery:           *buildQuery,
+		QueryArgs:            queryArgs,
+		CQuery:               *cquery,
+		IncrementalQuery:     *incrementalQuery,
+		FullQueryInterval:    *fullQueryInterval,
+		QueryCache:           *queryCache,
+		Watcher:              *watcherBackend,
+		PollInterval:         *pollInterval,
+		PollHash:             *pollHash,
+		HandleSignals:        true,
+		Version:              Version,
+		ProfilePath:          *profileDev,
+		NoLiveReload:         *noLiveReload,
+		NoProxy:              *noProxy,
+		ProxyHoldTimeout:     *proxyHoldTimeout,
+		RunOutput:            *runOutput,
+		RunOutputInteractive: *runOutputInteractive,
+	}
+	if command == "run" || command == "pipeline" {
+		opts.WatchPaths = splitList(*watchPaths)
+	}
+	ctx := context.Background()
+	i, err := watcher.New(ctx, opts)
 	if err != nil {
 		log.Fatalf("Error creating iBazel: %s", err)
 	}
-	i.SetDebounceDuration(*debounceDuration)
 	defer i.Cleanup()
 
 	// increase the number of files that this process can
@@ -170,25 +261,109 @@ func main() {
 		log.Errorf("error setting higher file descriptor limit for this process: %v", err)
 	}
 
-	handle(i, command, args)
+	handle(ctx, i, command, targets, args)
 }
 
-func handle(i *IBazel, command string, args []string) {
-	targets, startupArgs, bazelArgs, args := parseArgs(args)
-	i.SetStartupArgs(startupArgs)
-	i.SetBazelArgs(bazelArgs)
-
+func handle(ctx context.Context, i *watcher.IBazel, command string, targets []string, args []string) {
+	var err error
 	switch command {
 	case "build":
-		i.Build(targets...)
+		err = i.Build(ctx, targets...)
 	case "test":
-		i.Test(targets...)
+		err = i.Test(ctx, targets...)
+	case "coverage":
+		err = i.Coverage(ctx, targets...)
 	case "run":
 		// Run only takes one argument
-		i.Run(targets[0], args)
+		err = i.Run(ctx, targets[0], args)
+	case "exec":
+		err = i.Exec(ctx, targets, args)
+	case "pipeline":
+		var stages []watcher.Stage
+		stages, err = parsePipeline(targets)
+		if err == nil {
+			err = i.Pipeline(ctx, stages, args)
+		}
 	default:
-		fmt.Fprintf(os.Stderr, "Asked me to perform %s. I don't know how to do that.", command)
+		if contains(queryCommands, command) {
+			err = i.QueryCommand(ctx, command, strings.Join(targets, " "))
+			break
+		}
+		if !contains(watchableCommands, command) {
+			fmt.Fprintf(os.Stderr, "Asked me to perform %s. I don't know how to do that.", command)
+			usage()
+			return
+		}
+		err = i.Command(ctx, command, targets...)
+	}
+	if err != nil && err != ctx.Err() {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		usage()
-		return
 	}
 }
+
+// Separates the stages of a pipeline on the command line.
+const stageSeparator = "then"
+
+// parsePipeline reads stages such as
+//
+//	build //... then test //svc/... then run //svc:server
+func parsePipeline(args []string) ([]watcher.Stage, error) {
+	var stages []watcher.Stage
+	current := watcher.Stage{}
+	for _, arg := range append(args, stageSeparator) {
+		if arg != stageSeparator {
+			if current.Command == "" {
+				current.Command = strings.ToLower(arg)
+			} else {
+				current.Targets = append(current.Targets, arg)
+			}
+			continue
+		}
+
+		switch current.Command {
+		case "":
+			return nil, errors.New("pipeline stages can't be empty")
+		case "build", "test", "coverage", "run", "exec":
+		default:
+			if !contains(watchableCommands, current.Command) {
+				return nil, fmt.Errorf("%s can't be a pipeline stage", current.Command)
+			}
+		}
+		stages = append(stages, current)
+		current = watcher.Stage{}
+	}
+	return stages, nil
+}
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// splitList splits a comma separated list of paths.
+func splitList(s string) []string {
+	var paths []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+func contains(l []string, e string) bool {
+	for _, i := range l {
+		if i == e {
+			return true
+		}
+	}
+	return false
+}
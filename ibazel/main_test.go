@@ -17,6 +17,8 @@ package main
 import (
 	"reflect"
 	"testing"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/watcher"
 )
 
 func TestParsingArgs(t *testing.T) {
@@ -81,3 +83,31 @@ func TestIsOverrideableBazelFlag(t *testing.T) {
 		}
 	}
 }
+
+func TestParsePipeline(t *testing.T) {
+	stages, err := parsePipeline([]string{"build", "//...", "then", "Test", "//svc/...", "//lib/...", "then", "run", "//svc:server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []watcher.Stage{
+		{Command: "build", Targets: []string{"//..."}},
+		{Command: "test", Targets: []string{"//svc/...", "//lib/..."}},
+		{Command: "run", Targets: []string{"//svc:server"}},
+	}
+	if !reflect.DeepEqual(want, stages) {
+		t.Errorf("parsePipeline() = %v, want %v", stages, want)
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"build", "//...", "then"},
+		{"then", "build", "//..."},
+		{"build", "//...", "then", "then", "test", "//..."},
+		{"clean", "//a"},
+		{"query", "deps(//a)"},
+	} {
+		if _, err := parsePipeline(args); err == nil {
+			t.Errorf("Expected %v to be an invalid pipeline", args)
+		}
+	}
+}
@@ -19,7 +19,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -28,24 +27,27 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/bazelbuild/bazel-watcher/bazel"
 	"github.com/bazelbuild/bazel-watcher/ibazel/log"
 	"github.com/bazelbuild/bazel-watcher/ibazel/workspace_finder"
 	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
 )
 
-var runOutput = flag.Bool(
-	"run_output",
-	false,
-	"Search for commands in Bazel output that match a regex and execute them, the default path of file should be in the workspace root .bazel_fix_commands.json")
-var runOutputInteractive = flag.Bool(
-	"run_output_interactive",
-	true,
-	"Use an interactive prompt when executing commands in Bazel output")
-
 // This RegExp will match ANSI escape codes.
 var escapeCodeCleanerRegex = regexp.MustCompile("\\x1B\\[[\\x30-\\x3F]*[\\x20-\\x2F]*[\\x40-\\x7E]")
 
-type OutputRunner struct{}
+type OutputRunner struct {
+	// Whether commands are looked for in the output, and whether running one
+	// is confirmed first.
+	enabled     bool
+	interactive bool
+
+	optcmd []Optcmd
+	// The commands found in the output of the running command so far, and
+	// whether any of its output was seen as it was written.
+	matches  matches
+	streamed bool
+}
 
 type Optcmd struct {
 	Regex   string   `json:"regex"`
@@ -53,8 +55,10 @@ type Optcmd struct {
 	Args    []string `json:"args"`
 }
 
-func New() *OutputRunner {
-	i := &OutputRunner{}
+// New creates an OutputRunner. An enabled one runs the commands it finds in
+// the output of Bazel, after asking if it is interactive.
+func New(enabled bool, interactive bool) *OutputRunner {
+	i := &OutputRunner{enabled: enabled, interactive: interactive}
 	return i
 }
 
@@ -64,13 +68,59 @@ func (i *OutputRunner) TargetDecider(rule *blaze_query.Rule) {}
 
 func (i *OutputRunner) ChangeDetected(targets []string, changeType string, change string) {}
 
-func (i *OutputRunner) BeforeCommand(targets []string, command string) {}
+func (i *OutputRunner) BeforeCommand(targets []string, command string) {
+	i.matches = matches{}
+	i.streamed = false
+	if !i.enabled {
+		return
+	}
+	i.optcmd = loadOptcmd()
+}
+
+// OutputLine looks for commands in the output of Bazel as it is written.
+func (i *OutputRunner) OutputLine(targets []string, command string, line bazel.Line) {
+	if !i.enabled || i.optcmd == nil {
+		return
+	}
+	i.streamed = true
+	i.matches.add(i.optcmd, line.Text)
+}
 
 func (i *OutputRunner) AfterCommand(targets []string, command string, success bool, output *bytes.Buffer) {
-	if *runOutput == false || output == nil {
+	if !i.enabled {
 		return
 	}
 
+	m := i.matches
+	if !i.streamed {
+		// Commands whose output isn't streamed, such as the build of a run
+		// target, are searched once they are done.
+		if output == nil {
+			return
+		}
+		if i.optcmd == nil {
+			i.optcmd = loadOptcmd()
+		}
+		m = matches{}
+		m.scan(i.optcmd, output)
+	}
+	i.matches = matches{}
+
+	commandLines, commands, args := m.commandLines, m.commands, m.args
+	for idx, _ := range commandLines {
+		if i.interactive {
+			if promptCommand(commandLines[idx]) {
+				executeCommand(commands[idx], args[idx])
+			}
+		} else {
+			executeCommand(commands[idx], args[idx])
+		}
+	}
+}
+
+// loadOptcmd reads the commands to look for from the workspace, falling back
+// to buildozer commands.
+func loadOptcmd() []Optcmd {
 	jsonCommandPath := ".bazel_fix_commands.json"
 	defaultRegex := Optcmd{
 		Regex:   "^buildozer '(.*)'\\s+(.*)$",
@@ -83,16 +133,7 @@ func (i *OutputRunner) AfterCommand(targets []string, command string, success bo
 		log.Log("Use default regex")
 		optcmd = []Optcmd{defaultRegex}
 	}
-	commandLines, commands, args := matchRegex(optcmd, output)
-	for idx, _ := range commandLines {
-		if *runOutputInteractive {
-			if promptCommand(commandLines[idx]) {
-				executeCommand(commands[idx], args[idx])
-			}
-		} else {
-			executeCommand(commands[idx], args[idx])
-		}
-	}
+	return optcmd
 }
 
 func readConfigs(configPath string) []Optcmd {
@@ -114,22 +155,35 @@ func readConfigs(configPath string) []Optcmd {
 }
 
 func matchRegex(optcmd []Optcmd, output *bytes.Buffer) ([]string, []string, [][]string) {
-	var commandLines, commands []string
-	var args [][]string
+	var m matches
+	m.scan(optcmd, output)
+	return m.commandLines, m.commands, m.args
+}
+
+// matches are the commands found in the output of Bazel.
+type matches struct {
+	commandLines, commands []string
+	args                   [][]string
+}
+
+func (m *matches) scan(optcmd []Optcmd, output *bytes.Buffer) {
 	scanner := bufio.NewScanner(output)
 	for scanner.Scan() {
-		line := escapeCodeCleanerRegex.ReplaceAllLiteralString(scanner.Text(), "")
-		for _, oc := range optcmd {
-			re := regexp.MustCompile(oc.Regex)
-			matches := re.FindStringSubmatch(line)
-			if matches != nil && len(matches) >= 0 {
-				commandLines = append(commandLines, matches[0])
-				commands = append(commands, convertArg(matches, oc.Command))
-				args = append(args, convertArgs(matches, oc.Args))
-			}
+		m.add(optcmd, scanner.Text())
+	}
+}
+
+func (m *matches) add(optcmd []Optcmd, line string) {
+	line = escapeCodeCleanerRegex.ReplaceAllLiteralString(line, "")
+	for _, oc := range optcmd {
+		re := regexp.MustCompile(oc.Regex)
+		matches := re.FindStringSubmatch(line)
+		if matches != nil && len(matches) >= 0 {
+			m.commandLines = append(m.commandLines, matches[0])
+			m.commands = append(m.commands, convertArg(matches, oc.Command))
+			m.args = append(m.args, convertArgs(matches, oc.Args))
 		}
 	}
-	return commandLines, commands, args
 }
 
 func convertArg(matches []string, arg string) string {
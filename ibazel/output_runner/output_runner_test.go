@@ -18,6 +18,8 @@ import (
 	"bytes"
 	"reflect"
 	"testing"
+
+	"github.com/bazelbuild/bazel-watcher/bazel"
 )
 
 func TestConvertArgs(t *testing.T) {
@@ -160,3 +162,20 @@ func TestMatchCleanRegex(t *testing.T) {
 	}
 
 }
+
+func TestOutputLine(t *testing.T) {
+	i := New(true, true)
+	i.optcmd = []Optcmd{
+		{Regex: "^(buildozer) '(.*)'\\s+(.*)$", Command: "$1", Args: []string{"$2", "$3"}},
+	}
+	i.OutputLine(nil, "build", bazel.Line{Stream: bazel.Stderr, Text: "buildozer 'add deps //wow' //fake:target"})
+	i.OutputLine(nil, "build", bazel.Line{Stream: bazel.Stderr, Text: "not_a_match"})
+
+	if !i.streamed {
+		t.Errorf("Didn't record that the output was streamed")
+	}
+	expected := []string{"buildozer 'add deps //wow' //fake:target"}
+	if !reflect.DeepEqual(i.matches.commandLines, expected) {
+		t.Errorf("Commands not equal!\nGot:  %v\nWant: %v", i.matches.commandLines, expected)
+	}
+}
@@ -26,7 +26,11 @@
 package process_group
 
 import (
+	"fmt"
 	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
 )
 
 // ProcessGroup represents a tree of processes that can be terminated
@@ -35,7 +39,30 @@ type ProcessGroup interface {
 	RootProcess() *exec.Cmd
 	Start() error
 	Kill() error
+	Signal(sig syscall.Signal) error
 	Wait() error
 	Close() error
 	CombinedOutput() ([]byte, error)
+	// NewSession makes the root process the leader of a new session, with its
+	// stdin as the controlling terminal. It must be called before Start.
+	NewSession() error
+}
+
+// ParseSignal returns the signal with the given name, e.g. "SIGTERM" or
+// "TERM".
+func ParseSignal(name string) (syscall.Signal, error) {
+	upper := strings.ToUpper(name)
+	if !strings.HasPrefix(upper, "SIG") {
+		upper = "SIG" + upper
+	}
+	if sig, ok := signals[upper]; ok {
+		return sig, nil
+	}
+
+	names := make([]string, 0, len(signals))
+	for n := range signals {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return 0, fmt.Errorf("Unknown signal %q, expected one of %s", name, strings.Join(names, ", "))
 }
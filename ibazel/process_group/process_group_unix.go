@@ -21,6 +21,17 @@ import (
 	"syscall"
 )
 
+// Signals that can be sent to a process group.
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
 type unixProcessGroup struct {
 	root *exec.Cmd
 }
@@ -45,6 +56,10 @@ func (pg *unixProcessGroup) Kill() error {
 	return syscall.Kill(-pg.root.Process.Pid, syscall.SIGKILL)
 }
 
+func (pg *unixProcessGroup) Signal(sig syscall.Signal) error {
+	return syscall.Kill(-pg.root.Process.Pid, sig)
+}
+
 func (pg *unixProcessGroup) Wait() error {
 	return pg.root.Wait()
 }
@@ -56,3 +71,13 @@ func (pg *unixProcessGroup) Close() error {
 func (pg *unixProcessGroup) CombinedOutput() ([]byte, error) {
 	return pg.root.CombinedOutput()
 }
+
+func (pg *unixProcessGroup) NewSession() error {
+	// A new session is also a new process group led by the root process, so
+	// the group can still be signalled as a whole.
+	pg.root.SysProcAttr.Setpgid = false
+	pg.root.SysProcAttr.Setsid = true
+	pg.root.SysProcAttr.Setctty = true
+	pg.root.SysProcAttr.Ctty = 0
+	return nil
+}
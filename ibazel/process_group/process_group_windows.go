@@ -17,12 +17,19 @@ package process_group
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"log"
 	"os/exec"
 	"syscall"
 	"unsafe"
 )
 
+// Job objects can only be terminated, so the only signal that can be sent is
+// SIGKILL.
+var signals = map[string]syscall.Signal{
+	"SIGKILL": syscall.SIGKILL,
+}
+
 type winProcessGroup struct {
 	root   *exec.Cmd
 	job    syscall.Handle
@@ -105,6 +112,13 @@ func (pg *winProcessGroup) Kill() error {
 	return nil
 }
 
+func (pg *winProcessGroup) Signal(sig syscall.Signal) error {
+	if sig != syscall.SIGKILL {
+		return fmt.Errorf("Sending %v is not supported on Windows", sig)
+	}
+	return pg.Kill()
+}
+
 func (pg *winProcessGroup) Wait() error {
 	var code uint32
 	var key uint32
@@ -151,3 +165,7 @@ func (pg *winProcessGroup) CombinedOutput() ([]byte, error) {
 	err := pg.Run()
 	return b.Bytes(), err
 }
+
+func (pg *winProcessGroup) NewSession() error {
+	return errors.New("Sessions are not supported on Windows")
+}
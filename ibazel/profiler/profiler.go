@@ -18,7 +18,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	golog "log"
 	"math/rand"
@@ -26,6 +25,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,8 +33,6 @@ import (
 	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
 )
 
-var profileDev = flag.String("profile_dev", "", "Turn on profiling and append report to file")
-
 const (
 
 	// DefaultPort is the profiler Server's default server port
@@ -45,12 +43,14 @@ type Profiler struct {
 	server                   *http.Server
 	file                     *os.File
 	version                  string
+	path                     string
 	targets                  []string
 	iteration                string
 	iterationStartTime       int64
 	iterationBuildStart      bool
 	iterationReloadTriggered bool
 	changes                  []string
+	runLog                   string
 	lock                     sync.Mutex // guards events
 }
 
@@ -74,6 +74,9 @@ type profileEvent struct {
 	// build & reload event
 	Changes []string `json:"changes,omitempty"`
 
+	// run event
+	LogFile string `json:"logFile,omitempty"`
+
 	// browser event
 	RemoteType    string `json:"remoteType,omitempty"`
 	RemoteTime    int64  `json:"remoteTime,omitempty"`
@@ -88,25 +91,28 @@ type profilerRemoteEvent struct {
 	Data                     string `json:"data"`
 }
 
-func New(version string) *Profiler {
+// New creates a Profiler, which appends its report to the file at path. It
+// doesn't profile when path is empty.
+func New(version string, path string) *Profiler {
 	p := &Profiler{}
 	p.version = version
+	p.path = path
 	return p
 }
 
 func (i *Profiler) Initialize(info *map[string]string) {
-	if *profileDev == "" {
+	if i.path == "" {
 		return
 	}
 
 	var err error
-	i.file, err = os.OpenFile(*profileDev, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	i.file, err = os.OpenFile(i.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Errorf("Failed to open profile output file: %s", *profileDev)
+		log.Errorf("Failed to open profile output file: %s", i.path)
 		return
 	}
 
-	log.Errorf("Profile output: %s", *profileDev)
+	log.Errorf("Profile output: %s", i.path)
 
 	i.iterationBuildStart = true
 	i.newIteration()
@@ -134,14 +140,7 @@ func (i *Profiler) BeforeCommand(targets []string, command string) {
 		return
 	}
 	i.targets = targets
-	switch command {
-	case "build":
-		i.buildEvent("BUILD_START")
-	case "test":
-		i.buildEvent("TEST_START")
-	case "run":
-		i.buildEvent("RUN_START")
-	}
+	i.buildEvent(commandEvent(command, "START"))
 }
 
 func (i *Profiler) AfterCommand(targets []string, command string, success bool, output *bytes.Buffer) {
@@ -150,26 +149,26 @@ func (i *Profiler) AfterCommand(targets []string, command string, success bool,
 	}
 	i.targets = targets
 	if success {
-		switch command {
-		case "build":
-			i.buildEvent("BUILD_DONE")
-		case "test":
-			i.buildEvent("TEST_DONE")
-		case "run":
-			i.buildEvent("RUN_DONE")
-		}
+		i.buildEvent(commandEvent(command, "DONE"))
 	} else {
-		switch command {
-		case "build":
-			i.buildEvent("BUILD_FAILED")
-		case "test":
-			i.buildEvent("TEST_FAILED")
-		case "run":
-			i.buildEvent("RUN_FAILED")
-		}
+		i.buildEvent(commandEvent(command, "FAILED"))
 	}
 }
 
+// commandEvent returns the type of an event of a command, such as BUILD_START
+// or MOBILE_INSTALL_DONE.
+func commandEvent(command string, suffix string) string {
+	return strings.ToUpper(strings.Replace(command, "-", "_", -1)) + "_" + suffix
+}
+
+// SetRunLog records where the output of the run target is logged in the
+// events of later runs.
+func (i *Profiler) SetRunLog(path string) {
+	i.lock.Lock()
+	i.runLog = path
+	i.lock.Unlock()
+}
+
 func (i *Profiler) Cleanup() {
 	if i.file != nil {
 		i.file.Close()
@@ -257,6 +256,9 @@ func (i *Profiler) buildEvent(eventType string) {
 	event := profileEvent{}
 	event.Type = eventType
 	event.Changes = i.changes
+	if strings.HasPrefix(eventType, "RUN_") {
+		event.LogFile = i.runLog
+	}
 	i.processEvent(&event)
 	i.lock.Unlock()
 }
@@ -286,6 +288,7 @@ func (i *Profiler) remoteEvent(remoteEvent *profilerRemoteEvent) {
 	i.lock.Lock()
 	if !i.iterationReloadTriggered {
 		log.Logf("Ignoring unexpected remote event")
+		i.lock.Unlock()
 		return
 	}
 	event := profileEvent{}
@@ -298,6 +301,22 @@ func (i *Profiler) remoteEvent(remoteEvent *profilerRemoteEvent) {
 	i.lock.Unlock()
 }
 
+// TargetEvent records an event reported by the running target over its
+// control channel as a REMOTE_EVENT.
+func (i *Profiler) TargetEvent(eventType string, data string) {
+	if i.file == nil {
+		return
+	}
+	i.lock.Lock()
+	event := profileEvent{}
+	event.Type = "REMOTE_EVENT"
+	event.RemoteType = eventType
+	event.RemoteTime = makeTimestamp()
+	event.RemoteData = data
+	i.processEvent(&event)
+	i.lock.Unlock()
+}
+
 func (i *Profiler) processEvent(event *profileEvent) {
 	if i.file != nil && event != nil {
 		// prepare the event
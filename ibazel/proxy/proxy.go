@@ -0,0 +1,424 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	golog "log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+	"github.com/bazelbuild/bazel-watcher/ibazel/target_config"
+	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
+)
+
+const (
+	proxyTagPrefix = "ibazel_proxy="
+
+	// DefaultHoldTimeout is how long requests are held by default while the
+	// target is coming back up.
+	DefaultHoldTimeout = 30 * time.Second
+
+	// maxBufferedBody is the largest request body that will be held in memory
+	// so that it can be replayed against a restarted backend.
+	maxBufferedBody = 10 << 20
+
+	// backendPollInterval is how often the backend is dialed while waiting for
+	// it to accept connections.
+	backendPollInterval = 100 * time.Millisecond
+)
+
+// Matches the closing body tag so scripts can be injected in front of it.
+var closingBodyRegex = regexp.MustCompile(`(?i)</body\s*>`)
+
+// Proxy is a reverse proxy that sits in front of a run target. It injects the
+// live reload and profiler scripts into HTML responses and holds incoming
+// requests while the target is restarting.
+type Proxy struct {
+	// Whether ibazel_proxy tags are ignored, and how long requests are held.
+	disabled    bool
+	holdTimeout time.Duration
+
+	listenAddr  string
+	backendAddr string
+	url         string
+
+	server *http.Server
+
+	lock   sync.Mutex // guards ready and closed
+	ready  chan struct{}
+	closed bool
+}
+
+// New creates a Proxy, which holds requests for up to holdTimeout, or
+// DefaultHoldTimeout if it is 0. A disabled Proxy ignores ibazel_proxy tags.
+func New(disabled bool, holdTimeout time.Duration) *Proxy {
+	p := &Proxy{disabled: disabled, holdTimeout: holdTimeout}
+	if p.holdTimeout <= 0 {
+		p.holdTimeout = DefaultHoldTimeout
+	}
+	p.ready = make(chan struct{})
+	return p
+}
+
+func (p *Proxy) Initialize(info *map[string]string) {}
+
+// TagKeys registers the ibazel_proxy tag.
+func (p *Proxy) TagKeys() []target_config.Key {
+	return []target_config.Key{{
+		Name: "proxy",
+		Kind: target_config.String,
+		Validate: func(v string) error {
+			_, _, err := parseProxyTag(proxyTagPrefix + v)
+			return err
+		},
+	}}
+}
+
+func (p *Proxy) TargetDecider(rule *blaze_query.Rule) {
+	for _, tag := range target_config.Tags(rule) {
+		if !strings.HasPrefix(tag, proxyTagPrefix) {
+			continue
+		}
+		if p.disabled {
+			log.Log("Target requests a proxy but it has been disabled with the -noproxy flag.")
+			return
+		}
+		listen, backend, err := parseProxyTag(tag)
+		if err != nil {
+			log.Errorf("Invalid tag %q: %v", tag, err)
+			return
+		}
+		p.startProxyServer(listen, backend)
+		return
+	}
+}
+
+func (p *Proxy) ChangeDetected(targets []string, changeType string, change string) {}
+
+func (p *Proxy) BeforeCommand(targets []string, command string) {
+	if p.server == nil || command != "run" {
+		return
+	}
+	// The target is about to be rebuilt and possibly restarted. Hold new
+	// requests until it is accepting connections again.
+	p.backendDown()
+}
+
+func (p *Proxy) AfterCommand(targets []string, command string, success bool, output *bytes.Buffer) {
+	if p.server == nil || command != "run" {
+		return
+	}
+	go p.waitForBackend()
+}
+
+func (p *Proxy) Cleanup() {
+	p.lock.Lock()
+	p.closed = true
+	p.lock.Unlock()
+
+	if p.server != nil {
+		p.server.Close()
+	}
+}
+
+// parseProxyTag parses a tag of the form "ibazel_proxy=8080->3000". Either
+// side may be a bare port or a host:port pair.
+func parseProxyTag(tag string) (string, string, error) {
+	value := strings.TrimPrefix(tag, proxyTagPrefix)
+	parts := strings.Split(value, "->")
+	if len(parts) != 2 {
+		return "", "", errors.New("expected the form ibazel_proxy=<listen>-><backend>")
+	}
+
+	listen, err := normalizeAddr(parts[0], "")
+	if err != nil {
+		return "", "", fmt.Errorf("listen address: %v", err)
+	}
+	backend, err := normalizeAddr(parts[1], "localhost")
+	if err != nil {
+		return "", "", fmt.Errorf("backend address: %v", err)
+	}
+	return listen, backend, nil
+}
+
+func normalizeAddr(addr string, defaultHost string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Assume it is a bare port.
+		host, port = defaultHost, addr
+	} else if host == "" {
+		host = defaultHost
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func (p *Proxy) startProxyServer(listen, backend string) {
+	if p.server != nil {
+		return
+	}
+
+	p.listenAddr = listen
+	p.backendAddr = backend
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Errorf("Proxy could not listen on %s: %v", listen, err)
+		return
+	}
+
+	p.server = &http.Server{
+		Handler:  p.handler(),
+		ErrorLog: golog.New(os.Stderr, "[proxy]", 0),
+	}
+
+	go func() {
+		err := p.server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("Proxy server failed: %v", err)
+		}
+	}()
+
+	p.url = fmt.Sprintf("http://%s/", displayAddr(ln.Addr().String()))
+	log.Logf("Proxying %s to %s", p.url, backend)
+}
+
+// URL returns the address the proxy listens on, or "" if it isn't running.
+func (p *Proxy) URL() string {
+	if p == nil {
+		return ""
+	}
+	return p.url
+}
+
+func displayAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (p *Proxy) handler() http.Handler {
+	target := &url.URL{Scheme: "http", Host: p.backendAddr}
+	rp := httputil.NewSingleHostReverseProxy(target)
+
+	director := rp.Director
+	rp.Director = func(req *http.Request) {
+		director(req)
+		// Ask for an uncompressed response so scripts can be injected into it.
+		req.Header.Del("Accept-Encoding")
+	}
+	rp.Transport = &replayTransport{p: p, base: http.DefaultTransport}
+	rp.ModifyResponse = injectScripts
+	rp.ErrorLog = golog.New(os.Stderr, "[proxy]", 0)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Body != nil && req.Body != http.NoBody {
+			body, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, maxBufferedBody))
+			if err != nil {
+				http.Error(rw, "Request body too large to proxy", http.StatusRequestEntityTooLarge)
+				return
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(body)), nil
+			}
+		}
+
+		if !p.waitReady(p.holdTimeout) {
+			http.Error(rw, "Timed out waiting for the target to start", http.StatusGatewayTimeout)
+			return
+		}
+		rp.ServeHTTP(rw, req)
+	})
+}
+
+// replayTransport retries requests that could not reach the backend once the
+// backend is accepting connections again.
+type replayTransport struct {
+	p    *Proxy
+	base http.RoundTripper
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	deadline := time.Now().Add(t.p.holdTimeout)
+	for {
+		res, err := t.base.RoundTrip(req)
+		if err == nil || !isDialError(err) || time.Now().After(deadline) {
+			return res, err
+		}
+
+		// The backend went away between accepting the request and proxying it.
+		t.p.backendDown()
+		go t.p.waitForBackend()
+		if !t.p.waitReady(time.Until(deadline)) {
+			return nil, err
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+func isDialError(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		return opErr.Op == "dial"
+	}
+	return false
+}
+
+// injectScripts adds the live reload and profiler script tags to HTML
+// responses.
+func injectScripts(res *http.Response) error {
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		return nil
+	}
+	if res.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+
+	scripts := scriptTags()
+	if scripts == "" {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	body = injectBeforeClosingBody(body, scripts)
+
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func scriptTags() string {
+	var tags strings.Builder
+	for _, env := range []string{"IBAZEL_LIVERELOAD_URL", "IBAZEL_PROFILER_URL"} {
+		if src := os.Getenv(env); src != "" {
+			fmt.Fprintf(&tags, "<script src=%q></script>", src)
+		}
+	}
+	return tags.String()
+}
+
+func injectBeforeClosingBody(body []byte, scripts string) []byte {
+	locs := closingBodyRegex.FindAllIndex(body, -1)
+	if len(locs) == 0 {
+		return append(body, scripts...)
+	}
+	i := locs[len(locs)-1][0]
+
+	out := make([]byte, 0, len(body)+len(scripts))
+	out = append(out, body[:i]...)
+	out = append(out, scripts...)
+	return append(out, body[i:]...)
+}
+
+// backendDown causes new requests to be held until waitForBackend sees the
+// backend accepting connections again.
+func (p *Proxy) backendDown() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.ready:
+		p.ready = make(chan struct{})
+	default:
+	}
+}
+
+func (p *Proxy) backendUp() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case <-p.ready:
+	default:
+		close(p.ready)
+	}
+}
+
+func (p *Proxy) waitReady(timeout time.Duration) bool {
+	p.lock.Lock()
+	ready := p.ready
+	p.lock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (p *Proxy) waitForBackend() {
+	for {
+		p.lock.Lock()
+		closed := p.closed
+		ready := p.ready
+		p.lock.Unlock()
+
+		if closed {
+			return
+		}
+		select {
+		case <-ready:
+			// Someone else already saw the backend come up.
+			return
+		default:
+		}
+
+		conn, err := net.DialTimeout("tcp", p.backendAddr, backendPollInterval)
+		if err == nil {
+			conn.Close()
+			p.backendUp()
+			return
+		}
+		time.Sleep(backendPollInterval)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProxyTag(t *testing.T) {
+	for _, c := range []struct {
+		tag     string
+		listen  string
+		backend string
+		err     bool
+	}{
+		{"ibazel_proxy=8080->3000", ":8080", "localhost:3000", false},
+		{"ibazel_proxy=127.0.0.1:8080->3000", "127.0.0.1:8080", "localhost:3000", false},
+		{"ibazel_proxy=8080->10.0.0.1:3000", ":8080", "10.0.0.1:3000", false},
+		{"ibazel_proxy= 8080 -> 3000 ", ":8080", "localhost:3000", false},
+		{"ibazel_proxy=8080", "", "", true},
+		{"ibazel_proxy=8080->", "", "", true},
+		{"ibazel_proxy=moo->3000", "", "", true},
+		{"ibazel_proxy=8080->99999", "", "", true},
+	} {
+		listen, backend, err := parseProxyTag(c.tag)
+		if (err != nil) != c.err {
+			t.Errorf("parseProxyTag(%q) error = %v, wanted error: %v", c.tag, err, c.err)
+			continue
+		}
+		if listen != c.listen || backend != c.backend {
+			t.Errorf("parseProxyTag(%q) = (%q, %q), want (%q, %q)", c.tag, listen, backend, c.listen, c.backend)
+		}
+	}
+}
+
+func TestInjectBeforeClosingBody(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want string
+	}{
+		{"<html><body>hi</body></html>", "<html><body>hi<s></body></html>"},
+		{"<html><BODY>hi</BODY ></html>", "<html><BODY>hi<s></BODY ></html>"},
+		{"<p>fragment</p>", "<p>fragment</p><s>"},
+		{"</body>decoy</body>", "</body>decoy<s></body>"},
+	} {
+		got := string(injectBeforeClosingBody([]byte(c.in), "<s>"))
+		if got != c.want {
+			t.Errorf("injectBeforeClosingBody(%q)\nGot:  %s\nWant: %s", c.in, got, c.want)
+		}
+	}
+}
+
+func TestProxyInjectsScripts(t *testing.T) {
+	os.Setenv("IBAZEL_LIVERELOAD_URL", "http://localhost:35729/livereload.js?snipver=1")
+	defer os.Unsetenv("IBAZEL_LIVERELOAD_URL")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/app.js" {
+			rw.Header().Set("Content-Type", "application/javascript")
+			fmt.Fprint(rw, "console.log('</body>')")
+			return
+		}
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(rw, "<html><body>hello</body></html>")
+	}))
+	defer backend.Close()
+
+	p := New(false, 0)
+	p.backendAddr = strings.TrimPrefix(backend.URL, "http://")
+	p.backendUp()
+	front := httptest.NewServer(p.handler())
+	defer front.Close()
+
+	body := get(t, front.URL+"/")
+	want := `<html><body>hello<script src="http://localhost:35729/livereload.js?snipver=1"></script></body></html>`
+	if body != want {
+		t.Errorf("HTML response not injected.\nGot:  %s\nWant: %s", body, want)
+	}
+
+	body = get(t, front.URL+"/app.js")
+	if body != "console.log('</body>')" {
+		t.Errorf("Non-HTML response was modified: %s", body)
+	}
+}
+
+func TestProxyHoldsRequestsUntilBackendIsUp(t *testing.T) {
+	// Reserve a port and release it so the backend can come up on it later.
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	p := New(false, 0)
+	p.backendAddr = addr
+	defer p.Cleanup()
+	front := httptest.NewServer(p.handler())
+	defer front.Close()
+
+	// Start listening for the backend after the request has been issued.
+	go p.waitForBackend()
+	result := make(chan string)
+	go func() {
+		result <- get(t, front.URL+"/")
+	}()
+	time.Sleep(3 * backendPollInterval)
+
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, "up")
+	})}
+	go backend.Serve(ln)
+	defer backend.Close()
+
+	select {
+	case body := <-result:
+		if body != "up" {
+			t.Errorf("Got %q, want %q", body, "up")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Request was never replayed against the backend")
+	}
+}
+
+func get(t *testing.T, url string) string {
+	t.Helper()
+
+	res, err := http.Get(url)
+	if err != nil {
+		t.Errorf("http.Get(%q): %v", url, err)
+		return ""
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Errorf("Reading response: %v", err)
+	}
+	return string(body)
+}
+
+func TestProxyURL(t *testing.T) {
+	p := New(false, 0)
+	defer p.Cleanup()
+	if url := p.URL(); url != "" {
+		t.Errorf("Got URL %q before the proxy started", url)
+	}
+
+	p.startProxyServer("127.0.0.1:0", "127.0.0.1:1")
+	if url := p.URL(); !strings.HasPrefix(url, "http://127.0.0.1:") {
+		t.Errorf("Got URL %q, want one on 127.0.0.1", url)
+	}
+	if p.waitReady(10 * time.Millisecond) {
+		t.Errorf("Expected the proxy to time out waiting for the backend")
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package target_config reads the per-target settings that are given to
+// iBazel as tags on the target's rule, e.g.
+//
+//   tags = [
+//       "ibazel_notify_changes",
+//       "ibazel_debounce=500ms",
+//       "ibazel_listen=:8080,:8081",
+//   ]
+package target_config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
+)
+
+// Prefix starts every tag iBazel reads.
+const Prefix = "ibazel_"
+
+// Kind is the type of value a Key takes.
+type Kind int
+
+const (
+	// Flag keys are set by tagging with ibazel_<name> and take no value.
+	Flag Kind = iota
+	// String keys take a single value.
+	String
+	// List keys take comma separated values and may be repeated.
+	List
+	// Duration keys take a single value like "500ms" or "2s".
+	Duration
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Flag:
+		return "flag"
+	case String:
+		return "string"
+	case List:
+		return "list"
+	case Duration:
+		return "duration"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Key describes a setting that can be given with an ibazel_<name> tag.
+type Key struct {
+	Name string
+	Kind Kind
+
+	// Validate checks a single value and returns an error describing what is
+	// wrong with it. It is optional and not called for Flag keys.
+	Validate func(value string) error
+}
+
+// Registry holds the keys iBazel and its lifecycle listeners understand.
+type Registry struct {
+	keys map[string]Key
+}
+
+func NewRegistry() *Registry {
+	return &Registry{keys: map[string]Key{}}
+}
+
+// Register adds keys to the registry. Every key name can only be registered
+// once.
+func (r *Registry) Register(keys ...Key) error {
+	for _, k := range keys {
+		if k.Name == "" || strings.ContainsAny(k.Name, "=, ") {
+			return fmt.Errorf("Invalid tag key name %q", k.Name)
+		}
+		if _, ok := r.keys[k.Name]; ok {
+			return fmt.Errorf("Tag key %s%s is registered twice", Prefix, k.Name)
+		}
+		r.keys[k.Name] = k
+	}
+	return nil
+}
+
+// Names returns the names of all the registered keys, sorted.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.keys))
+	for name := range r.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseRule reads the settings from the tags of rule. See Parse.
+func (r *Registry) ParseRule(rule *blaze_query.Rule) (*Config, error) {
+	return r.Parse(Tags(rule))
+}
+
+// Parse reads the settings from tags. Tags that don't start with Prefix are
+// ignored. The returned Config holds every valid setting even if an error is
+// returned for the others.
+func (r *Registry) Parse(tags []string) (*Config, error) {
+	c := newConfig()
+	var errs Errors
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, Prefix) {
+			continue
+		}
+		if err := r.parseTag(c, tag); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, nil
+}
+
+func (r *Registry) parseTag(c *Config, tag string) error {
+	name := strings.TrimPrefix(tag, Prefix)
+	value, hasValue := "", false
+	if i := strings.Index(name, "="); i >= 0 {
+		name, value, hasValue = name[:i], name[i+1:], true
+	}
+
+	k, ok := r.keys[name]
+	if !ok {
+		return fmt.Errorf("%q: unknown key %q, known keys are %s", tag, name, strings.Join(r.Names(), ", "))
+	}
+
+	if k.Kind == Flag {
+		if hasValue {
+			return fmt.Errorf("%q: %s%s doesn't take a value", tag, Prefix, name)
+		}
+		c.flags[name] = true
+		return nil
+	}
+
+	if !hasValue || strings.TrimSpace(value) == "" {
+		return fmt.Errorf("%q: %s%s needs a %s value, e.g. %s%s=<value>", tag, Prefix, name, k.Kind, Prefix, name)
+	}
+
+	values := []string{strings.TrimSpace(value)}
+	if k.Kind == List {
+		values = nil
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	} else if _, ok := c.values[name]; ok {
+		return fmt.Errorf("%q: %s%s is set more than once", tag, Prefix, name)
+	}
+
+	for _, v := range values {
+		if k.Kind == Duration {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return fmt.Errorf("%q: %q isn't a duration like \"500ms\" or \"2s\"", tag, v)
+			}
+			c.durations[name] = d
+		}
+		if k.Validate != nil {
+			if err := k.Validate(v); err != nil {
+				return fmt.Errorf("%q: %v", tag, err)
+			}
+		}
+	}
+	c.values[name] = append(c.values[name], values...)
+	return nil
+}
+
+// Tags returns the tags of rule.
+func Tags(rule *blaze_query.Rule) []string {
+	if rule == nil {
+		return nil
+	}
+	for _, attr := range rule.Attribute {
+		if attr.GetName() == "tags" && attr.GetType() == blaze_query.Attribute_STRING_LIST {
+			return attr.StringListValue
+		}
+	}
+	return nil
+}
+
+// Errors are all the problems found while parsing tags.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Config holds the settings read from a target's tags. A nil Config has no
+// settings.
+type Config struct {
+	flags     map[string]bool
+	values    map[string][]string
+	durations map[string]time.Duration
+}
+
+func newConfig() *Config {
+	return &Config{
+		flags:     map[string]bool{},
+		values:    map[string][]string{},
+		durations: map[string]time.Duration{},
+	}
+}
+
+// Flag returns whether the Flag key name was set.
+func (c *Config) Flag(name string) bool {
+	if c == nil {
+		return false
+	}
+	return c.flags[name]
+}
+
+// String returns the value of the String key name, if it was set.
+func (c *Config) String(name string) (string, bool) {
+	if c == nil || len(c.values[name]) == 0 {
+		return "", false
+	}
+	return c.values[name][0], true
+}
+
+// List returns all the values of the List key name.
+func (c *Config) List(name string) []string {
+	if c == nil {
+		return nil
+	}
+	return c.values[name]
+}
+
+// Duration returns the value of the Duration key name, if it was set.
+func (c *Config) Duration(name string) (time.Duration, bool) {
+	if c == nil {
+		return 0, false
+	}
+	d, ok := c.durations[name]
+	return d, ok
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package target_config
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
+)
+
+func newTestRegistry(t *testing.T) *Registry {
+	r := NewRegistry()
+	err := r.Register(
+		Key{Name: "notify_changes", Kind: Flag},
+		Key{Name: "listen", Kind: List},
+		Key{Name: "debounce", Kind: Duration},
+		Key{Name: "signal", Kind: String, Validate: func(v string) error {
+			if v != "SIGTERM" && v != "SIGINT" {
+				return errors.New("unknown signal")
+			}
+			return nil
+		}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRegister(t *testing.T) {
+	r := newTestRegistry(t)
+	if err := r.Register(Key{Name: "listen", Kind: String}); err == nil {
+		t.Errorf("Expected registering a key twice to fail")
+	}
+	if err := r.Register(Key{Name: "a=b", Kind: String}); err == nil {
+		t.Errorf("Expected registering an invalid name to fail")
+	}
+	if got, want := r.Names(), []string{"debounce", "listen", "notify_changes", "signal"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+}
+
+func TestParse(t *testing.T) {
+	r := newTestRegistry(t)
+	c, err := r.Parse([]string{
+		"manual",
+		"ibazel_notify_changes",
+		"ibazel_listen=:8080",
+		"ibazel_listen=:8081, localhost:9000",
+		"ibazel_debounce=250ms",
+		"ibazel_signal=SIGINT",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.Flag("notify_changes") {
+		t.Errorf("Expected notify_changes to be set")
+	}
+	if c.Flag("listen") {
+		t.Errorf("Expected listen not to be a flag")
+	}
+	if got, want := c.List("listen"), []string{":8080", ":8081", "localhost:9000"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List(listen) = %v, want %v", got, want)
+	}
+	if got, ok := c.Duration("debounce"); !ok || got != 250*time.Millisecond {
+		t.Errorf("Duration(debounce) = %v, %v, want 250ms", got, ok)
+	}
+	if got, ok := c.String("signal"); !ok || got != "SIGINT" {
+		t.Errorf("String(signal) = %q, %v, want SIGINT", got, ok)
+	}
+	if _, ok := c.String("missing"); ok {
+		t.Errorf("Expected missing not to be set")
+	}
+}
+
+func TestParse_errors(t *testing.T) {
+	r := newTestRegistry(t)
+	for _, c := range []struct {
+		tag  string
+		want string
+	}{
+		{"ibazel_moo", `unknown key "moo", known keys are debounce, listen, notify_changes, signal`},
+		{"ibazel_notify_changes=yes", "doesn't take a value"},
+		{"ibazel_debounce", "needs a duration value"},
+		{"ibazel_debounce=", "needs a duration value"},
+		{"ibazel_debounce=soon", `"soon" isn't a duration`},
+		{"ibazel_debounce=-1s", `"-1s" isn't a duration`},
+		{"ibazel_signal=SIGFOO", "unknown signal"},
+	} {
+		_, err := r.Parse([]string{c.tag})
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, wanted an error", c.tag)
+			continue
+		}
+		if !strings.Contains(err.Error(), c.want) {
+			t.Errorf("Parse(%q) error = %q, wanted it to contain %q", c.tag, err, c.want)
+		}
+	}
+}
+
+func TestParse_keepsValidSettings(t *testing.T) {
+	r := newTestRegistry(t)
+	c, err := r.Parse([]string{"ibazel_debounce=1s", "ibazel_debounce=2s", "ibazel_moo", "ibazel_listen=:8080"})
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", err)
+	}
+	if got, _ := c.Duration("debounce"); got != time.Second {
+		t.Errorf("Duration(debounce) = %v, want the first value 1s", got)
+	}
+	if got := c.List("listen"); len(got) != 1 {
+		t.Errorf("List(listen) = %v, want [:8080]", got)
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	r := newTestRegistry(t)
+	rule := &blaze_query.Rule{
+		Name: proto.String("//path/to:target"),
+		Attribute: []*blaze_query.Attribute{
+			{
+				Name:            proto.String("tags"),
+				Type:            blaze_query.Attribute_STRING_LIST.Enum(),
+				StringListValue: []string{"ibazel_notify_changes"},
+			},
+		},
+	}
+	c, err := r.ParseRule(rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Flag("notify_changes") {
+		t.Errorf("Expected notify_changes to be set")
+	}
+
+	var nilConfig *Config
+	if nilConfig.Flag("notify_changes") || nilConfig.List("listen") != nil {
+		t.Errorf("Expected a nil Config to have no settings")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/coverage"
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+)
+
+// Bazel prints where it put the combined report once coverage is done:
+// "INFO: LCOV coverage report is located at /path/to/_coverage_report.dat".
+var coverageReportRegex = regexp.MustCompile(`coverage report is located at (\S+)`)
+
+// Coverage runs the specified tests with coverage in the IBazel loop until
+// ctx is done.
+func (i *IBazel) Coverage(ctx context.Context, targets ...string) error {
+	return i.loop(ctx, "coverage", i.coverage, targets)
+}
+
+func (i *IBazel) coverage(ctx context.Context, targets ...string) (*bytes.Buffer, error) {
+	b := i.newBazel()
+
+	outputBuffer, err := b.Coverage(ctx, append([]string{"--combined_report=lcov"}, targets...)...)
+	if err != nil {
+		log.Errorf("Build error: %v", err)
+		return outputBuffer, err
+	}
+	i.reportCoverage(outputBuffer)
+	return outputBuffer, nil
+}
+
+// coverageReportPath returns where Bazel wrote the combined LCOV report.
+func (i *IBazel) coverageReportPath(output *bytes.Buffer) string {
+	if output != nil {
+		if m := coverageReportRegex.FindSubmatch(output.Bytes()); m != nil {
+			return string(m[1])
+		}
+	}
+	if i.outputPath == "" {
+		return ""
+	}
+	return filepath.Join(i.outputPath, "_coverage", "_coverage_report.dat")
+}
+
+// reportCoverage prints the coverage of the files that changed since the last
+// iteration, or of every file on the first one, and writes the summaries.
+func (i *IBazel) reportCoverage(output *bytes.Buffer) {
+	path := i.coverageReportPath(output)
+	if path == "" {
+		log.Errorf("Not reporting coverage because the location of the report is unknown")
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Errorf("Error reading coverage report: %v", err)
+		return
+	}
+	defer f.Close()
+	report, err := coverage.Parse(f)
+	if err != nil {
+		log.Errorf("Error reading coverage report %s: %v", path, err)
+		return
+	}
+
+	workspacePath, _ := i.workspaceFinder.FindWorkspace()
+	paths := report.Paths()
+	if len(i.changes) > 0 {
+		paths = changedCoveragePaths(report, workspacePath, i.changes)
+	}
+	for _, p := range paths {
+		f := report.Files[p]
+		log.Logf("%s: %.1f%% (%d/%d lines)", p, f.Percent(), f.LinesHit(), f.LinesFound())
+	}
+	hit, found := report.Total()
+	log.Logf("Total coverage: %.1f%% (%d/%d lines)", report.Percent(), hit, found)
+
+	if i.coverageLCOVPath != "" {
+		writeCoverageReport(workspacePath, i.coverageLCOVPath, report.WriteLCOV)
+	}
+	if i.coverageHTMLPath != "" {
+		writeCoverageReport(workspacePath, i.coverageHTMLPath, report.WriteHTML)
+	}
+}
+
+// changedCoveragePaths returns the paths in the report of the changed files,
+// which are absolute, while the paths in the report are relative to the
+// workspace root.
+func changedCoveragePaths(report *coverage.Report, workspacePath string, changes []string) []string {
+	var paths []string
+	for _, change := range changes {
+		rel, err := filepath.Rel(workspacePath, change)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if _, ok := report.Files[rel]; ok && !contains(paths, rel) {
+			paths = append(paths, rel)
+		}
+	}
+	return paths
+}
+
+func writeCoverageReport(workspacePath string, path string, write func(w io.Writer) error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workspacePath, path)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Errorf("Error writing coverage summary: %v", err)
+		return
+	}
+	defer f.Close()
+	if err := write(f); err != nil {
+		log.Errorf("Error writing coverage summary %s: %v", path, err)
+	}
+}
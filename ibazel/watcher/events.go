@@ -0,0 +1,113 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/bazelbuild/bazel-watcher/bazel"
+)
+
+// EventType is the kind of an Event.
+type EventType string
+
+const (
+	// A watched file changed.
+	CHANGE_DETECTED EventType = "CHANGE_DETECTED"
+	// A command is about to run.
+	BEFORE_COMMAND EventType = "BEFORE_COMMAND"
+	// A command ran.
+	AFTER_COMMAND EventType = "AFTER_COMMAND"
+	// A command wrote a line of output.
+	OUTPUT_LINE EventType = "OUTPUT_LINE"
+	// The command run by exec exited.
+	EXEC_EXITED EventType = "EXEC_EXITED"
+)
+
+// Event is something that happened in the IBazel loop. It carries the same
+// information as the matching Lifecycle call.
+type Event struct {
+	Type    EventType
+	Targets []string
+
+	// ChangeType is "source" or "graph", and Change is the file that changed.
+	// They are only set for CHANGE_DETECTED.
+	ChangeType string
+	Change     string
+
+	// Command is the command that is about to run or ran, as passed to
+	// Lifecycle.BeforeCommand. Success and Output are only set for
+	// AFTER_COMMAND.
+	Command string
+	Success bool
+	Output  *bytes.Buffer
+
+	// Line is only set for OUTPUT_LINE.
+	Line bazel.Line
+
+	// ExitStatus is only set for EXEC_EXITED, and is -1 if the command
+	// couldn't be run.
+	ExitStatus int
+}
+
+type subscriber struct {
+	ctx    context.Context
+	events chan Event
+}
+
+type subscribers struct {
+	lock sync.Mutex
+	subs []*subscriber
+}
+
+// Subscribe returns a channel that receives the events of the IBazel loop
+// until ctx is done, at which point it is closed. The loop waits for the
+// events to be received, so they should be read promptly.
+func (i *IBazel) Subscribe(ctx context.Context) <-chan Event {
+	sub := &subscriber{ctx: ctx, events: make(chan Event, 16)}
+
+	i.subscribers.lock.Lock()
+	i.subscribers.subs = append(i.subscribers.subs, sub)
+	i.subscribers.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		i.subscribers.lock.Lock()
+		defer i.subscribers.lock.Unlock()
+		for n, s := range i.subscribers.subs {
+			if s == sub {
+				i.subscribers.subs = append(i.subscribers.subs[:n], i.subscribers.subs[n+1:]...)
+				break
+			}
+		}
+		close(sub.events)
+	}()
+	return sub.events
+}
+
+// publish sends e to every subscriber.
+func (i *IBazel) publish(e Event) {
+	i.subscribers.lock.Lock()
+	defer i.subscribers.lock.Unlock()
+	for _, sub := range i.subscribers.subs {
+		select {
+		case sub.events <- e:
+		case <-sub.ctx.Done():
+		}
+	}
+}
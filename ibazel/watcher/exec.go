@@ -0,0 +1,112 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/bazelbuild/bazel-watcher/bazel"
+	"github.com/bazelbuild/bazel-watcher/ibazel/command"
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+)
+
+// Replaced by the output files of the build in the arguments of exec.
+const outputsPlaceholder = "{outputs}"
+
+// Bazel only lists the output files of as many targets as --show_result says,
+// one by default.
+const showAllResults = "--show_result=2147483647"
+
+var execCommand = exec.CommandContext
+
+// Exec builds the specified targets and then runs a command in the IBazel
+// loop until ctx is done.
+func (i *IBazel) Exec(ctx context.Context, targets []string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("exec needs a command to run after --")
+	}
+	i.execArgs = args
+	return i.loop(ctx, "exec", i.exec, targets)
+}
+
+func (i *IBazel) exec(ctx context.Context, targets ...string) (*bytes.Buffer, error) {
+	outputBuffer, err := i.build(ctx, append([]string{showAllResults}, targets...)...)
+	if err != nil {
+		return outputBuffer, err
+	}
+	outputs := command.BuildOutputs(outputBuffer)
+	if len(outputs) == 0 && usesOutputs(i.execArgs) {
+		log.Errorf("No output files were found in the output of the build, %s expands to nothing", outputsPlaceholder)
+	}
+
+	args := expandOutputs(i.execArgs, outputs)
+	cmd := execCommand(ctx, args[0], args[1:]...)
+	if workspacePath, err := i.workspaceFinder.FindWorkspace(); err == nil {
+		// The outputs are relative to the workspace root.
+		cmd.Dir = workspacePath
+	}
+	cmd.Env = append(os.Environ(), i.ibazelEnv()...)
+	cmd.Env = append(cmd.Env, "IBAZEL_BUILD_OUTPUTS="+strings.Join(outputs, string(os.PathListSeparator)))
+
+	// Only the last lines of output are kept, like those of Bazel.
+	stdout, stderr, output, flush := bazel.NewOutputWriters(os.Stdout, os.Stderr, bazel.DefaultOutputBufferLines)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	log.Logf("Running %s", strings.Join(args, " "))
+	err = cmd.Run()
+	flush()
+	status := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status = exitErr.ExitCode()
+		log.Errorf("Command exited with status %d", status)
+	} else if err != nil {
+		status = -1
+		log.Errorf("Error running command: %v", err)
+	} else {
+		log.Logf("Command succeeded")
+	}
+	i.execExited(targets, status)
+	return output.Bytes(), err
+}
+
+func usesOutputs(args []string) bool {
+	for _, arg := range args {
+		if arg == outputsPlaceholder {
+			return true
+		}
+	}
+	return false
+}
+
+// expandOutputs replaces every argument that is exactly {outputs} with the
+// output files.
+func expandOutputs(args []string, outputs []string) []string {
+	expanded := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == outputsPlaceholder {
+			expanded = append(expanded, outputs...)
+		} else {
+			expanded = append(expanded, arg)
+		}
+	}
+	return expanded
+}
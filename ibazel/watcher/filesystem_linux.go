@@ -0,0 +1,60 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package watcher
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Filesystems that don't deliver inotify events for changes made elsewhere,
+// such as on the host of a container or on a file server, by the magic number
+// statfs returns for them.
+var filesystemsWithoutInotify = map[uint32]string{
+	0x6969:     "NFS",
+	0x517b:     "SMB",
+	0xfe534d42: "SMB2",
+	0xff534d42: "CIFS",
+	0x65735546: "FUSE",
+	0x01021997: "9P",
+	0x6a656a63: "virtiofs",
+	0x786f4256: "VirtualBox shared folder",
+}
+
+// filesystemWithoutInotify returns the name of the filesystem of path when
+// it is known not to deliver inotify events.
+func filesystemWithoutInotify(path string) (string, bool) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", false
+	}
+	name, ok := filesystemsWithoutInotify[uint32(st.Type)]
+	return name, ok
+}
+
+// inotifyLimit reads one of the limits in /proc/sys/fs/inotify.
+func inotifyLimit(name string) (int, bool) {
+	data, err := ioutil.ReadFile(filepath.Join("/proc/sys/fs/inotify", name))
+	if err != nil {
+		return 0, false
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return limit, err == nil
+}
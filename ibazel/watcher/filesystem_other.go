@@ -0,0 +1,29 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package watcher
+
+// filesystemWithoutInotify returns the name of the filesystem of path when
+// it is known not to deliver inotify events. inotify is only used on Linux.
+func filesystemWithoutInotify(path string) (string, bool) {
+	return "", false
+}
+
+// inotifyLimit reads one of the limits in /proc/sys/fs/inotify, which only
+// exist on Linux.
+func inotifyLimit(name string) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,1146 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package watcher is the engine of iBazel. It watches the sources of Bazel
+// targets and builds, tests or runs them whenever they change.
+//
+//   w, err := watcher.New(watcher.Options{Lifecycles: []watcher.Lifecycle{l}})
+//   if err != nil {
+//     return err
+//   }
+//   defer w.Cleanup()
+//   return w.Build(ctx, "//path/to:target")
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bazelbuild/bazel-watcher/bazel"
+	"github.com/bazelbuild/bazel-watcher/ibazel/command"
+	"github.com/bazelbuild/bazel-watcher/ibazel/live_reload"
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+	"github.com/bazelbuild/bazel-watcher/ibazel/output_runner"
+	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
+	"github.com/bazelbuild/bazel-watcher/ibazel/profiler"
+	"github.com/bazelbuild/bazel-watcher/ibazel/proxy"
+	"github.com/bazelbuild/bazel-watcher/ibazel/target_config"
+	"github.com/bazelbuild/bazel-watcher/ibazel/workspace_finder"
+	"github.com/fsnotify/fsnotify"
+
+	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
+)
+
+var osExit = os.Exit
+var bazelNew = bazel.New
+var commandDefaultCommand = command.DefaultCommand
+var commandNotifyCommand = command.NotifyCommand
+
+type State string
+type runnableCommand func(context.Context, ...string) (*bytes.Buffer, error)
+
+const (
+	DEBOUNCE_QUERY   State = "DEBOUNCE_QUERY"
+	QUERY            State = "QUERY"
+	WAIT             State = "WAIT"
+	DEBOUNCE_RUN     State = "DEBOUNCE_RUN"
+	DEBOUNCE_RESTART State = "DEBOUNCE_RESTART"
+	RESTART          State = "RESTART"
+	RUN              State = "RUN"
+	QUIT             State = "QUIT"
+)
+
+// IBazel watches the sources of targets and runs a command on them whenever
+// they change. It runs one loop at a time.
+type IBazel struct {
+	debounceDuration time.Duration
+	runInPTY         bool
+
+	// Settings for logging the output of run targets.
+	runOutputLog        bool
+	runOutputLogMaxSize int64
+	quietRunOutputLines int
+
+	cmd         command.Command
+	execArgs    []string
+	sockets     *command.Sockets
+	tagRegistry *target_config.Registry
+	outputLog   *command.OutputLog
+	args        []string
+	bazelArgs   []string
+	startupArgs []string
+
+	sigs           chan os.Signal // Signals channel for the current process
+	interruptCount int
+
+	workspaceFinder workspace_finder.WorkspaceFinder
+
+	buildFileWatcher  fSNotifyWatcher
+	sourceFileWatcher fSNotifyWatcher
+	// Whether the watchers poll instead of using fsnotify, how often they look
+	// for changes then, and whether they compare the content of files. Even
+	// fsnotify watchers poll the directories past the inotify limits.
+	poll         bool
+	pollInterval time.Duration
+	pollHash     bool
+
+	filesWatched map[fSNotifyWatcher]*watchSet
+
+	// Watched directories that were deleted or moved away. The watcher drops
+	// them, so the next query adds them again once they are back.
+	removedDirs map[fSNotifyWatcher]map[string]struct{}
+
+	// Files, directories and globs whose changes only restart the run target,
+	// and the entries of filesWatched that are only watched because of them.
+	watchPaths   []string
+	extraWatched map[fSNotifyWatcher]map[string]struct{}
+
+	sourceEventHandler *SourceEventHandler
+	lifecycleListeners []Lifecycle
+	subscribers        subscribers
+
+	liveReload *live_reload.LiveReloadServer
+	profiler   *profiler.Profiler
+	proxy      *proxy.Proxy
+
+	// Messages written by the running target to its control channel.
+	controlMessages chan command.ControlMessage
+
+	// Bazel's output base, where iBazel keeps its own files.
+	outputBase string
+	// Where Bazel puts its outputs.
+	outputPath string
+	// The version of Bazel, such as "release 5.0.0".
+	bazelRelease string
+
+	// Files that changed since the command was last run.
+	changes []string
+
+	// How many times a command was run.
+	iterations int
+
+	// Environment of the run target.
+	runEnvFiles []string
+	runEnv      []string
+
+	// The stages of ibazel pipeline.
+	stages []Stage
+
+	// Where ibazel coverage writes its summaries.
+	coverageLCOVPath string
+	coverageHTMLPath string
+
+	// The queries that find the files to watch, and whether the source files
+	// are found with cquery.
+	queries watchQueries
+	cquery  bool
+	// The query that follows a change to the build graph, while it is pending,
+	// and where its result is sent.
+	requery        *requery
+	requeryResults chan requeryResult
+	// Whether only the files affected by changed packages are queried, and
+	// how often all of them are.
+	incrementalQuery  bool
+	fullQueryInterval time.Duration
+	lastFullQuery     time.Time
+	// The BUILD and .bzl files that changed since the last query.
+	graphChanges []string
+	// Whether the watch set is cached under the output base.
+	queryCache bool
+
+	// Where the output of Bazel is shown.
+	stdout io.Writer
+	stderr io.Writer
+
+	// The command that is running, for the listeners of its output.
+	runningTargets []string
+	runningCommand string
+
+	state State
+}
+
+// Options configures an IBazel.
+type Options struct {
+	// Passed to every Bazel invocation.
+	StartupArgs []string
+	BazelArgs   []string
+
+	// How long to wait for more changes before acting on one. Defaults to
+	// 100ms.
+	DebounceDuration time.Duration
+
+	// Run the target of Run in a pseudo-terminal.
+	RunInPTY bool
+	// Tee the output of the target of Run into log files under Bazel's output
+	// base, rotated once they grow past RunOutputLogMaxSize bytes.
+	RunOutputLog        bool
+	RunOutputLogMaxSize int64
+	// Only show the last lines of output of the target of Run once it goes
+	// quiet. Implies RunOutputLog.
+	QuietRunOutputLines int
+	// Files, directories and globs, relative to the workspace root, whose
+	// changes restart the target of Run without rebuilding it.
+	WatchPaths []string
+	// Dotenv files, relative to the workspace root, and KEY=VALUE overrides
+	// for the environment of the target of Run.
+	RunEnvFiles []string
+	RunEnv      []string
+
+	// Where Coverage writes an LCOV and an HTML summary after each iteration.
+	// Relative paths are relative to the workspace root, and empty paths
+	// aren't written.
+	CoverageLCOVPath string
+	CoverageHTMLPath string
+
+	// Where the output of Bazel is shown as it is written. They default to
+	// os.Stdout and os.Stderr.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Templates of the queries that find the source files, and the BUILD and
+	// .bzl files, to watch. {targets} is replaced by the targets. They default
+	// to DefaultSourceQuery and DefaultBuildQuery.
+	SourceQuery string
+	BuildQuery  string
+	// Options given to every watch query, such as --keep_going.
+	QueryArgs []string
+	// Find the source files to watch with cquery and BazelArgs, so that only
+	// the files of the active configuration are watched. Plain query is used
+	// when cquery fails.
+	CQuery bool
+	// After a change to BUILD or .bzl files, only query for the files the
+	// changed packages can affect, and merge them into the watch set. All the
+	// files to watch are still queried when the last full query is older than
+	// FullQueryInterval, which defaults to DefaultFullQueryInterval.
+	IncrementalQuery  bool
+	FullQueryInterval time.Duration
+	// Cache the files to watch under Bazel's output base. The next IBazel
+	// watching the same targets with the same flags starts from them as long
+	// as none of the BUILD and .bzl files changed, and queries for the files
+	// to watch in the background.
+	QueryCache bool
+
+	// Lifecycles are notified of what happens in the loop after the built-in
+	// live reload, profiler, output runner and proxy listeners.
+	Lifecycles []Lifecycle
+
+	// HandleSignals makes SIGINT, SIGTERM and SIGHUP stop the running target
+	// and exit the process, like the ibazel binary does.
+	HandleSignals bool
+
+	// Version is the version of iBazel reported in profiles, and ProfilePath
+	// the file the profile is appended to. Nothing is profiled without one.
+	Version     string
+	ProfilePath string
+
+	// Ignore the ibazel_live_reload and ibazel_proxy tags of run targets.
+	NoLiveReload bool
+	NoProxy      bool
+	// How long the proxy holds requests while the target is coming back up.
+	// Defaults to proxy.DefaultHoldTimeout.
+	ProxyHoldTimeout time.Duration
+
+	// Look for commands, such as buildozer fixes, in the output of Bazel and
+	// run them, after asking when RunOutputInteractive is set.
+	RunOutput            bool
+	RunOutputInteractive bool
+
+	// Watcher is how changes are noticed: WatcherFSNotify, WatcherPoll, or
+	// WatcherAuto, the default, which polls when the workspace is on a
+	// filesystem known not to deliver inotify events. Polling looks at the
+	// watched files every PollInterval, which defaults to DefaultPollInterval,
+	// and with PollHash compares their content instead of their modification
+	// time.
+	Watcher      string
+	PollInterval time.Duration
+	PollHash     bool
+}
+
+// The ways of noticing changes.
+const (
+	WatcherAuto     = "auto"
+	WatcherFSNotify = "fsnotify"
+	WatcherPoll     = "poll"
+)
+
+// New creates an IBazel. It must be cleaned up once it is no longer used. ctx
+// bounds the bazel info that finds the output base.
+func New(ctx context.Context, opts Options) (*IBazel, error) {
+	for _, kv := range opts.RunEnv {
+		if err := command.ParseEnvVar(kv); err != nil {
+			return nil, err
+		}
+	}
+	queries, err := newWatchQueries(opts.SourceQuery, opts.BuildQuery, opts.QueryArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &IBazel{queries: queries}
+	switch opts.Watcher {
+	case "", WatcherAuto:
+		workspacePath, err := (&workspace_finder.MainWorkspaceFinder{}).FindWorkspace()
+		if err == nil {
+			if fs, ok := filesystemWithoutInotify(workspacePath); ok {
+				log.Logf("The workspace is on %s, which doesn't report changes. Polling for them instead", fs)
+				i.poll = true
+			}
+		}
+	case WatcherFSNotify:
+	case WatcherPoll:
+		i.poll = true
+	default:
+		return nil, fmt.Errorf("Unknown watcher %q, expected %s, %s or %s", opts.Watcher, WatcherAuto, WatcherFSNotify, WatcherPoll)
+	}
+	i.pollInterval = DefaultPollInterval
+	if opts.PollInterval > 0 {
+		i.pollInterval = opts.PollInterval
+	}
+	i.pollHash = opts.PollHash
+	err = i.setup()
+	if err != nil {
+		return nil, err
+	}
+
+	i.debounceDuration = 100 * time.Millisecond
+	if opts.DebounceDuration > 0 {
+		i.debounceDuration = opts.DebounceDuration
+	}
+	i.startupArgs = opts.StartupArgs
+	i.bazelArgs = opts.BazelArgs
+	i.runInPTY = opts.RunInPTY
+	i.runOutputLog = opts.RunOutputLog || opts.QuietRunOutputLines > 0
+	i.runOutputLogMaxSize = opts.RunOutputLogMaxSize
+	i.quietRunOutputLines = opts.QuietRunOutputLines
+	i.runEnvFiles = opts.RunEnvFiles
+	i.runEnv = opts.RunEnv
+	i.coverageLCOVPath = opts.CoverageLCOVPath
+	i.coverageHTMLPath = opts.CoverageHTMLPath
+	i.cquery = opts.CQuery
+	i.incrementalQuery = opts.IncrementalQuery
+	i.queryCache = opts.QueryCache
+	i.fullQueryInterval = opts.FullQueryInterval
+	if i.fullQueryInterval == 0 {
+		i.fullQueryInterval = DefaultFullQueryInterval
+	}
+	i.stdout, i.stderr = opts.Stdout, opts.Stderr
+	if i.stdout == nil {
+		i.stdout = os.Stdout
+	}
+	if i.stderr == nil {
+		i.stderr = os.Stderr
+	}
+	i.filesWatched = map[fSNotifyWatcher]*watchSet{}
+	i.extraWatched = map[fSNotifyWatcher]map[string]struct{}{}
+	i.removedDirs = map[fSNotifyWatcher]map[string]struct{}{}
+	i.workspaceFinder = &workspace_finder.MainWorkspaceFinder{}
+	i.controlMessages = make(chan command.ControlMessage, 16)
+	i.requeryResults = make(chan requeryResult)
+	i.addWatchPaths(opts.WatchPaths...)
+
+	i.sigs = make(chan os.Signal, 1)
+	if opts.HandleSignals {
+		signal.Notify(i.sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	}
+
+	liveReload := live_reload.New(opts.NoLiveReload)
+	profiler := profiler.New(opts.Version, opts.ProfilePath)
+	outputRunner := output_runner.New(opts.RunOutput, opts.RunOutputInteractive)
+	proxy := proxy.New(opts.NoProxy, opts.ProxyHoldTimeout)
+
+	liveReload.AddEventsListener(profiler)
+	i.liveReload = liveReload
+	i.profiler = profiler
+	i.proxy = proxy
+
+	i.lifecycleListeners = append([]Lifecycle{
+		liveReload,
+		profiler,
+		outputRunner,
+		proxy,
+	}, opts.Lifecycles...)
+
+	i.tagRegistry, err = newTagRegistry(i.lifecycleListeners)
+	if err != nil {
+		return nil, err
+	}
+
+	info, _ := i.getInfo(ctx)
+	if info != nil {
+		i.outputBase = (*info)["output_base"]
+		i.outputPath = (*info)["output_path"]
+		i.bazelRelease = (*info)["release"]
+	}
+	for _, l := range i.lifecycleListeners {
+		l.Initialize(info)
+	}
+
+	if opts.HandleSignals {
+		go func() {
+			for {
+				i.handleSignals()
+			}
+		}()
+	}
+
+	return i, nil
+}
+
+func (i *IBazel) handleSignals() {
+	// Got an OS signal (SIGINT, SIGTERM, SIGHUP).
+	sig := <-i.sigs
+
+	switch sig {
+	case syscall.SIGINT:
+		if i.cmd != nil && i.cmd.IsSubprocessRunning() {
+			log.NewLine()
+			log.Log("Subprocess killed from getting SIGINT (trigger SIGINT again to stop ibazel)")
+			i.cmd.Terminate()
+		} else {
+			osExit(3)
+		}
+		break
+	case syscall.SIGTERM:
+		if i.cmd != nil && i.cmd.IsSubprocessRunning() {
+			log.NewLine()
+			log.Log("Subprocess killed from getting SIGTERM")
+			i.cmd.Terminate()
+		}
+		osExit(3)
+		return
+	case syscall.SIGHUP:
+		if i.cmd != nil && i.cmd.IsSubprocessRunning() {
+			log.NewLine()
+			log.Log("Subprocess killed from getting SIGHUP")
+			i.cmd.Terminate()
+		}
+		osExit(3)
+		return
+	default:
+		log.Fatal("Got a signal that wasn't handled. Please file a bug against bazel-watcher that describes how you did this. This is a big problem.")
+	}
+
+	i.interruptCount += 1
+	if i.interruptCount > 2 {
+		log.NewLine()
+		log.Fatal("Exiting from getting SIGINT 3 times")
+		osExit(3)
+	}
+}
+
+func (i *IBazel) newBazel() bazel.Bazel {
+	b := bazelNew()
+	b.SetStartupArgs(i.startupArgs)
+	b.SetArguments(i.bazelArgs)
+	b.SetStdout(i.stdout)
+	b.SetStderr(i.stderr)
+	b.SetOutputListener(i.outputLine)
+	return b
+}
+
+func (i *IBazel) Cleanup() {
+	i.sourceEventHandler.Close()
+	i.buildFileWatcher.Close()
+	i.sourceFileWatcher.Close()
+	i.sockets.Close()
+	i.outputLog.Close()
+	for _, l := range i.lifecycleListeners {
+		l.Cleanup()
+	}
+}
+
+func (i *IBazel) targetDecider(target string, rule *blaze_query.Rule) {
+	for _, l := range i.lifecycleListeners {
+		// TODO: As the name implies, it would be good to use this to make a
+		// determination about if future events should be routed to this listener.
+		// Why not do it now?
+		// Right now I don't track which file is associated with the end target. I
+		// just query for a list of all files that are rdeps of any target that is
+		// in the list of targets to build/test/run (although run can only have 1).
+		// Since I don't have that mapping right now the information doesn't
+		// presently exist to implement this properly. Once the build graph
+		// changed, the mapping could be built by the query that runs in the
+		// background after the command.
+		l.TargetDecider(rule)
+	}
+}
+
+func (i *IBazel) changeDetected(targets []string, changeType string, change string) {
+	if !contains(i.changes, change) {
+		i.changes = append(i.changes, change)
+	}
+	if changeType == "graph" && !contains(i.graphChanges, change) {
+		i.graphChanges = append(i.graphChanges, change)
+	}
+	for _, l := range i.lifecycleListeners {
+		l.ChangeDetected(targets, changeType, change)
+	}
+	i.publish(Event{Type: CHANGE_DETECTED, Targets: targets, ChangeType: changeType, Change: change})
+}
+
+func (i *IBazel) beforeCommand(targets []string, command string) {
+	i.iterations++
+	i.runningTargets, i.runningCommand = targets, command
+	for _, l := range i.lifecycleListeners {
+		l.BeforeCommand(targets, command)
+	}
+	i.publish(Event{Type: BEFORE_COMMAND, Targets: targets, Command: command})
+}
+
+func (i *IBazel) afterCommand(targets []string, command string, success bool, output *bytes.Buffer) {
+	for _, l := range i.lifecycleListeners {
+		l.AfterCommand(targets, command, success, output)
+	}
+	i.publish(Event{Type: AFTER_COMMAND, Targets: targets, Command: command, Success: success, Output: output})
+}
+
+// execExited passes the exit status of the command run by exec to the
+// listeners that want it.
+func (i *IBazel) execExited(targets []string, status int) {
+	for _, l := range i.lifecycleListeners {
+		if e, ok := l.(ExecListener); ok {
+			e.ExecExited(targets, status)
+		}
+	}
+	i.publish(Event{Type: EXEC_EXITED, Targets: targets, Command: "exec", ExitStatus: status})
+}
+
+// outputLine passes a line of output of the running command to the listeners
+// that want it as it is written.
+func (i *IBazel) outputLine(line bazel.Line) {
+	for _, l := range i.lifecycleListeners {
+		if o, ok := l.(OutputListener); ok {
+			o.OutputLine(i.runningTargets, i.runningCommand, line)
+		}
+	}
+	i.publish(Event{Type: OUTPUT_LINE, Targets: i.runningTargets, Command: i.runningCommand, Line: line})
+}
+
+func (i *IBazel) setup() error {
+	var err error
+
+	// Even though we are going to recreate this when the query happens, create
+	// the pointer we will use to refer to the watchers right now.
+	i.buildFileWatcher, err = i.newWatcher()
+	if err != nil {
+		return err
+	}
+
+	i.sourceFileWatcher, err = i.newWatcher()
+	if err != nil {
+		return err
+	}
+
+	i.sourceEventHandler = newSourceEventHandler(i.sourceFileWatcher)
+
+	return nil
+}
+
+func (i *IBazel) newWatcher() (fSNotifyWatcher, error) {
+	if i.poll {
+		return newPollingWatcher(i.pollInterval, i.pollHash), nil
+	}
+	w, err := wrapWatcher(fsnotify.NewWatcher())
+	if isWatchLimit(err) {
+		log.Errorf("Can't use inotify: too many instances are in use (fs.inotify.max_user_instances is %s). Polling for changes instead", inotifyLimitString("max_user_instances"))
+		return newPollingWatcher(i.pollInterval, i.pollHash), nil
+	}
+	if err != nil {
+		return w, err
+	}
+	return newFallbackWatcher(w, newPollingWatcher(i.pollInterval, i.pollHash)), nil
+}
+
+// Run the specified target (singular) in the IBazel loop until ctx is done.
+func (i *IBazel) Run(ctx context.Context, target string, args []string) error {
+	i.args = args
+	return i.loop(ctx, "run", i.run, []string{target})
+}
+
+// Build the specified targets in the IBazel loop until ctx is done.
+func (i *IBazel) Build(ctx context.Context, targets ...string) error {
+	return i.loop(ctx, "build", i.build, targets)
+}
+
+// Test the specified targets in the IBazel loop until ctx is done.
+func (i *IBazel) Test(ctx context.Context, targets ...string) error {
+	return i.loop(ctx, "test", i.test, targets)
+}
+
+// Command runs any other Bazel command that takes targets, such as
+// mobile-install or fetch, in the IBazel loop until ctx is done.
+func (i *IBazel) Command(ctx context.Context, command string, targets ...string) error {
+	return i.loop(ctx, command, func(ctx context.Context, targets ...string) (*bytes.Buffer, error) {
+		return i.command(ctx, command, targets...)
+	}, targets)
+}
+
+// loop runs the state machine until ctx is done, then stops the run target
+// and returns ctx.Err().
+func (i *IBazel) loop(ctx context.Context, command string, commandToRun runnableCommand, targets []string) error {
+	joinedTargets := strings.Join(targets, " ")
+
+	i.state = QUERY
+	for ctx.Err() == nil {
+		i.iteration(ctx, command, commandToRun, targets, joinedTargets)
+	}
+	i.state = QUIT
+	i.cancelRequery()
+
+	if i.cmd != nil && i.cmd.IsSubprocessRunning() {
+		i.cmd.Terminate()
+	}
+	i.cmd = nil
+	return ctx.Err()
+}
+
+// fsnotify also triggers for file stat and read operations. Explicitly filter the modifying events
+// to avoid triggering builds on file accesses (e.g. due to your IDE checking modified status).
+const modifyingEvents = fsnotify.Write | fsnotify.Create | fsnotify.Rename | fsnotify.Remove
+
+func (i *IBazel) iteration(ctx context.Context, command string, commandToRun runnableCommand, targets []string, joinedTargets string) {
+	switch i.state {
+	case WAIT:
+		select {
+		case e := <-i.sourceEventHandler.SourceFileEvents:
+			if e.Op&modifyingEvents == 0 {
+				break
+			}
+			if i.isRestartOnly(e.Name) {
+				log.Logf("Changed: %q. Restarting...", e.Name)
+				i.changeDetected(targets, "source", e.Name)
+				i.state = DEBOUNCE_RESTART
+			} else if i.watched(i.sourceFileWatcher, e) {
+				log.Logf("Changed: %q. Rebuilding...", e.Name)
+				i.changeDetected(targets, "source", e.Name)
+				i.state = DEBOUNCE_RUN
+			}
+		case e := <-i.buildFileWatcher.Events():
+			if i.watched(i.buildFileWatcher, e) && e.Op&modifyingEvents != 0 {
+				log.Logf("Build graph changed: %q. Requerying...", e.Name)
+				i.changeDetected(targets, "graph", e.Name)
+				i.state = DEBOUNCE_QUERY
+			}
+		case msg := <-i.controlMessages:
+			i.handleControlMessage(targets, msg)
+		case r := <-i.requeryResults:
+			i.finishRequery(targets, r)
+		case <-ctx.Done():
+		}
+	case DEBOUNCE_QUERY:
+		select {
+		case e := <-i.buildFileWatcher.Events():
+			if i.watched(i.buildFileWatcher, e) && e.Op&modifyingEvents != 0 {
+				i.changeDetected(targets, "graph", e.Name)
+			}
+			i.state = DEBOUNCE_QUERY
+		case r := <-i.requeryResults:
+			i.finishRequery(targets, r)
+		case <-time.After(i.debounceDuration):
+			// Run the command right away, and query for the files to watch
+			// once it is done.
+			i.scheduleRequery()
+			i.state = RUN
+		case <-ctx.Done():
+		}
+	case QUERY:
+		if i.loadQueryCache(targets) {
+			// Check the cached files in the background once the command ran.
+			i.scheduleRequery()
+			i.state = RUN
+			break
+		}
+		// Query for which files to watch.
+		log.Logf("Querying for files to watch...")
+		// If a query fails, just keep watching the same files as before.
+		query := i.queries.buildQuery(joinedTargets)
+		toWatch, buildErr := i.queryForSourceFiles(ctx, query)
+		if buildErr == nil {
+			i.watchFiles(query, toWatch, i.buildFileWatcher)
+		}
+		query = i.queries.sourceQuery(joinedTargets)
+		toWatch, sourceErr := i.querySourceFiles(ctx, query)
+		if sourceErr == nil {
+			i.watchFiles(query, toWatch, i.sourceFileWatcher, i.watchPathEntries()...)
+		}
+		if buildErr == nil && sourceErr == nil {
+			i.saveQueryCache(targets)
+		}
+		i.lastFullQuery = time.Now()
+		i.graphChanges = nil
+		i.state = RUN
+	case DEBOUNCE_RUN:
+		select {
+		case e := <-i.sourceEventHandler.SourceFileEvents:
+			if i.watched(i.sourceFileWatcher, e) && e.Op&modifyingEvents != 0 {
+				i.changeDetected(targets, "source", e.Name)
+			}
+			i.state = DEBOUNCE_RUN
+		case r := <-i.requeryResults:
+			i.finishRequery(targets, r)
+		case <-time.After(i.debounceDuration):
+			i.state = RUN
+		case <-ctx.Done():
+		}
+	case DEBOUNCE_RESTART:
+		select {
+		case e := <-i.sourceEventHandler.SourceFileEvents:
+			if e.Op&modifyingEvents == 0 {
+				break
+			}
+			if i.isRestartOnly(e.Name) {
+				i.changeDetected(targets, "source", e.Name)
+			} else if i.watched(i.sourceFileWatcher, e) {
+				// A rebuild restarts the target anyway.
+				log.Logf("Changed: %q. Rebuilding...", e.Name)
+				i.changeDetected(targets, "source", e.Name)
+				i.state = DEBOUNCE_RUN
+			}
+		case r := <-i.requeryResults:
+			i.finishRequery(targets, r)
+		case <-time.After(i.debounceDuration):
+			i.state = RESTART
+		case <-ctx.Done():
+		}
+	case RESTART:
+		if i.cmd != nil {
+			log.Logf("Restarting %s", joinedTargets)
+			i.beforeCommand(targets, "run")
+			err := i.cmd.Restart()
+			i.afterCommand(targets, "run", err == nil, nil)
+		}
+		i.changes = nil
+		i.state = WAIT
+	case RUN:
+		if i.stages != nil {
+			i.runPipeline(ctx)
+		} else {
+			i.runCommand(ctx, command, commandToRun, targets)
+		}
+		i.changes = nil
+		i.state = WAIT
+		i.startRequery(ctx, targets, joinedTargets)
+	}
+}
+
+// runCommand runs a command and reports it to the lifecycle listeners.
+func (i *IBazel) runCommand(ctx context.Context, command string, commandToRun runnableCommand, targets []string) error {
+	v := verb(command)
+	log.Logf("%s%s %s", strings.ToUpper(v[:1]), v[1:], strings.Join(targets, " "))
+	i.beforeCommand(targets, command)
+	outputBuffer, err := commandToRun(ctx, targets...)
+	i.afterCommand(targets, command, err == nil, outputBuffer)
+	return err
+}
+
+// handleControlMessage acts on a request made by the running target.
+func (i *IBazel) handleControlMessage(targets []string, msg command.ControlMessage) {
+	switch msg.Verb {
+	case command.ControlReady:
+		log.Logf("Target reported that it is ready")
+		i.profiler.TargetEvent("READY", "")
+	case command.ControlRebuild:
+		log.Logf("Target requested a rebuild. Rebuilding...")
+		i.state = RUN
+	case command.ControlRestart:
+		if i.cmd == nil {
+			return
+		}
+		log.Logf("Target requested a restart. Restarting...")
+		i.beforeCommand(targets, "run")
+		err := i.cmd.Restart()
+		i.afterCommand(targets, "run", err == nil, nil)
+	case command.ControlReload:
+		i.liveReload.TriggerReload(targets)
+	case command.ControlEvent:
+		i.profiler.TargetEvent(msg.Type, msg.Data)
+	}
+}
+
+func verb(s string) string {
+	switch s {
+	case "build", "test", "fetch":
+		return fmt.Sprintf("%sing", s)
+	case "run":
+		return "running"
+	case "exec":
+		return "executing"
+	default:
+		return fmt.Sprintf("running %s for", s)
+	}
+}
+
+func (i *IBazel) build(ctx context.Context, targets ...string) (*bytes.Buffer, error) {
+	b := i.newBazel()
+
+	outputBuffer, err := b.Build(ctx, targets...)
+	if err != nil {
+		log.Errorf("Build error: %v", err)
+		return outputBuffer, err
+	}
+	return outputBuffer, nil
+}
+
+func (i *IBazel) test(ctx context.Context, targets ...string) (*bytes.Buffer, error) {
+	b := i.newBazel()
+
+	outputBuffer, err := b.Test(ctx, targets...)
+	if err != nil {
+		log.Errorf("Build error: %v", err)
+		return outputBuffer, err
+	}
+	return outputBuffer, err
+}
+
+func (i *IBazel) command(ctx context.Context, command string, targets ...string) (*bytes.Buffer, error) {
+	b := i.newBazel()
+
+	outputBuffer, err := b.Command(ctx, command, targets...)
+	if err != nil {
+		log.Errorf("Error running bazel %s: %v", command, err)
+		return outputBuffer, err
+	}
+	return outputBuffer, nil
+}
+
+func contains(l []string, e string) bool {
+	for _, i := range l {
+		if i == e {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *IBazel) setupRun(ctx context.Context, target string) (command.Command, error) {
+	rule, err := i.queryRule(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	i.targetDecider(target, rule)
+
+	config, err := i.tagRegistry.ParseRule(rule)
+	if err != nil {
+		log.Errorf("Invalid tags on %s: %v", target, err)
+	}
+
+	commandNotify := config.Flag("notify_changes")
+	notifyProtocol := os.Getenv("IBAZEL_NOTIFY_PROTOCOL")
+	if v, ok := config.String("notify_protocol"); ok {
+		notifyProtocol = v
+	}
+	notifyDelivery := os.Getenv("IBAZEL_NOTIFY_DELIVERY")
+	if v, ok := config.String("notify_delivery"); ok {
+		notifyDelivery = v
+	}
+
+	opts := command.Options{
+		PTY:            i.runInPTY || config.Flag("pty"),
+		Stdout:         i.stdout,
+		Stderr:         i.stderr,
+		OutputListener: i.outputLine,
+	}
+	if config.Flag("control") {
+		opts.Control = i.controlMessages
+	}
+	opts.NotifyProtocol, err = command.ParseNotifyProtocol(notifyProtocol)
+	if err != nil {
+		log.Errorf("Error: %v", err)
+	}
+	opts.NotifyDelivery, err = command.ParseNotifyDelivery(notifyDelivery)
+	if err != nil {
+		log.Errorf("Error: %v", err)
+	}
+	// The values of the tags below were already validated.
+	if v, ok := config.String("restart_signal"); ok {
+		opts.StopSignal, _ = process_group.ParseSignal(v)
+	}
+	opts.GracePeriod, _ = config.Duration("grace_period")
+	if v, ok := config.String("readiness_probe"); ok {
+		opts.ReadinessProbe, _ = command.ParseReadinessProbe(v)
+		opts.OnReady = func() {
+			i.controlMessages <- command.ControlMessage{Verb: command.ControlReady}
+		}
+	}
+	if d, ok := config.Duration("debounce"); ok {
+		i.debounceDuration = d
+	}
+	envFiles := i.resolveEnvFiles(append(i.runEnvFiles, config.List("env_file")...))
+	opts.EnvFiles = envFiles
+	opts.Env = i.runEnv
+	opts.IBazelEnv = i.ibazelEnv
+	if paths := append(config.List("watch"), envFiles...); len(paths) > 0 {
+		i.addWatchPaths(paths...)
+		i.watchWatchPaths()
+	}
+
+	listenAddrs := config.List("listen")
+	if len(listenAddrs) > 0 {
+		i.sockets, err = command.OpenSockets(listenAddrs)
+		if err != nil {
+			log.Errorf("Error opening sockets for %s: %v", target, err)
+		} else {
+			log.Logf("Passing sockets to the target: %s", strings.Join(i.sockets.Addrs(), ", "))
+			opts.Sockets = i.sockets
+		}
+	}
+
+	if i.runOutputLog {
+		i.openOutputLog(target)
+		opts.Log = i.outputLog
+	}
+
+	if commandNotify {
+		log.Logf("Launching with notifications")
+		return commandNotifyCommand(i.startupArgs, i.bazelArgs, target, i.args, opts), nil
+	} else {
+		return commandDefaultCommand(i.startupArgs, i.bazelArgs, target, i.args, opts), nil
+	}
+}
+
+func (i *IBazel) openOutputLog(target string) {
+	if i.outputBase == "" {
+		log.Errorf("Not logging the output of %s because Bazel's output base is unknown", target)
+		return
+	}
+	path := command.OutputLogPath(filepath.Join(i.outputBase, "ibazel", "logs"), target)
+	l, err := command.OpenOutputLog(path, i.runOutputLogMaxSize, i.quietRunOutputLines)
+	if err != nil {
+		log.Errorf("Error opening log file for %s: %v", target, err)
+		return
+	}
+	log.Logf("Logging the output of %s to %s", target, path)
+	i.outputLog = l
+	i.profiler.SetRunLog(path)
+}
+
+func (i *IBazel) run(ctx context.Context, targets ...string) (*bytes.Buffer, error) {
+	if i.cmd == nil {
+		// If the command is empty, we are in our first pass through the state
+		// machine and we need to make a command object.
+		cmd, err := i.setupRun(ctx, targets[0])
+		if err != nil {
+			log.Errorf("Run setup failed %v", err)
+			return nil, err
+		}
+		i.cmd = cmd
+		outputBuffer, err := i.cmd.Start(ctx)
+		if err != nil {
+			log.Errorf("Run start failed %v", err)
+		}
+		return outputBuffer, err
+	}
+
+	log.Logf("Notifying of changes")
+	outputBuffer := i.cmd.NotifyOfChanges(ctx, i.changes)
+	return outputBuffer, nil
+}
+
+func (i *IBazel) queryRule(ctx context.Context, rule string) (*blaze_query.Rule, error) {
+	b := i.newBazel()
+
+	res, err := b.Query(ctx, rule)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Error running Bazel %v", err)
+	}
+
+	for _, target := range res.Target {
+		switch *target.Type {
+		case blaze_query.Target_RULE:
+			return target.Rule, nil
+		}
+	}
+
+	return nil, errors.New("No information available")
+}
+
+func (i *IBazel) getInfo(ctx context.Context) (*map[string]string, error) {
+	b := i.newBazel()
+
+	res, err := b.Info(ctx)
+	if err != nil {
+		log.Errorf("Error getting Bazel info %v", err)
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// querySourceFiles returns the source files returned by query. With cquery
+// only the files of the active configuration are returned.
+func (i *IBazel) querySourceFiles(ctx context.Context, query string) ([]string, error) {
+	if i.cquery {
+		toWatch, err := i.cqueryForSourceFiles(ctx, query)
+		if err == nil || ctx.Err() != nil {
+			return toWatch, err
+		}
+		log.Errorf("Bazel cquery failed, falling back to query: %v", err)
+	}
+	return i.queryForSourceFiles(ctx, query)
+}
+
+func (i *IBazel) queryForSourceFiles(ctx context.Context, query string) ([]string, error) {
+	b := i.newBazel()
+
+	res, err := b.Query(ctx, append([]string{query}, i.queries.args...)...)
+	if err != nil {
+		log.Errorf("Bazel query failed: %v", err)
+		return []string{}, err
+	}
+
+	return i.sourceFilePaths(res.Target)
+}
+
+func (i *IBazel) cqueryForSourceFiles(ctx context.Context, query string) ([]string, error) {
+	b := i.newBazel()
+
+	res, err := b.CQuery(ctx, append([]string{query}, i.queries.args...)...)
+	if err != nil {
+		return []string{}, err
+	}
+
+	targets := make([]*blaze_query.Target, 0, len(res.Results))
+	for _, result := range res.Results {
+		if result.Target != nil {
+			targets = append(targets, result.Target)
+		}
+	}
+	return i.sourceFilePaths(targets)
+}
+
+// sourceFilePaths returns where the source files among the targets are in the
+// workspace, leaving out those of external repositories.
+func (i *IBazel) sourceFilePaths(targets []*blaze_query.Target) ([]string, error) {
+	workspacePath, err := i.workspaceFinder.FindWorkspace()
+	if err != nil {
+		log.Errorf("Error finding workspace: %v", err)
+		return []string{}, err
+	}
+
+	toWatch := make([]string, 0, len(targets))
+	for _, target := range targets {
+		switch *target.Type {
+		case blaze_query.Target_SOURCE_FILE:
+			label := *target.SourceFile.Name
+			if strings.HasPrefix(label, "@") {
+				continue
+			}
+			if strings.HasPrefix(label, "//external") {
+				continue
+			}
+
+			label = strings.Replace(strings.TrimPrefix(label, "//"), ":", string(filepath.Separator), 1)
+			toWatch = append(toWatch, filepath.Join(workspacePath, label))
+			break
+		default:
+			log.Errorf("%v\n", target)
+		}
+	}
+
+	return toWatch, nil
+}
+
+// watchFiles watches the files returned by a query, and the extra files that
+// aren't part of the build. Only the directories that weren't watched before,
+// or were deleted since, are added to the watcher, and only those that are no
+// longer needed are removed from it.
+func (i *IBazel) watchFiles(query string, toWatch []string, watcher fSNotifyWatcher, extra ...string) {
+	watched := i.filesWatched[watcher]
+	removed := i.removedDirs[watcher]
+	next := newWatchSet()
+	failed := map[string]struct{}{}
+	found := false
+	polled := polledDirectories(watcher)
+
+	add := func(file string) bool {
+		if !found {
+			if _, err := os.Stat(file); !os.IsNotExist(err) {
+				found = true
+			}
+		}
+
+		parentDirectory, _ := filepath.Split(file)
+		_, gone := removed[parentDirectory]
+		if !next.hasDir(parentDirectory) && (!watched.hasDir(parentDirectory) || gone) {
+			if _, ok := failed[parentDirectory]; ok {
+				return false
+			}
+			if err := watcher.Add(parentDirectory); err != nil {
+				failed[parentDirectory] = struct{}{}
+				// Special case for the "defaults package", see https://github.com/bazelbuild/bazel/issues/5533
+				if !strings.HasSuffix(filepath.ToSlash(file), "/tools/defaults/BUILD") {
+					log.Errorf("Error watching file %q error: %v", file, err)
+				}
+				return false
+			}
+		}
+		next.add(file)
+		return true
+	}
+
+	for _, file := range toWatch {
+		add(file)
+	}
+	extraWatched := map[string]struct{}{}
+	for _, file := range extra {
+		if next.contains(file) {
+			// Part of the build as well, or given twice.
+			continue
+		}
+		if add(file) {
+			extraWatched[file] = struct{}{}
+		}
+	}
+
+	// Remove the watches of the directories that no longer contain any files
+	// returned by the latest query.
+	watched.eachDir(func(parentDirectory string) {
+		if _, gone := removed[parentDirectory]; !gone && !next.hasDir(parentDirectory) {
+			if err := watcher.Remove(parentDirectory); err != nil {
+				log.Errorf("Error unwatching directory %q error: %v\n", parentDirectory, err)
+			}
+		}
+	})
+
+	if !found {
+		log.Errorf("Didn't find any files to watch from query %s", query)
+	}
+
+	if p := polledDirectories(watcher); p > polled {
+		needed := next.dirCount()
+		for w, s := range i.filesWatched {
+			if w != watcher {
+				needed += s.dirCount()
+			}
+		}
+		reportWatchLimit(needed, p)
+	}
+
+	i.filesWatched[watcher] = next
+	i.extraWatched[watcher] = extraWatched
+	delete(i.removedDirs, watcher)
+}
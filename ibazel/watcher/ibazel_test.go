@@ -0,0 +1,1245 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazel-watcher/bazel"
+	mock_bazel "github.com/bazelbuild/bazel-watcher/bazel/testing"
+	"github.com/bazelbuild/bazel-watcher/ibazel/command"
+	"github.com/bazelbuild/bazel-watcher/ibazel/coverage"
+	"github.com/bazelbuild/bazel-watcher/ibazel/live_reload"
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+	"github.com/bazelbuild/bazel-watcher/ibazel/proxy"
+	"github.com/bazelbuild/bazel-watcher/ibazel/workspace_finder"
+	"github.com/fsnotify/fsnotify"
+
+	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
+	"github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf/analysis"
+	"github.com/golang/protobuf/proto"
+)
+
+func init() {
+	log.FakeExit()
+}
+
+type fakeFSNotifyWatcher struct {
+	ErrorChan chan error
+	EventChan chan fsnotify.Event
+}
+
+var _ fSNotifyWatcher = &fakeFSNotifyWatcher{}
+
+func (w *fakeFSNotifyWatcher) Close() error                { return nil }
+func (w *fakeFSNotifyWatcher) Add(name string) error       { return nil }
+func (w *fakeFSNotifyWatcher) Remove(name string) error    { return nil }
+func (w *fakeFSNotifyWatcher) Events() chan fsnotify.Event { return w.EventChan }
+func (w *fakeFSNotifyWatcher) Errors() chan error          { return w.ErrorChan }
+func (w *fakeFSNotifyWatcher) Watcher() *fsnotify.Watcher  { return nil }
+
+var oldCommandDefaultCommand = command.DefaultCommand
+
+func assertEqual(t *testing.T, want, got interface{}, msg string) {
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("Wanted %s, got %s. %s", want, got, msg)
+		debug.PrintStack()
+	}
+}
+
+type mockCommand struct {
+	startupArgs []string
+	bazelArgs   []string
+	target      string
+	args        []string
+
+	notifiedOfChanges bool
+	started           bool
+	terminated        bool
+	restarted         bool
+}
+
+func (m *mockCommand) Start(ctx context.Context) (*bytes.Buffer, error) {
+	if m.started {
+		panic("Can't run command twice")
+	}
+	m.started = true
+	return nil, nil
+}
+func (m *mockCommand) NotifyOfChanges(ctx context.Context, changes []string) *bytes.Buffer {
+	m.notifiedOfChanges = true
+	return nil
+}
+func (m *mockCommand) Restart() error {
+	if !m.started {
+		panic("Restarted before starting")
+	}
+	m.restarted = true
+	return nil
+}
+func (m *mockCommand) Terminate() {
+	if !m.started {
+		panic("Terminated before starting")
+	}
+	m.terminated = true
+}
+func (m *mockCommand) assertTerminated(t *testing.T) {
+	if !m.terminated {
+		t.Errorf("Mock command wasn't terminated")
+		debug.PrintStack()
+	}
+}
+
+func (m *mockCommand) IsSubprocessRunning() bool {
+	return m.started
+}
+
+var mockBazel *mock_bazel.MockBazel
+
+func getMockCommand(i *IBazel) *mockCommand {
+	c, ok := i.cmd.(*mockCommand)
+	if !ok {
+		panic(fmt.Sprintf("Unable to cast i.cmd to a mockCommand. Was: %v", i.cmd))
+	}
+	return c
+}
+
+func init() {
+	// Replace the bazel object creation function with one that makes my mock.
+	bazelNew = func() bazel.Bazel {
+		mockBazel = &mock_bazel.MockBazel{}
+		mockBazel.AddQueryResponse("//path/to:target", &blaze_query.QueryResult{
+			Target: []*blaze_query.Target{
+				&blaze_query.Target{
+					Type: blaze_query.Target_RULE.Enum(),
+					Rule: &blaze_query.Rule{
+						Attribute: []*blaze_query.Attribute{
+							&blaze_query.Attribute{
+								Name: proto.String("name"),
+							},
+						},
+					},
+				},
+			},
+		})
+		return mockBazel
+	}
+	commandDefaultCommand = func(startupArgs []string, bazelArgs []string, target string, args []string, opts command.Options) command.Command {
+		// Don't do anything
+		return &mockCommand{
+			startupArgs: startupArgs,
+			bazelArgs:   bazelArgs,
+			target:      target,
+			args:        args,
+		}
+	}
+}
+
+// workspaceFinder finds the workspace in a fixed directory.
+type workspaceFinder struct {
+	path string
+}
+
+func (w *workspaceFinder) FindWorkspace() (string, error) {
+	return w.path, nil
+}
+
+func newIBazel(t testing.TB) *IBazel {
+	i, err := New(context.Background(), Options{})
+	if err != nil {
+		t.Errorf("Error creating IBazel: %s", err)
+	}
+
+	i.workspaceFinder = &workspace_finder.FakeWorkspaceFinder{}
+
+	return i
+}
+
+// testWorkspace creates a temporary directory with the given empty files, or
+// directories if they end with a slash. The caller removes it.
+func testWorkspace(t testing.TB, files ...string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ibazel_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if strings.HasSuffix(file, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestIBazelLifecycle(t *testing.T) {
+	i := newIBazel(t)
+	i.Cleanup()
+
+	// Now inspect private API. If things weren't closed properly this will block
+	// and the test will timeout.
+	<-i.sourceFileWatcher.Events()
+	<-i.buildFileWatcher.Events()
+}
+
+func TestIBazelLoop(t *testing.T) {
+	i := newIBazel(t)
+
+	// Replace the file watching channel with one that has a buffer.
+	i.buildFileWatcher = &fakeFSNotifyWatcher{
+		EventChan: make(chan fsnotify.Event, 1),
+	}
+	i.sourceEventHandler.SourceFileEvents = make(chan fsnotify.Event, 1)
+
+	defer i.Cleanup()
+
+	// The process for testing this is going to be to emit events to the channels
+	// that are associated with these objects and walk the state transition
+	// graph.
+
+	// First let's consume all the events from all the channels we care about
+	called := false
+	command := func(ctx context.Context, targets ...string) (*bytes.Buffer, error) {
+		called = true
+		return nil, nil
+	}
+
+	i.state = QUERY
+	step := func() {
+		i.iteration(context.Background(), "demo", command, []string{}, "")
+	}
+	assertRun := func() {
+		if called == false {
+			_, file, line, _ := runtime.Caller(1) // decorate + log + public function.
+			t.Errorf("%s:%v Should have run the provided comand", file, line)
+		}
+		called = false
+	}
+	assertState := func(state State) {
+		if i.state != state {
+			_, file, line, _ := runtime.Caller(1) // decorate + log + public function.
+			t.Errorf("%s:%v Expected state to be %s but was %s", file, line, state, i.state)
+		}
+	}
+
+	// Pretend a fairly normal event chain happens.
+	// Start, run the program, write a source file, run, write a build file, run.
+
+	assertState(QUERY)
+	step()
+	i.filesWatched[i.buildFileWatcher] = newWatchSet("/path/to/BUILD")
+	i.filesWatched[i.sourceFileWatcher] = newWatchSet("/path/to/foo")
+	assertState(RUN)
+	step() // Actually run the command
+	assertRun()
+	assertState(WAIT)
+	// Source file change.
+	i.sourceEventHandler.SourceFileEvents <- fsnotify.Event{Op: fsnotify.Write, Name: "/path/to/foo"}
+	step()
+	assertState(DEBOUNCE_RUN)
+	step()
+	// Don't send another event in to test the timer
+	assertState(RUN)
+	step() // Actually run the command
+	assertRun()
+	assertState(WAIT)
+	// Build file change.
+	i.buildFileWatcher.Events() <- fsnotify.Event{Op: fsnotify.Write, Name: "/path/to/BUILD"}
+	step()
+	assertState(DEBOUNCE_QUERY)
+	// Don't send another event in to test the timer. The command is run
+	// before the query.
+	step()
+	assertState(RUN)
+	step() // Actually run the command
+	assertRun()
+	assertState(WAIT)
+	if i.requery == nil {
+		t.Errorf("Expected a query to run in the background")
+	}
+	step() // Receive the result of the query
+	assertState(WAIT)
+	if i.requery != nil {
+		t.Errorf("Expected the query to be done")
+	}
+}
+
+func TestIBazelLoop_watchPaths(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	i.sourceEventHandler.SourceFileEvents = make(chan fsnotify.Event, 1)
+	i.filesWatched[i.sourceFileWatcher] = newWatchSet(
+		"/path/to/foo",
+		"/path/to/config/a.yaml",
+	)
+	i.extraWatched[i.sourceFileWatcher] = map[string]struct{}{
+		"/path/to/config/a.yaml": struct{}{},
+	}
+	i.watchPaths = []string{"/path/to/config/*.yaml", "/path/to/foo"}
+	cmd := &mockCommand{started: true}
+	i.cmd = cmd
+
+	called := false
+	command := func(ctx context.Context, targets ...string) (*bytes.Buffer, error) {
+		called = true
+		return nil, nil
+	}
+	step := func() {
+		i.iteration(context.Background(), "run", command, []string{"//path/to:target"}, "//path/to:target")
+	}
+
+	// Watched files and new files matching a glob restart the target.
+	for _, name := range []string{"/path/to/config/a.yaml", "/path/to/config/new.yaml"} {
+		i.state = WAIT
+		cmd.restarted = false
+		i.sourceEventHandler.SourceFileEvents <- fsnotify.Event{Op: fsnotify.Write, Name: name}
+		step()
+		assertEqual(t, DEBOUNCE_RESTART, i.state, "State after a change to "+name)
+		step()
+		assertEqual(t, RESTART, i.state, "State after debouncing")
+		step()
+		assertEqual(t, WAIT, i.state, "State after restarting")
+		assertEqual(t, true, cmd.restarted, "Restarted after a change to "+name)
+		assertEqual(t, false, called, "Rebuilt after a change to "+name)
+	}
+
+	// Files that are part of the build are rebuilt even if they match.
+	i.state = WAIT
+	i.sourceEventHandler.SourceFileEvents <- fsnotify.Event{Op: fsnotify.Write, Name: "/path/to/foo"}
+	step()
+	assertEqual(t, DEBOUNCE_RUN, i.state, "State after a change to a source file")
+
+	// A rebuild takes over a pending restart.
+	i.state = DEBOUNCE_RESTART
+	i.sourceEventHandler.SourceFileEvents <- fsnotify.Event{Op: fsnotify.Write, Name: "/path/to/foo"}
+	step()
+	assertEqual(t, DEBOUNCE_RUN, i.state, "State after a change to a source file while debouncing a restart")
+}
+
+func TestIBazelBuild(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	i.build(context.Background(), "//path/to:target")
+	expected := [][]string{
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
+		[]string{"Build", "//path/to:target"},
+	}
+
+	mockBazel.AssertActions(t, expected)
+}
+
+func TestIBazelTest(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	i.test(context.Background(), "//path/to:target")
+	expected := [][]string{
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
+		[]string{"Test", "//path/to:target"},
+	}
+
+	mockBazel.AssertActions(t, expected)
+}
+
+func TestIBazelRun_firstPass(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	i.run(context.Background(), "//path/to:target")
+}
+
+func TestIBazelRun_queryError(t *testing.T) {
+	oldBazelNew := bazelNew
+	defer func() { bazelNew = oldBazelNew }()
+	bazelNew = func() bazel.Bazel {
+		b := oldBazelNew()
+		mockBazel.QueryError(errors.New("query failed"))
+		return b
+	}
+
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	if _, err := i.run(context.Background(), "//path/to:target"); err == nil {
+		t.Errorf("Expected the failed query to be returned")
+	}
+	if i.cmd != nil {
+		t.Errorf("Expected no command to be started")
+	}
+}
+
+func TestIBazelRun_notifyPreexistiingJobWhenStarting(t *testing.T) {
+	commandDefaultCommand = func(startupArgs []string, bazelArgs []string, target string, args []string, opts command.Options) command.Command {
+		assertEqual(t, startupArgs, []string{}, "Startup args")
+		assertEqual(t, bazelArgs, []string{}, "Bazel args")
+		assertEqual(t, target, "", "Target")
+		assertEqual(t, args, []string{}, "Args")
+		return &mockCommand{}
+	}
+	defer func() { commandDefaultCommand = oldCommandDefaultCommand }()
+
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	i.args = []string{"--do_it"}
+
+	cmd := &mockCommand{
+		notifiedOfChanges: false,
+	}
+	i.cmd = cmd
+
+	path := "//path/to:target"
+	i.run(context.Background(), path)
+
+	if !cmd.notifiedOfChanges {
+		t.Errorf("The previously running command was not notified of changes")
+	}
+}
+
+func TestHandleSignals_SIGINTWithoutRunningCommand(t *testing.T) {
+	i := &IBazel{}
+	err := i.setup()
+	if err != nil {
+		t.Errorf("Error creating IBazel: %s", err)
+	}
+	i.sigs = make(chan os.Signal, 1)
+	defer i.Cleanup()
+
+	// But we want to simulate the subprocess not dying
+	attemptedExit := 0
+	osExit = func(i int) {
+		attemptedExit = i
+	}
+	assertEqual(t, i.cmd, nil, "There shouldn't be a subprocess running")
+
+	// SIGINT without a running command should attempt to exit
+	i.sigs <- syscall.SIGINT
+	i.handleSignals()
+
+	// Goroutine tests are kind of racey
+	assertEqual(t, attemptedExit, 3, "Should have exited ibazel")
+}
+
+func TestHandleSignals_SIGINT(t *testing.T) {
+	i := &IBazel{}
+	err := i.setup()
+	if err != nil {
+		t.Errorf("Error creating IBazel: %s", err)
+	}
+	i.sigs = make(chan os.Signal, 1)
+	defer i.Cleanup()
+
+	// But we want to simulate the subprocess not dying
+	attemptedExit := 0
+	osExit = func(i int) {
+		attemptedExit = i
+	}
+
+	var cmd *mockCommand
+	// Attempt to kill a task 2 times (but secretly resurrect the job from the
+	// dead to test the job not responding)
+	for j := 0; j < 2; j++ {
+		cmd = &mockCommand{}
+		cmd.Start(context.Background())
+		i.cmd = cmd
+
+		// This should kill the subprocess and simulate hitting ctrl-c
+		// First save the cmd so we can make assertions on it. It will be removed
+		// by the SIGINT
+		i.sigs <- syscall.SIGINT
+		i.handleSignals()
+
+		cmd.assertTerminated(t)
+		assertEqual(t, attemptedExit, 0, "It shouldn't have os.Exit'd")
+	}
+
+	// This should kill the job and go over the interrupt limit where exiting happens
+	i.sigs <- syscall.SIGINT
+	i.handleSignals()
+
+	assertEqual(t, attemptedExit, 3, "Should have exited ibazel")
+}
+
+func TestHandleSignals_SIGTERM(t *testing.T) {
+	i := &IBazel{}
+	err := i.setup()
+	if err != nil {
+		t.Errorf("Error creating IBazel: %s", err)
+	}
+	i.sigs = make(chan os.Signal, 1)
+	defer i.Cleanup()
+
+	// Now test sending SIGTERM
+	attemptedExit := false
+	osExit = func(i int) {
+		attemptedExit = true
+	}
+	attemptedExit = false
+
+	cmd := &mockCommand{}
+	cmd.Start(context.Background())
+	i.cmd = cmd
+
+	i.sigs <- syscall.SIGTERM
+	i.handleSignals()
+	cmd.assertTerminated(t)
+
+	assertEqual(t, attemptedExit, true, "Should have exited ibazel")
+}
+
+func TestNewTagRegistry(t *testing.T) {
+	r, err := newTagRegistry([]Lifecycle{live_reload.New(false), proxy.New(false, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := r.Parse([]string{
+		"manual",
+		"ibazel_live_reload",
+		"ibazel_proxy=8080->3000",
+		"ibazel_listen=:8080, localhost:9000",
+		"ibazel_restart_signal=SIGINT",
+		"ibazel_grace_period=2s",
+		"ibazel_readiness_probe=http://localhost:3000/healthz",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []string{":8080", "localhost:9000"}, config.List("listen"), "Listen tags")
+	gracePeriod, _ := config.Duration("grace_period")
+	assertEqual(t, 2*time.Second, gracePeriod, "Grace period")
+
+	for _, tag := range []string{
+		"ibazel_proxy=8080",
+		"ibazel_listen=8080",
+		"ibazel_restart_signal=SIGMOO",
+		"ibazel_readiness_probe=localhost:3000",
+		"ibazel_notify_protocol=3",
+		"ibazel_live_reloads",
+	} {
+		if _, err := r.Parse([]string{tag}); err == nil {
+			t.Errorf("Expected %q to be invalid", tag)
+		}
+	}
+
+	if _, err := newTagRegistry([]Lifecycle{live_reload.New(false), live_reload.New(false)}); err == nil {
+		t.Errorf("Expected registering the same tags twice to fail")
+	}
+}
+
+func TestIBazelLoop_controlMessages(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	i.sourceEventHandler.SourceFileEvents = make(chan fsnotify.Event, 1)
+	i.state = WAIT
+
+	// Reloads and events don't change the state.
+	i.controlMessages <- command.ControlMessage{Verb: command.ControlReload}
+	i.iteration(context.Background(), "run", nil, []string{"//path/to:target"}, "//path/to:target")
+	assertEqual(t, WAIT, i.state, "State after reload")
+
+	i.controlMessages <- command.ControlMessage{Verb: command.ControlEvent, Type: "HMR"}
+	i.iteration(context.Background(), "run", nil, []string{"//path/to:target"}, "//path/to:target")
+	assertEqual(t, WAIT, i.state, "State after event")
+
+	// Rebuilds skip straight to running the command.
+	i.controlMessages <- command.ControlMessage{Verb: command.ControlRebuild}
+	i.iteration(context.Background(), "run", nil, []string{"//path/to:target"}, "//path/to:target")
+	assertEqual(t, RUN, i.state, "State after rebuild")
+}
+
+func TestExpandOutputs(t *testing.T) {
+	outputs := []string{"bazel-bin/a.yaml", "bazel-bin/b.yaml"}
+	for _, c := range []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"kubectl", "apply"}, []string{"kubectl", "apply"}},
+		{[]string{"cat", "{outputs}"}, []string{"cat", "bazel-bin/a.yaml", "bazel-bin/b.yaml"}},
+		{[]string{"{outputs}", "-f", "{outputs}"}, []string{"bazel-bin/a.yaml", "bazel-bin/b.yaml", "-f", "bazel-bin/a.yaml", "bazel-bin/b.yaml"}},
+		{[]string{"echo", "x{outputs}"}, []string{"echo", "x{outputs}"}},
+	} {
+		assertEqual(t, c.expected, expandOutputs(c.args, outputs), fmt.Sprintf("Expanded %v", c.args))
+	}
+}
+
+func TestIBazelExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Needs a POSIX shell")
+	}
+
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	r := &recordingLifecycle{}
+	i.lifecycleListeners = []Lifecycle{r}
+	i.execArgs = []string{"sh", "-c", "echo $IBAZEL_ITERATION; exit 3"}
+	i.iterations = 2
+	output, err := i.exec(context.Background(), "//path/to:target")
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 3 {
+		t.Errorf("Expected the command to exit with status 3, got %v", err)
+	}
+	assertEqual(t, "2\n", output.String(), "Output of the command")
+	assertEqual(t, [][]string{{"exited", "3", "//path/to:target"}}, r.commands, "Exit status given to the listeners")
+	mockBazel.AssertActions(t, [][]string{
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
+		[]string{"Build", regexp.QuoteMeta(showAllResults), "//path/to:target"},
+	})
+
+	oldBazelNew := bazelNew
+	defer func() { bazelNew = oldBazelNew }()
+	bazelNew = func() bazel.Bazel {
+		b := oldBazelNew()
+		mockBazel.BuildError(errors.New("build failed"))
+		return b
+	}
+	i.execArgs = []string{"sh", "-c", "echo should not run"}
+	if output, err := i.exec(context.Background(), "//path/to:target"); err == nil || strings.Contains(output.String(), "should not run") {
+		t.Errorf("Expected a failed build to skip the command")
+	}
+}
+
+func TestIBazelSetupRun_control(t *testing.T) {
+	var opts command.Options
+	commandNotifyCommand = func(startupArgs []string, bazelArgs []string, target string, args []string, o command.Options) command.Command {
+		opts = o
+		return &mockCommand{}
+	}
+	defer func() { commandNotifyCommand = command.NotifyCommand }()
+
+	for _, c := range []struct {
+		tags    []string
+		control bool
+	}{
+		{[]string{"ibazel_notify_changes"}, false},
+		{[]string{"ibazel_notify_changes", "ibazel_control"}, true},
+	} {
+		i := newIBazel(t)
+		oldBazelNew := bazelNew
+		bazelNew = func() bazel.Bazel {
+			b := oldBazelNew()
+			mockBazel.AddQueryResponse("//path/to:target", &blaze_query.QueryResult{
+				Target: []*blaze_query.Target{{
+					Type: blaze_query.Target_RULE.Enum(),
+					Rule: &blaze_query.Rule{
+						Attribute: []*blaze_query.Attribute{{
+							Name:            proto.String("tags"),
+							Type:            blaze_query.Attribute_STRING_LIST.Enum(),
+							StringListValue: c.tags,
+						}},
+					},
+				}},
+			})
+			return b
+		}
+		i.setupRun(context.Background(), "//path/to:target")
+		bazelNew = oldBazelNew
+		i.Cleanup()
+
+		assertEqual(t, c.control, opts.Control != nil, fmt.Sprintf("Control channel with tags %v", c.tags))
+	}
+}
+
+func TestIBazelSetupRun_outputListener(t *testing.T) {
+	var opts command.Options
+	commandNotifyCommand = func(startupArgs []string, bazelArgs []string, target string, args []string, o command.Options) command.Command {
+		opts = o
+		return &mockCommand{}
+	}
+	defer func() { commandNotifyCommand = command.NotifyCommand }()
+
+	i := newIBazel(t)
+	defer i.Cleanup()
+	oldBazelNew := bazelNew
+	defer func() { bazelNew = oldBazelNew }()
+	bazelNew = func() bazel.Bazel {
+		b := oldBazelNew()
+		mockBazel.AddQueryResponse("//path/to:target", &blaze_query.QueryResult{
+			Target: []*blaze_query.Target{{
+				Type: blaze_query.Target_RULE.Enum(),
+				Rule: &blaze_query.Rule{
+					Attribute: []*blaze_query.Attribute{{
+						Name:            proto.String("tags"),
+						Type:            blaze_query.Attribute_STRING_LIST.Enum(),
+						StringListValue: []string{"ibazel_notify_changes"},
+					}},
+				},
+			}},
+		})
+		return b
+	}
+	r := &recordingLifecycle{}
+	i.lifecycleListeners = []Lifecycle{r}
+
+	i.beforeCommand([]string{"//path/to:target"}, "run")
+	i.setupRun(context.Background(), "//path/to:target")
+	if opts.OutputListener == nil {
+		t.Fatalf("Expected the builds of the notify command to be listened to")
+	}
+	opts.OutputListener(bazel.Line{Stream: bazel.Stderr, Text: "INFO: Build completed successfully"})
+	assertEqual(t, [][]string{
+		{"before", "run", "//path/to:target"},
+		{"line", "run", "stderr", "INFO: Build completed successfully"},
+	}, r.commands, "Lifecycle calls")
+}
+
+func TestIBazelCoverage(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	i.coverage(context.Background(), "//path/to:target")
+	expected := [][]string{
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
+		[]string{"Coverage", "--combined_report=lcov", "//path/to:target"},
+	}
+
+	mockBazel.AssertActions(t, expected)
+}
+
+func TestReportCoverage(t *testing.T) {
+	dir := testWorkspace(t)
+	defer os.RemoveAll(dir)
+
+	i := newIBazel(t)
+	defer i.Cleanup()
+	i.workspaceFinder = &workspaceFinder{dir}
+
+	reportPath := filepath.Join(dir, "_coverage_report.dat")
+	report := "SF:pkg/a.go\nDA:1,1\nDA:2,0\nend_of_record\nSF:pkg/b.go\nDA:1,1\nend_of_record\n"
+	if err := ioutil.WriteFile(reportPath, []byte(report), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := bytes.NewBufferString("INFO: LCOV coverage report is located at " + reportPath + "\n and execpath is bazel-out/_coverage/_coverage_report.dat\n")
+	assertEqual(t, reportPath, i.coverageReportPath(output), "Path of the coverage report")
+	i.outputPath = "/output"
+	assertEqual(t, filepath.Join("/output", "_coverage", "_coverage_report.dat"), i.coverageReportPath(&bytes.Buffer{}), "Default path of the coverage report")
+
+	i.coverageLCOVPath = "lcov.info"
+	i.coverageHTMLPath = filepath.Join(dir, "coverage.html")
+	i.reportCoverage(output)
+	lcov, err := ioutil.ReadFile(filepath.Join(dir, "lcov.info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "SF:pkg/a.go\nDA:1,1\nDA:2,0\nLH:1\nLF:2\nend_of_record\nSF:pkg/b.go\nDA:1,1\nLH:1\nLF:1\nend_of_record\n", string(lcov), "LCOV summary")
+	if _, err := os.Stat(filepath.Join(dir, "coverage.html")); err != nil {
+		t.Errorf("Expected an HTML summary: %v", err)
+	}
+}
+
+func TestChangedCoveragePaths(t *testing.T) {
+	r, err := coverage.Parse(strings.NewReader("SF:pkg/a.go\nDA:1,1\nend_of_record\nSF:pkg/b.go\nDA:1,1\nend_of_record\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.FromSlash("/workspace")
+	changes := []string{
+		filepath.Join(root, "pkg", "b.go"),
+		filepath.Join(root, "pkg", "BUILD"),
+		filepath.Join(root, "pkg", "b.go"),
+	}
+	assertEqual(t, []string{"pkg/b.go"}, changedCoveragePaths(r, root, changes), "Changed files in the report")
+}
+
+func TestIBazelCommand(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	i.command(context.Background(), "mobile-install", "//path/to:target")
+	expected := [][]string{
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
+		[]string{"Command", "mobile-install", "//path/to:target"},
+	}
+
+	mockBazel.AssertActions(t, expected)
+}
+
+func TestVerb(t *testing.T) {
+	for command, expected := range map[string]string{
+		"build":          "building",
+		"test":           "testing",
+		"fetch":          "fetching",
+		"run":            "running",
+		"exec":           "executing",
+		"coverage":       "running coverage for",
+		"mobile-install": "running mobile-install for",
+	} {
+		assertEqual(t, expected, verb(command), fmt.Sprintf("Verb of %q", command))
+	}
+}
+
+func TestValidateStages(t *testing.T) {
+	valid := []Stage{
+		{"build", []string{"//..."}},
+		{"test", []string{"//svc/...", "//lib/..."}},
+		{"run", []string{"//svc:server"}},
+	}
+	if err := validateStages(valid, nil); err != nil {
+		t.Errorf("Expected %v to be valid: %v", valid, err)
+	}
+
+	for _, stages := range [][]Stage{
+		{},
+		{{"", []string{"//a"}}},
+		{{"build", nil}},
+		{{"run", []string{"//a", "//b"}}},
+		{{"run", []string{"//a"}}, {"build", []string{"//b"}}},
+		{{"exec", []string{"//a"}}, {"build", []string{"//b"}}},
+		{{"exec", []string{"//a"}}},
+	} {
+		if err := validateStages(stages, nil); err == nil {
+			t.Errorf("Expected %v to be an invalid pipeline", stages)
+		}
+	}
+}
+
+// recordingLifecycle records the commands it is notified of.
+type recordingLifecycle struct {
+	commands [][]string
+}
+
+func (r *recordingLifecycle) Initialize(info *map[string]string)                                {}
+func (r *recordingLifecycle) TargetDecider(rule *blaze_query.Rule)                              {}
+func (r *recordingLifecycle) ChangeDetected(targets []string, changeType string, change string) {}
+func (r *recordingLifecycle) Cleanup()                                                          {}
+
+func (r *recordingLifecycle) BeforeCommand(targets []string, command string) {
+	r.commands = append(r.commands, append([]string{"before", command}, targets...))
+}
+
+func (r *recordingLifecycle) AfterCommand(targets []string, command string, success bool, output *bytes.Buffer) {
+	r.commands = append(r.commands, append([]string{"after", command, fmt.Sprint(success)}, targets...))
+}
+
+func (r *recordingLifecycle) OutputLine(targets []string, command string, line bazel.Line) {
+	r.commands = append(r.commands, []string{"line", command, line.Stream.String(), line.Text})
+}
+
+func (r *recordingLifecycle) ExecExited(targets []string, status int) {
+	r.commands = append(r.commands, append([]string{"exited", fmt.Sprint(status)}, targets...))
+}
+
+func TestIBazelPipeline(t *testing.T) {
+	commandDefaultCommand = func(startupArgs []string, bazelArgs []string, target string, args []string, opts command.Options) command.Command {
+		return &mockCommand{}
+	}
+	defer func() { commandDefaultCommand = oldCommandDefaultCommand }()
+
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	r := &recordingLifecycle{}
+	i.lifecycleListeners = []Lifecycle{r}
+	i.stages = []Stage{
+		{"build", []string{"//path/to:target"}},
+		{"fetch", []string{"//path/to:other"}},
+		{"run", []string{"//path/to:target"}},
+	}
+	i.state = RUN
+	i.iteration(context.Background(), "pipeline", nil, []string{"//path/to:target", "//path/to:other"}, "//path/to:target //path/to:other")
+	assertEqual(t, [][]string{
+		{"before", "build", "//path/to:target"},
+		{"after", "build", "true", "//path/to:target"},
+		{"before", "fetch", "//path/to:other"},
+		{"after", "fetch", "true", "//path/to:other"},
+		{"before", "run", "//path/to:target"},
+		{"after", "run", "true", "//path/to:target"},
+	}, r.commands, "Commands of the pipeline")
+	assertEqual(t, WAIT, i.state, "State after the pipeline")
+	if !getMockCommand(i).started {
+		t.Errorf("Expected the run stage to start the target")
+	}
+
+	// A failing stage skips the rest.
+	oldBazelNew := bazelNew
+	defer func() { bazelNew = oldBazelNew }()
+	bazelNew = func() bazel.Bazel {
+		b := oldBazelNew()
+		mockBazel.BuildError(errors.New("build failed"))
+		return b
+	}
+	r.commands = nil
+	i.state = RUN
+	i.iteration(context.Background(), "pipeline", nil, []string{"//path/to:target", "//path/to:other"}, "//path/to:target //path/to:other")
+	assertEqual(t, [][]string{
+		{"before", "build", "//path/to:target"},
+		{"after", "build", "false", "//path/to:target"},
+	}, r.commands, "Commands of the failed pipeline")
+}
+
+func TestNew_options(t *testing.T) {
+	if _, err := New(context.Background(), Options{RunEnv: []string{"NOT_AN_ASSIGNMENT"}}); err == nil {
+		t.Errorf("Expected an invalid run environment to be rejected")
+	}
+
+	r := &recordingLifecycle{}
+	i, err := New(context.Background(), Options{
+		DebounceDuration:    time.Second,
+		QuietRunOutputLines: 10,
+		Lifecycles:          []Lifecycle{r},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Cleanup()
+
+	assertEqual(t, time.Second, i.debounceDuration, "Debounce duration")
+	assertEqual(t, true, i.runOutputLog, "Quiet output implies logging")
+	assertEqual(t, Lifecycle(r), i.lifecycleListeners[len(i.lifecycleListeners)-1], "Custom lifecycle listener")
+}
+
+func TestIBazelLoop_context(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	i.sourceEventHandler.SourceFileEvents = make(chan fsnotify.Event)
+	cmd := &mockCommand{}
+	cmd.Start(context.Background())
+	i.cmd = cmd
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- i.loop(ctx, "build", i.build, []string{"//path/to:target"})
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		assertEqual(t, context.Canceled, err, "Error of a cancelled loop")
+	case <-time.After(5 * time.Second):
+		t.Fatal("The loop didn't stop when its context was cancelled")
+	}
+	assertEqual(t, QUIT, i.state, "State after the loop stopped")
+	cmd.assertTerminated(t)
+}
+
+func TestSubscribe(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := i.Subscribe(ctx)
+
+	i.changeDetected([]string{"//path/to:target"}, "source", "/path/to/foo")
+	i.beforeCommand([]string{"//path/to:target"}, "build")
+	i.afterCommand([]string{"//path/to:target"}, "build", true, nil)
+
+	assertEqual(t, Event{Type: CHANGE_DETECTED, Targets: []string{"//path/to:target"}, ChangeType: "source", Change: "/path/to/foo"}, <-events, "Change event")
+	assertEqual(t, Event{Type: BEFORE_COMMAND, Targets: []string{"//path/to:target"}, Command: "build"}, <-events, "Before command event")
+	assertEqual(t, Event{Type: AFTER_COMMAND, Targets: []string{"//path/to:target"}, Command: "build", Success: true}, <-events, "After command event")
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Errorf("Expected the events to be closed once the context is done")
+	}
+	// Publishing without subscribers doesn't block.
+	i.beforeCommand([]string{"//path/to:target"}, "build")
+}
+
+func TestIBazelOutputLine(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	lines := []bazel.Line{
+		{Stream: bazel.Stderr, Text: "INFO: Analyzed target"},
+		{Stream: bazel.Stdout, Text: "Target //path/to:target up-to-date"},
+	}
+	oldBazelNew := bazelNew
+	defer func() { bazelNew = oldBazelNew }()
+	bazelNew = func() bazel.Bazel {
+		b := oldBazelNew()
+		mockBazel.Output(lines...)
+		return b
+	}
+
+	r := &recordingLifecycle{}
+	i.lifecycleListeners = []Lifecycle{r}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := i.Subscribe(ctx)
+
+	targets := []string{"//path/to:target"}
+	i.runCommand(ctx, "build", i.build, targets)
+
+	assertEqual(t, [][]string{
+		{"before", "build", "//path/to:target"},
+		{"line", "build", "stderr", "INFO: Analyzed target"},
+		{"line", "build", "stdout", "Target //path/to:target up-to-date"},
+		{"after", "build", "true", "//path/to:target"},
+	}, r.commands, "Lifecycle calls")
+
+	assertEqual(t, BEFORE_COMMAND, (<-events).Type, "First event")
+	for _, line := range lines {
+		assertEqual(t, Event{Type: OUTPUT_LINE, Targets: targets, Command: "build", Line: line}, <-events, "Output line event")
+	}
+	e := <-events
+	assertEqual(t, AFTER_COMMAND, e.Type, "Last event")
+	assertEqual(t, "INFO: Analyzed target\nTarget //path/to:target up-to-date\n", e.Output.String(), "Output of the command")
+}
+
+func TestTargetsExpression(t *testing.T) {
+	for _, c := range []struct {
+		command    string
+		expression string
+		want       string
+	}{
+		{"query", "deps(//foo) except //bar/...", "deps(//foo) except //bar/..."},
+		{"cquery", "config(deps(//foo), target)", "deps(//foo)"},
+		{"aquery", "mnemonic('GoCompile', outputs('.*\\.a', deps(//foo) except //bar/...))", "deps(//foo) except //bar/..."},
+		{"aquery", "deps(//foo) except mnemonic('GoLink', //bar)", "deps(//foo) except mnemonic('GoLink', //bar)"},
+		{"query", "config(//foo, target)", "config(//foo, target)"},
+	} {
+		assertEqual(t, c.want, targetsExpression(c.command, c.expression), fmt.Sprintf("Targets of %s %q", c.command, c.expression))
+	}
+}
+
+func TestIBazelQueryCommand(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	expression := "deps(//foo) except //bar/..."
+	var lock sync.Mutex // guards mocks
+	var mocks []*mock_bazel.MockBazel
+	oldBazelNew := bazelNew
+	defer func() { bazelNew = oldBazelNew }()
+	bazelNew = func() bazel.Bazel {
+		b := oldBazelNew()
+		mockBazel.AddQueryResponse(expression, &blaze_query.QueryResult{
+			Target: []*blaze_query.Target{
+				{Type: blaze_query.Target_RULE.Enum(), Rule: &blaze_query.Rule{Name: proto.String("//foo:foo")}},
+				{Type: blaze_query.Target_RULE.Enum(), Rule: &blaze_query.Rule{Name: proto.String("//foo:lib")}},
+				sourceFileTarget("//foo:foo.go"),
+			},
+		})
+		lock.Lock()
+		mocks = append(mocks, mockBazel)
+		lock.Unlock()
+		return b
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := i.Subscribe(ctx)
+	done := make(chan error)
+	go func() {
+		done <- i.QueryCommand(ctx, "query", expression)
+	}()
+	for e := range events {
+		if e.Type == AFTER_COMMAND {
+			assertEqual(t, []string{"//foo:foo", "//foo:lib", "//foo:foo.go"}, e.Targets, "Targets of the expression")
+			break
+		}
+	}
+	cancel()
+	<-done
+
+	lock.Lock()
+	defer lock.Unlock()
+	assertQueries(t, mocks[:3], [][]string{
+		{expression},
+		{i.queries.buildQuery("//foo:foo //foo:lib //foo:foo.go")},
+		{i.queries.sourceQuery("//foo:foo //foo:lib //foo:foo.go")},
+	})
+	mocks[3].AssertActions(t, [][]string{
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
+		[]string{"Command", "query", regexp.QuoteMeta(expression)},
+	})
+}
+
+func sourceFileTarget(label string) *blaze_query.Target {
+	return &blaze_query.Target{
+		Type:       blaze_query.Target_SOURCE_FILE.Enum(),
+		SourceFile: &blaze_query.SourceFile{Name: proto.String(label)},
+	}
+}
+
+func TestIBazelQuerySourceFiles_cquery(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+	i.workspaceFinder = &workspaceFinder{"/workspace"}
+	i.cquery = true
+
+	query := i.queries.sourceQuery("//path/to:target")
+	oldBazelNew := bazelNew
+	defer func() { bazelNew = oldBazelNew }()
+	var cqueryError error
+	bazelNew = func() bazel.Bazel {
+		b := oldBazelNew()
+		mockBazel.AddCQueryResponse(query, &analysis.CqueryResult{
+			Results: []*analysis.ConfiguredTarget{
+				{Target: sourceFileTarget("//path/to:linux.go")},
+				{Target: sourceFileTarget("@external//:file.go")},
+			},
+		})
+		mockBazel.AddQueryResponse(query, &blaze_query.QueryResult{
+			Target: []*blaze_query.Target{
+				sourceFileTarget("//path/to:linux.go"),
+				sourceFileTarget("//path/to:windows.go"),
+			},
+		})
+		mockBazel.CQueryError(cqueryError)
+		return b
+	}
+
+	toWatch, err := i.querySourceFiles(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	assertEqual(t, []string{filepath.Join("/workspace", "path", "to", "linux.go")}, toWatch, "Files of the active configuration")
+	mockBazel.AssertActions(t, [][]string{
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
+		[]string{"CQuery", regexp.QuoteMeta(query)},
+	})
+
+	// Plain query is used when cquery fails.
+	cqueryError = errors.New("cquery failed")
+	toWatch, err = i.querySourceFiles(context.Background(), query)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	assertEqual(t, []string{
+		filepath.Join("/workspace", "path", "to", "linux.go"),
+		filepath.Join("/workspace", "path", "to", "windows.go"),
+	}, toWatch, "Files of every configuration")
+	mockBazel.AssertActions(t, [][]string{
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
+		[]string{"Query", regexp.QuoteMeta(query)},
+	})
+}
+
+func TestNewWatchQueries(t *testing.T) {
+	q, err := newWatchQueries("", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "kind('source file', deps(set(//a //b)))", q.sourceQuery("//a //b"), "Default source query")
+	assertEqual(t, "buildfiles(deps(set(//a //b)))", q.buildQuery("//a //b"), "Default build query")
+
+	q, err = newWatchQueries("kind('source file', deps(set({targets})) except //third_party/...)", "", []string{"--keep_going"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, "kind('source file', deps(set(//a)) except //third_party/...)", q.sourceQuery("//a"), "Custom source query")
+
+	for _, c := range []struct {
+		source string
+		build  string
+		args   []string
+	}{
+		{source: "deps(//...)"},
+		{build: "buildfiles(deps(set({target})))"},
+		{source: "kind('source file', deps(set({targets}))"},
+		{source: "kind('source file', deps(set({targets}))))"},
+		{source: "kind('source file, deps(set({targets})))"},
+		{args: []string{"keep_going"}},
+	} {
+		if _, err := newWatchQueries(c.source, c.build, c.args); err == nil {
+			t.Errorf("Expected newWatchQueries(%q, %q, %q) to fail", c.source, c.build, c.args)
+		}
+	}
+
+	// Parentheses inside quotes don't need to be balanced.
+	if _, err := newWatchQueries("kind('source file (', deps(set({targets})))", "", nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if _, err := New(context.Background(), Options{SourceQuery: "deps(//...)"}); err == nil {
+		t.Errorf("Expected an invalid query to be rejected")
+	}
+}
+
+func TestIBazelQuerySourceFiles_queryArgs(t *testing.T) {
+	i, err := New(context.Background(), Options{QueryArgs: []string{"--keep_going"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Cleanup()
+	i.workspaceFinder = &workspaceFinder{"/workspace"}
+
+	query := i.queries.sourceQuery("//path/to:target")
+	oldBazelNew := bazelNew
+	defer func() { bazelNew = oldBazelNew }()
+	bazelNew = func() bazel.Bazel {
+		b := oldBazelNew()
+		mockBazel.AddQueryResponse(query, &blaze_query.QueryResult{
+			Target: []*blaze_query.Target{sourceFileTarget("//path/to:file.go")},
+		})
+		return b
+	}
+
+	if _, err := i.querySourceFiles(context.Background(), query); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	mockBazel.AssertActions(t, [][]string{
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
+		[]string{"Query", regexp.QuoteMeta(query), "--keep_going"},
+	})
+}
+
+// assertQueries checks that each bazel ran one of the queries, in order.
+func assertQueries(t *testing.T, mocks []*mock_bazel.MockBazel, queries [][]string) {
+	t.Helper()
+	if len(mocks) != len(queries) {
+		t.Fatalf("Expected %d queries, got %d", len(queries), len(mocks))
+	}
+	for n, query := range queries {
+		action := []string{"Query"}
+		for _, arg := range query {
+			action = append(action, regexp.QuoteMeta(arg))
+		}
+		mocks[n].AssertActions(t, [][]string{
+			[]string{"SetStdout"},
+			[]string{"SetStderr"},
+			action,
+		})
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultFullQueryInterval is how often the files to watch are queried in
+// full when incremental queries are enabled.
+const DefaultFullQueryInterval = 10 * time.Minute
+
+// incrementalQuery restricts a watch query to what the changed packages can
+// affect. Its files are merged into the watch set instead of replacing it.
+type incrementalQuery struct {
+	// Directories of the changed packages.
+	packageDirs []string
+	// The targets of the changed packages, as given to the query templates.
+	joinedPackages string
+}
+
+// incrementalChanges reports whether only BUILD and .bzl files changed. Other
+// files that affect the build graph, such as WORKSPACE or MODULE.bazel, can
+// change any package and need a full query.
+func incrementalChanges(changes []string) bool {
+	for _, change := range changes {
+		switch base := filepath.Base(change); {
+		case base == "BUILD", base == "BUILD.bazel", filepath.Ext(base) == ".bzl":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// affectedPackages finds the packages whose BUILD files changed, or which load
+// a changed .bzl file.
+func (i *IBazel) affectedPackages(ctx context.Context, changes []string, targets []string) ([]string, error) {
+	workspacePath, err := i.workspaceFinder.FindWorkspace()
+	if err != nil {
+		return nil, err
+	}
+
+	packages := map[string]struct{}{}
+	var bzlFiles []string
+	for _, change := range changes {
+		rel, err := filepath.Rel(workspacePath, change)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%q is outside of the workspace", change)
+		}
+		rel = filepath.ToSlash(rel)
+		switch path.Base(rel) {
+		case "BUILD", "BUILD.bazel":
+			pkg := path.Dir(rel)
+			if pkg == "." {
+				pkg = ""
+			}
+			packages[pkg] = struct{}{}
+		default:
+			bzlFiles = append(bzlFiles, rel)
+		}
+	}
+
+	if len(bzlFiles) > 0 {
+		// rbuildfiles takes paths, and only works with a universe to look in.
+		b := i.newBazel()
+		args := append([]string{
+			fmt.Sprintf("rbuildfiles(%s)", strings.Join(bzlFiles, ", ")),
+			"--universe_scope=" + strings.Join(targets, ","),
+			"--order_output=no",
+		}, i.queries.args...)
+		res, err := b.Query(ctx, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range res.Target {
+			if target.SourceFile == nil {
+				continue
+			}
+			label := target.SourceFile.GetName()
+			if !strings.HasPrefix(label, "//") {
+				continue
+			}
+			packages[strings.SplitN(strings.TrimPrefix(label, "//"), ":", 2)[0]] = struct{}{}
+		}
+	}
+
+	result := make([]string, 0, len(packages))
+	for p := range packages {
+		result = append(result, p)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// queryIncrementally only queries for the files to watch that the changed
+// BUILD and .bzl files can affect.
+func (i *IBazel) queryIncrementally(ctx context.Context, r *requeryResult, changes []string, targets []string) error {
+	packages, err := i.affectedPackages(ctx, changes, targets)
+	if err != nil {
+		return err
+	}
+	r.incremental, err = i.newIncrementalQuery(packages)
+	if err != nil {
+		return err
+	}
+	if len(packages) == 0 {
+		// The changed files aren't loaded by any of the watched packages.
+		return nil
+	}
+
+	roots, err := i.incrementalRoots(ctx, r.incremental, targets)
+	if err != nil {
+		return err
+	}
+	if len(roots) == 0 {
+		// None of the targets depend on the changed packages anymore.
+		return nil
+	}
+
+	joinedRoots := strings.Join(roots, " ")
+	r.buildQuery = i.queries.buildQuery(joinedRoots)
+	r.sourceQuery = i.queries.sourceQuery(joinedRoots)
+	if r.buildFiles, err = i.queryForSourceFiles(ctx, r.buildQuery); err != nil {
+		return err
+	}
+	if r.sourceFiles, err = i.querySourceFiles(ctx, r.sourceQuery); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newIncrementalQuery restricts the queries of the files to watch to the
+// given packages.
+func (i *IBazel) newIncrementalQuery(packages []string) (*incrementalQuery, error) {
+	workspacePath, err := i.workspaceFinder.FindWorkspace()
+	if err != nil {
+		return nil, err
+	}
+	q := &incrementalQuery{}
+	labels := make([]string, 0, len(packages))
+	for _, p := range packages {
+		q.packageDirs = append(q.packageDirs, filepath.Join(workspacePath, filepath.FromSlash(p)))
+		labels = append(labels, fmt.Sprintf("//%s:*", p))
+	}
+	q.joinedPackages = strings.Join(labels, " ")
+	return q, nil
+}
+
+// incrementalRoots finds the targets of the changed packages that the watched
+// targets depend on. The watch queries only need to be run on those, instead
+// of on the whole transitive closure of the watched targets.
+func (i *IBazel) incrementalRoots(ctx context.Context, q *incrementalQuery, targets []string) ([]string, error) {
+	b := i.newBazel()
+	args := append([]string{
+		fmt.Sprintf("rdeps(set(%s), set(%s), 0)", strings.Join(targets, " "), q.joinedPackages),
+		"--universe_scope=" + strings.Join(targets, ","),
+		"--order_output=no",
+	}, i.queries.args...)
+	res, err := b.Query(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	roots := make([]string, 0, len(res.Target))
+	for _, target := range res.Target {
+		switch {
+		case target.Rule != nil:
+			roots = append(roots, target.Rule.GetName())
+		case target.SourceFile != nil:
+			roots = append(roots, target.SourceFile.GetName())
+		}
+	}
+	sort.Strings(roots)
+	return roots, nil
+}
+
+// mergeBuildFiles adds the BUILD and .bzl files found by an incremental query
+// to the ones already watched. Files that are no longer loaded are only
+// dropped by the next full query.
+func (i *IBazel) mergeBuildFiles(found []string) []string {
+	return mergeFiles(i.queriedFiles(i.buildFileWatcher), found)
+}
+
+// mergeSourceFiles adds the source files found by an incremental query to the
+// ones already watched, and drops the files of the changed packages that it
+// didn't find.
+func (i *IBazel) mergeSourceFiles(q *incrementalQuery, found []string) []string {
+	owned := q.owner()
+	kept := map[string]struct{}{}
+	for file := range i.queriedFiles(i.sourceFileWatcher) {
+		if !owned(file) {
+			kept[file] = struct{}{}
+		}
+	}
+	return mergeFiles(kept, found)
+}
+
+// owner returns a function that reports whether a file belongs to one of the
+// changed packages, including the subdirectories that aren't packages of
+// their own.
+func (q *incrementalQuery) owner() func(file string) bool {
+	dirs := map[string]bool{}
+	for _, dir := range q.packageDirs {
+		dirs[dir] = true
+	}
+	// Whether a directory belongs to one of the changed packages.
+	var owned func(dir string) bool
+	owned = func(dir string) bool {
+		if o, ok := dirs[dir]; ok {
+			return o
+		}
+		parent := filepath.Dir(dir)
+		o := parent != dir && !isPackage(dir) && owned(parent)
+		dirs[dir] = o
+		return o
+	}
+	return func(file string) bool {
+		return owned(filepath.Dir(file))
+	}
+}
+
+// isPackage reports whether dir has a BUILD file.
+func isPackage(dir string) bool {
+	for _, name := range []string{"BUILD", "BUILD.bazel"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// queriedFiles returns the files watched because of the queries, leaving out
+// the watch paths.
+func (i *IBazel) queriedFiles(w fSNotifyWatcher) map[string]struct{} {
+	files := map[string]struct{}{}
+	i.filesWatched[w].each(func(file string) {
+		if _, ok := i.extraWatched[w][file]; !ok {
+			files[file] = struct{}{}
+		}
+	})
+	return files
+}
+
+func mergeFiles(files map[string]struct{}, found []string) []string {
+	for _, file := range found {
+		files[file] = struct{}{}
+	}
+	merged := make([]string, 0, len(files))
+	for file := range files {
+		merged = append(merged, file)
+	}
+	sort.Strings(merged)
+	return merged
+}
@@ -0,0 +1,185 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazel-watcher/bazel"
+	mock_bazel "github.com/bazelbuild/bazel-watcher/bazel/testing"
+
+	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestIBazelAffectedPackages(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+	i.workspaceFinder = &workspaceFinder{"/workspace"}
+
+	rbuildfiles := "rbuildfiles(tools/defs.bzl)"
+	oldBazelNew := bazelNew
+	defer func() { bazelNew = oldBazelNew }()
+	bazelNew = func() bazel.Bazel {
+		b := oldBazelNew()
+		mockBazel.AddQueryResponse(rbuildfiles, &blaze_query.QueryResult{
+			Target: []*blaze_query.Target{
+				sourceFileTarget("//a:BUILD.bazel"),
+				sourceFileTarget("//b/c:BUILD"),
+				sourceFileTarget("@external//:BUILD"),
+			},
+		})
+		return b
+	}
+
+	packages, err := i.affectedPackages(context.Background(), []string{
+		filepath.Join("/workspace", "BUILD"),
+		filepath.Join("/workspace", "a", "BUILD.bazel"),
+		filepath.Join("/workspace", "tools", "defs.bzl"),
+	}, []string{"//a:target", "//b/..."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []string{"", "a", "b/c"}, packages, "Affected packages")
+	mockBazel.AssertActions(t, [][]string{
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
+		[]string{"Query", regexp.QuoteMeta(rbuildfiles), "--universe_scope=//a:target,//b/...", "--order_output=no"},
+	})
+
+	if _, err := i.affectedPackages(context.Background(), []string{"/elsewhere/BUILD"}, nil); err == nil {
+		t.Errorf("Expected a file outside of the workspace to be rejected")
+	}
+}
+
+func TestIncrementalChanges(t *testing.T) {
+	for changes, want := range map[string]bool{
+		"/ws/a/BUILD /ws/b/BUILD.bazel /ws/tools/defs.bzl": true,
+		"/ws/a/BUILD /ws/WORKSPACE":                        false,
+		"/ws/MODULE.bazel":                                 false,
+	} {
+		assertEqual(t, want, incrementalChanges(strings.Fields(changes)), changes)
+	}
+}
+
+func TestIBazelRequery_incremental(t *testing.T) {
+	i, err := New(context.Background(), Options{IncrementalQuery: true, FullQueryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Cleanup()
+	dir := testWorkspace(t, "a/sub/", "a/subpkg/BUILD", "b/", "c/")
+	defer os.RemoveAll(dir)
+	file := func(pkg, name string) string {
+		return filepath.Join(dir, filepath.FromSlash(pkg), name)
+	}
+	i.workspaceFinder = &workspaceFinder{dir}
+	i.lastFullQuery = time.Now()
+
+	i.filesWatched[i.buildFileWatcher] = newWatchSet(
+		file("a", "BUILD"),
+		file("b", "BUILD"),
+	)
+	i.filesWatched[i.sourceFileWatcher] = newWatchSet(
+		file("a", "old.go"),
+		file("a", "kept.go"),
+		file("a/sub", "stale.go"),
+		file("a/subpkg", "other.go"),
+		file("b", "b.go"),
+	)
+
+	rootsQuery := "rdeps(set(//a:target //b:target), set(//a:*), 0)"
+	var mocks []*mock_bazel.MockBazel
+	sourceQuery := i.queries.sourceQuery("//a:lib //a:target")
+
+	oldBazelNew := bazelNew
+	defer func() { bazelNew = oldBazelNew }()
+	bazelNew = func() bazel.Bazel {
+		b := oldBazelNew()
+		mockBazel.AddQueryResponse(rootsQuery, &blaze_query.QueryResult{
+			Target: []*blaze_query.Target{
+				{Type: blaze_query.Target_RULE.Enum(), Rule: &blaze_query.Rule{Name: proto.String("//a:target")}},
+				{Type: blaze_query.Target_RULE.Enum(), Rule: &blaze_query.Rule{Name: proto.String("//a:lib")}},
+			},
+		})
+		mockBazel.AddQueryResponse(sourceQuery, &blaze_query.QueryResult{
+			Target: []*blaze_query.Target{
+				sourceFileTarget("//a:kept.go"),
+				sourceFileTarget("//a:new.go"),
+				sourceFileTarget("//c:c.go"),
+			},
+		})
+		mocks = append(mocks, mockBazel)
+		return b
+	}
+
+	i.changeDetected(nil, "graph", file("a", "BUILD"))
+	i.scheduleRequery()
+	i.startRequery(context.Background(), []string{"//a:target", "//b:target"}, "//a:target //b:target")
+	defer i.cancelRequery()
+	r := <-i.requeryResults
+	i.finishRequery(nil, r)
+
+	assertEqual(t, []string{
+		file("a", "kept.go"),
+		file("a", "new.go"),
+		file("a/subpkg", "other.go"),
+		file("b", "b.go"),
+		file("c", "c.go"),
+	}, i.filesWatched[i.sourceFileWatcher].files(), "Source files merged into the watch set")
+	assertEqual(t, []string{
+		file("a", "BUILD"),
+		file("b", "BUILD"),
+	}, i.filesWatched[i.buildFileWatcher].files(), "BUILD files are only added")
+	assertQueries(t, mocks, [][]string{
+		{rootsQuery, "--universe_scope=//a:target,//b:target", "--order_output=no"},
+		{i.queries.buildQuery("//a:lib //a:target")},
+		{sourceQuery},
+	})
+
+	// Other changes to the graph need a full query.
+	mocks = nil
+	i.changeDetected(nil, "graph", file("", "WORKSPACE"))
+	i.scheduleRequery()
+	i.startRequery(context.Background(), []string{"//a:target", "//b:target"}, "//a:target //b:target")
+	r = <-i.requeryResults
+	i.finishRequery(nil, r)
+	assertQueries(t, mocks, [][]string{
+		{i.queries.buildQuery("//a:target //b:target")},
+		{i.queries.sourceQuery("//a:target //b:target")},
+	})
+
+	// A full query is done once the last one is too old.
+	mocks = nil
+	i.lastFullQuery = time.Now().Add(-2 * time.Hour)
+	i.changeDetected(nil, "graph", file("a", "BUILD"))
+	i.scheduleRequery()
+	i.startRequery(context.Background(), []string{"//a:target", "//b:target"}, "//a:target //b:target")
+	r = <-i.requeryResults
+	i.finishRequery(nil, r)
+	assertQueries(t, mocks, [][]string{
+		{i.queries.buildQuery("//a:target //b:target")},
+		{i.queries.sourceQuery("//a:target //b:target")},
+	})
+	if time.Since(i.lastFullQuery) > time.Minute {
+		t.Errorf("Expected the time of the last full query to be updated")
+	}
+}
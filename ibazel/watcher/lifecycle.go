@@ -1,8 +1,9 @@
-package main
+package watcher
 
 import (
 	"bytes"
 
+	"github.com/bazelbuild/bazel-watcher/bazel"
 	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
 )
 
@@ -25,11 +26,30 @@ type Lifecycle interface {
 	Cleanup()
 
 	// BeforeCommand is called before a blaze $COMMAND is run.
-	// command: "build"|"test"|"run"
+	// command: "build"|"test"|"coverage"|"run"|"exec", or any other Bazel
+	// command ibazel was started with, such as "mobile-install"
 	BeforeCommand(targets []string, command string)
 
 	// AfterCommand is called after a blaze $COMMAND is run with the result of
 	// that command.
-	// command: "build"|"test"|"run"
+	// command: the same as for BeforeCommand
 	AfterCommand(targets []string, command string, success bool, output *bytes.Buffer)
 }
+
+// OutputListener is implemented by lifecycle listeners that want the output of
+// Bazel line by line while a command runs, rather than only its last lines
+// once it is done.
+type OutputListener interface {
+	// OutputLine is called with every line of output of a command in the order
+	// the lines were written. It is called while Bazel runs, so it shouldn't
+	// block.
+	OutputLine(targets []string, command string, line bazel.Line)
+}
+
+// ExecListener is implemented by lifecycle listeners that want the exit status
+// of the command run by exec.
+type ExecListener interface {
+	// ExecExited is called once the command has exited, before AfterCommand.
+	// status is -1 if the command couldn't be run.
+	ExecExited(targets []string, status int)
+}
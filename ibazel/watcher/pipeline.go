@@ -0,0 +1,120 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+)
+
+// Stage is one of the commands a pipeline runs on every iteration.
+type Stage struct {
+	// Command is build, test, coverage, run, exec or any other Bazel command
+	// that takes targets.
+	Command string
+	Targets []string
+}
+
+// validateStages checks that every stage has targets, and that only the last
+// stage is run or exec, since it is the one that gets the arguments.
+func validateStages(stages []Stage, args []string) error {
+	if len(stages) == 0 {
+		return errors.New("a pipeline needs stages")
+	}
+	for n, s := range stages {
+		if s.Command == "" {
+			return errors.New("pipeline stages need a command")
+		}
+		if len(s.Targets) == 0 {
+			return fmt.Errorf("the %s stage needs targets", s.Command)
+		}
+		switch s.Command {
+		case "run", "exec":
+			if n+1 < len(stages) {
+				return fmt.Errorf("%s must be the last stage", s.Command)
+			}
+		}
+	}
+	switch last := stages[len(stages)-1]; last.Command {
+	case "run":
+		if len(last.Targets) > 1 {
+			return errors.New("the run stage takes a single target")
+		}
+	case "exec":
+		if len(args) == 0 {
+			return errors.New("exec needs a command to run after --")
+		}
+	}
+	return nil
+}
+
+// Pipeline runs the stages one after the other in the IBazel loop until ctx
+// is done. A stage only runs if the ones before it succeeded. args are passed
+// to the last stage if it is run or exec.
+func (i *IBazel) Pipeline(ctx context.Context, stages []Stage, args []string) error {
+	if err := validateStages(stages, args); err != nil {
+		return err
+	}
+	i.args = args
+	i.execArgs = args
+	i.stages = stages
+
+	var targets []string
+	for _, s := range stages {
+		for _, target := range s.Targets {
+			if !contains(targets, target) {
+				targets = append(targets, target)
+			}
+		}
+	}
+	return i.loop(ctx, "pipeline", nil, targets)
+}
+
+// runPipeline runs the stages until one of them fails. Each stage is reported
+// to the lifecycle listeners on its own.
+func (i *IBazel) runPipeline(ctx context.Context) {
+	for n, s := range i.stages {
+		if err := i.runCommand(ctx, s.Command, i.stageCommand(s.Command), s.Targets); err != nil {
+			if n+1 < len(i.stages) {
+				log.Errorf("Skipping the rest of the pipeline because %s failed", s.Command)
+			}
+			return
+		}
+	}
+}
+
+func (i *IBazel) stageCommand(command string) runnableCommand {
+	switch command {
+	case "build":
+		return i.build
+	case "test":
+		return i.test
+	case "coverage":
+		return i.coverage
+	case "run":
+		return i.run
+	case "exec":
+		return i.exec
+	default:
+		return func(ctx context.Context, targets ...string) (*bytes.Buffer, error) {
+			return i.command(ctx, command, targets...)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultPollInterval is how often the polling watcher looks for changes.
+const DefaultPollInterval = time.Second
+
+// pollingWatcher finds changes by looking at the watched files at an interval,
+// for filesystems that don't deliver inotify events. Like fsnotify, it
+// watches the files directly inside the directories it is given.
+type pollingWatcher struct {
+	interval time.Duration
+	// Compare the content of files instead of their modification time.
+	hash bool
+
+	events chan fsnotify.Event
+	errors chan error
+
+	lock sync.Mutex // guards watched
+	// What was last seen of each watched path, by name inside it. A watched
+	// file is its own only entry, under "".
+	watched map[string]map[string]fileSnapshot
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ fSNotifyWatcher = &pollingWatcher{}
+
+type fileSnapshot struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+	hash    string
+}
+
+func newPollingWatcher(interval time.Duration, hash bool) *pollingWatcher {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	w := &pollingWatcher{
+		interval: interval,
+		hash:     hash,
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		watched:  map[string]map[string]fileSnapshot{},
+		done:     make(chan struct{}),
+	}
+	go w.poll()
+	return w
+}
+
+func (w *pollingWatcher) Add(name string) error {
+	name = filepath.Clean(name)
+	entries, err := w.snapshot(name)
+	if err != nil {
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.watched[name] = entries
+	return nil
+}
+
+func (w *pollingWatcher) Remove(name string) error {
+	name = filepath.Clean(name)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.watched[name]; !ok {
+		return &os.PathError{Op: "remove watch", Path: name, Err: os.ErrNotExist}
+	}
+	delete(w.watched, name)
+	return nil
+}
+
+func (w *pollingWatcher) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	return nil
+}
+
+func (w *pollingWatcher) Events() chan fsnotify.Event { return w.events }
+func (w *pollingWatcher) Errors() chan error          { return w.errors }
+func (w *pollingWatcher) Watcher() *fsnotify.Watcher  { return nil }
+
+func (w *pollingWatcher) poll() {
+	defer close(w.events)
+	defer close(w.errors)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, e := range w.changes() {
+				select {
+				case w.events <- e:
+				case <-w.done:
+					return
+				}
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// changes looks at every watched path again, and returns what changed since
+// the last time.
+func (w *pollingWatcher) changes() []fsnotify.Event {
+	w.lock.Lock()
+	names := make([]string, 0, len(w.watched))
+	for name := range w.watched {
+		names = append(names, name)
+	}
+	w.lock.Unlock()
+
+	var events []fsnotify.Event
+	for _, name := range names {
+		// A path that can't be read any more has no entries.
+		entries, _ := w.snapshot(name)
+
+		w.lock.Lock()
+		before, ok := w.watched[name]
+		if ok {
+			w.watched[name] = entries
+		}
+		w.lock.Unlock()
+		if !ok {
+			// Removed in the meantime.
+			continue
+		}
+		events = append(events, diffSnapshots(name, before, entries)...)
+	}
+	return events
+}
+
+func diffSnapshots(name string, before, after map[string]fileSnapshot) []fsnotify.Event {
+	var events []fsnotify.Event
+	path := func(entry string) string {
+		if entry == "" {
+			return name
+		}
+		return filepath.Join(name, entry)
+	}
+	for entry, s := range after {
+		old, ok := before[entry]
+		switch {
+		case !ok:
+			events = append(events, fsnotify.Event{Name: path(entry), Op: fsnotify.Create})
+		case old.changed(s):
+			events = append(events, fsnotify.Event{Name: path(entry), Op: fsnotify.Write})
+		case old.mode != s.mode:
+			events = append(events, fsnotify.Event{Name: path(entry), Op: fsnotify.Chmod})
+		}
+	}
+	for entry := range before {
+		if _, ok := after[entry]; !ok {
+			events = append(events, fsnotify.Event{Name: path(entry), Op: fsnotify.Remove})
+		}
+	}
+	return events
+}
+
+// snapshot records what is in a watched directory, or the watched file.
+func (w *pollingWatcher) snapshot(name string) (map[string]fileSnapshot, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return map[string]fileSnapshot{"": w.snapshotFile(name, info)}, nil
+	}
+	infos, err := ioutil.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]fileSnapshot, len(infos))
+	for _, info := range infos {
+		entries[info.Name()] = w.snapshotFile(filepath.Join(name, info.Name()), info)
+	}
+	return entries, nil
+}
+
+func (w *pollingWatcher) snapshotFile(path string, info os.FileInfo) fileSnapshot {
+	s := fileSnapshot{size: info.Size(), modTime: info.ModTime(), mode: info.Mode()}
+	if w.hash && info.Mode().IsRegular() {
+		// A file that can't be read is compared by size only.
+		s.hash, _ = hashFile(path)
+	}
+	return s
+}
+
+// changed reports whether the content of a file changed. Hashes, when there
+// are any, are more reliable than modification times, which some network
+// filesystems only keep to the second.
+func (s fileSnapshot) changed(after fileSnapshot) bool {
+	if s.size != after.size {
+		return true
+	}
+	if s.hash != "" || after.hash != "" {
+		return s.hash != after.hash
+	}
+	return !s.modTime.Equal(after.modTime)
+}
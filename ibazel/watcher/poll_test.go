@@ -0,0 +1,143 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestPollingWatcher(t *testing.T) {
+	dir := testWorkspace(t)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.go")
+
+	// The changes are looked for by hand instead of on a timer.
+	w := newPollingWatcher(time.Hour, false)
+	defer w.Close()
+	if err := w.Add(dir + string(filepath.Separator)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected watching a missing file to fail")
+	}
+
+	assertEqual(t, []fsnotify.Event(nil), w.changes(), "Nothing changed")
+	if err := ioutil.WriteFile(file, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []fsnotify.Event{{Name: file, Op: fsnotify.Create}}, w.changes(), "File created")
+	if err := ioutil.WriteFile(file, []byte("version 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []fsnotify.Event{{Name: file, Op: fsnotify.Write}}, w.changes(), "File written")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []fsnotify.Event{{Name: file, Op: fsnotify.Write}}, w.changes(), "File touched")
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []fsnotify.Event{{Name: file, Op: fsnotify.Remove}}, w.changes(), "File removed")
+
+	if err := w.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []fsnotify.Event(nil), w.changes(), "Directory no longer watched")
+}
+
+func TestPollingWatcher_hash(t *testing.T) {
+	dir := testWorkspace(t)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(file, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := newPollingWatcher(time.Hour, true)
+	defer w.Close()
+	if err := w.Add(file); err != nil {
+		t.Fatal(err)
+	}
+
+	// Touching the file doesn't change it.
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []fsnotify.Event(nil), w.changes(), "File touched")
+
+	// Changes that keep the size and modification time are noticed.
+	if err := ioutil.WriteFile(file, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, []fsnotify.Event{{Name: file, Op: fsnotify.Write}}, w.changes(), "File written")
+}
+
+func TestPollingWatcher_events(t *testing.T) {
+	dir := testWorkspace(t)
+	defer os.RemoveAll(dir)
+
+	w := newPollingWatcher(10*time.Millisecond, false)
+	if err := w.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-w.Events():
+		assertEqual(t, fsnotify.Event{Name: file, Op: fsnotify.Create}, e, "Event")
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected an event for the new file")
+	}
+
+	// The channels are closed, like those of fsnotify.
+	w.Close()
+	for range w.Events() {
+	}
+}
+
+func TestNew_watcher(t *testing.T) {
+	i, err := New(context.Background(), Options{Watcher: WatcherPoll, PollInterval: time.Minute, PollHash: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Cleanup()
+	w, ok := i.sourceFileWatcher.(*pollingWatcher)
+	if !ok {
+		t.Fatalf("Expected a polling watcher, got %T", i.sourceFileWatcher)
+	}
+	assertEqual(t, time.Minute, w.interval, "Poll interval")
+	assertEqual(t, true, w.hash, "Poll hash")
+
+	if _, err := New(context.Background(), Options{Watcher: "inotify"}); err == nil {
+		t.Errorf("Expected an unknown watcher to be rejected")
+	}
+}
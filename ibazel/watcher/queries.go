@@ -0,0 +1,112 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TargetsPlaceholder is replaced by the targets in the watch queries.
+const TargetsPlaceholder = "{targets}"
+
+// The queries that find the files to watch unless they are overridden.
+const (
+	DefaultSourceQuery = "kind('source file', deps(set({targets})))"
+	DefaultBuildQuery  = "buildfiles(deps(set({targets})))"
+)
+
+var placeholderRegex = regexp.MustCompile(`\{[^{}]*\}`)
+
+// watchQueries find the files to watch: the source files, whose changes
+// trigger a build, and the BUILD and .bzl files, whose changes also trigger a
+// new query.
+type watchQueries struct {
+	source string
+	build  string
+	// Options given to every query, such as --keep_going.
+	args []string
+}
+
+func newWatchQueries(source, build string, args []string) (watchQueries, error) {
+	q := watchQueries{source: DefaultSourceQuery, build: DefaultBuildQuery, args: args}
+	if source != "" {
+		q.source = source
+	}
+	if build != "" {
+		q.build = build
+	}
+	if err := validateQueryTemplate("source", q.source); err != nil {
+		return q, err
+	}
+	if err := validateQueryTemplate("build", q.build); err != nil {
+		return q, err
+	}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return q, fmt.Errorf("Query option %q isn't a flag", arg)
+		}
+	}
+	return q, nil
+}
+
+func (q watchQueries) sourceQuery(joinedTargets string) string {
+	return strings.Replace(q.source, TargetsPlaceholder, joinedTargets, -1)
+}
+
+func (q watchQueries) buildQuery(joinedTargets string) string {
+	return strings.Replace(q.build, TargetsPlaceholder, joinedTargets, -1)
+}
+
+// validateQueryTemplate catches the mistakes in a query template that would
+// otherwise only show up as a failed query once iBazel is running.
+func validateQueryTemplate(name, template string) error {
+	if !strings.Contains(template, TargetsPlaceholder) {
+		return fmt.Errorf("The %s query %q doesn't contain %s", name, template, TargetsPlaceholder)
+	}
+	for _, p := range placeholderRegex.FindAllString(template, -1) {
+		if p != TargetsPlaceholder {
+			return fmt.Errorf("The %s query %q contains the unknown placeholder %s", name, template, p)
+		}
+	}
+
+	depth := 0
+	var quote rune
+	for _, c := range template {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("The %s query %q has an unbalanced )", name, template)
+			}
+		}
+	}
+	if quote != 0 {
+		return fmt.Errorf("The %s query %q has an unterminated %c", name, template, quote)
+	}
+	if depth > 0 {
+		return fmt.Errorf("The %s query %q has an unbalanced (", name, template)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+)
+
+// queryCacheVersion changes whenever the format of the query cache does.
+const queryCacheVersion = 1
+
+// queryCache is the watch set found by the last query, kept under Bazel's
+// output base so that the next iBazel started on the same targets can build
+// without waiting for the queries.
+type queryCache struct {
+	Version int    `json:"version"`
+	Key     string `json:"key"`
+	// The BUILD and .bzl files, which the cache is only valid with as long as
+	// they didn't change.
+	BuildFiles  map[string]fileState `json:"build_files"`
+	SourceFiles []string             `json:"source_files"`
+}
+
+type fileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+}
+
+// queryCacheKey identifies what the watch set depends on besides the BUILD and
+// .bzl files: the targets, the flags and the version of Bazel.
+func (i *IBazel) queryCacheKey(targets []string) string {
+	h := sha256.New()
+	json.NewEncoder(h).Encode(struct {
+		Targets     []string
+		StartupArgs []string
+		BazelArgs   []string
+		SourceQuery string
+		BuildQuery  string
+		QueryArgs   []string
+		CQuery      bool
+		Release     string
+	}{
+		targets,
+		i.startupArgs,
+		i.bazelArgs,
+		i.queries.source,
+		i.queries.build,
+		i.queries.args,
+		i.cquery,
+		i.bazelRelease,
+	})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// queryCachePath returns where the watch set of targets is cached, or "" when
+// it isn't.
+func (i *IBazel) queryCachePath(key string) string {
+	if !i.queryCache || i.outputBase == "" {
+		return ""
+	}
+	return filepath.Join(i.outputBase, "ibazel", "queries", key[:16]+".json")
+}
+
+// loadQueryCache watches the files found by the last query of targets, if
+// none of the BUILD and .bzl files changed since then.
+func (i *IBazel) loadQueryCache(targets []string) bool {
+	key := i.queryCacheKey(targets)
+	path := i.queryCachePath(key)
+	if path == "" {
+		return false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Error reading the query cache: %v", err)
+		}
+		return false
+	}
+	var c queryCache
+	if err := json.Unmarshal(data, &c); err != nil {
+		log.Errorf("Error reading the query cache %s: %v", path, err)
+		return false
+	}
+	if c.Version != queryCacheVersion || c.Key != key {
+		return false
+	}
+
+	buildFiles := make([]string, 0, len(c.BuildFiles))
+	for file, state := range c.BuildFiles {
+		if !state.matches(file) {
+			log.Logf("Not using the query cache: %q changed", file)
+			return false
+		}
+		buildFiles = append(buildFiles, file)
+	}
+	sort.Strings(buildFiles)
+
+	log.Logf("Watching the files found by the last query")
+	i.watchFiles("cached buildfiles", buildFiles, i.buildFileWatcher)
+	i.watchFiles("cached source files", c.SourceFiles, i.sourceFileWatcher, i.watchPathEntries()...)
+	return true
+}
+
+// saveQueryCache writes the watch set to the query cache of targets in the
+// background.
+func (i *IBazel) saveQueryCache(targets []string) {
+	key := i.queryCacheKey(targets)
+	path := i.queryCachePath(key)
+	if path == "" {
+		return
+	}
+	buildFiles := mergeFiles(i.queriedFiles(i.buildFileWatcher), nil)
+	sourceFiles := mergeFiles(i.queriedFiles(i.sourceFileWatcher), nil)
+	go func() {
+		if err := writeQueryCache(path, key, buildFiles, sourceFiles); err != nil {
+			log.Errorf("Error writing the query cache: %v", err)
+		}
+	}()
+}
+
+func writeQueryCache(path, key string, buildFiles, sourceFiles []string) error {
+	c := queryCache{
+		Version:     queryCacheVersion,
+		Key:         key,
+		BuildFiles:  map[string]fileState{},
+		SourceFiles: sourceFiles,
+	}
+	for _, file := range buildFiles {
+		state, err := newFileState(file)
+		if err != nil {
+			return err
+		}
+		c.BuildFiles[file] = state
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Replace the cache at once, so that it is never read half written.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func newFileState(file string) (fileState, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fileState{}, err
+	}
+	hash, err := hashFile(file)
+	if err != nil {
+		return fileState{}, err
+	}
+	return fileState{Size: info.Size(), ModTime: info.ModTime(), Hash: hash}, nil
+}
+
+// matches reports whether file is unchanged. Its content is only hashed when
+// its size and modification time don't tell.
+func (s fileState) matches(file string) bool {
+	info, err := os.Stat(file)
+	if err != nil || info.Size() != s.Size {
+		return false
+	}
+	if info.ModTime().Equal(s.ModTime) {
+		return true
+	}
+	hash, err := hashFile(file)
+	return err == nil && hash == s.Hash
+}
+
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("Error hashing %q: %v", file, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
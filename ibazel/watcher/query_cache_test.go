@@ -0,0 +1,82 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIBazelQueryCache(t *testing.T) {
+	dir := testWorkspace(t, "pkg/BUILD", "pkg/a.go")
+	defer os.RemoveAll(dir)
+	build := filepath.Join(dir, "pkg", "BUILD")
+	source := filepath.Join(dir, "pkg", "a.go")
+
+	i, err := New(context.Background(), Options{QueryCache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Cleanup()
+	i.outputBase = filepath.Join(dir, "output_base")
+	targets := []string{"//pkg:target"}
+
+	key := i.queryCacheKey(targets)
+	if err := writeQueryCache(i.queryCachePath(key), key, []string{build}, []string{source}); err != nil {
+		t.Fatal(err)
+	}
+
+	i.state = QUERY
+	i.iteration(context.Background(), "build", nil, targets, "//pkg:target")
+	assertEqual(t, RUN, i.state, "The command runs right away")
+	if i.requery == nil {
+		t.Errorf("Expected the cached files to be checked in the background")
+	}
+	assertEqual(t, []string{build}, i.filesWatched[i.buildFileWatcher].files(), "Cached BUILD files")
+	assertEqual(t, []string{source}, i.filesWatched[i.sourceFileWatcher].files(), "Cached source files")
+	mockBazel.AssertActions(t, [][]string{
+		[]string{"SetStdout"},
+		[]string{"SetStderr"},
+		[]string{"Info"},
+	})
+
+	// Touching a BUILD file keeps the cache, changing it doesn't.
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(build, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !i.loadQueryCache(targets) {
+		t.Errorf("Expected the cache to be used after the BUILD file was touched")
+	}
+	if err := ioutil.WriteFile(build, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if i.loadQueryCache(targets) {
+		t.Errorf("Expected the cache to be dropped after the BUILD file changed")
+	}
+
+	// Other flags or another version of Bazel use another cache.
+	i.bazelRelease = "release 99.0.0"
+	if key == i.queryCacheKey(targets) {
+		t.Errorf("Expected the version of Bazel to be part of the key")
+	}
+	if key == i.queryCacheKey([]string{"//pkg:other"}) {
+		t.Errorf("Expected the targets to be part of the key")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Functions that only cquery and aquery know, and which of their arguments is
+// the expression that gives the targets.
+var queryFilterArgs = map[string]map[string]int{
+	"cquery": {"config": 0},
+	"aquery": {"inputs": -1, "outputs": -1, "mnemonic": -1},
+}
+
+// QueryCommand runs query, cquery or aquery with a query expression in the
+// IBazel loop until ctx is done. The files of the targets the expression
+// evaluates to when it starts are watched.
+func (i *IBazel) QueryCommand(ctx context.Context, command string, expression string) error {
+	targets, err := i.expressionTargets(ctx, command, expression)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("%q doesn't match any targets to watch", expression)
+	}
+	return i.loop(ctx, command, func(ctx context.Context, _ ...string) (*bytes.Buffer, error) {
+		return i.command(ctx, command, expression)
+	}, targets)
+}
+
+// expressionTargets evaluates the targets of a query expression with bazel
+// query.
+func (i *IBazel) expressionTargets(ctx context.Context, command string, expression string) ([]string, error) {
+	b := i.newBazel()
+	res, err := b.Query(ctx, append([]string{targetsExpression(command, expression)}, i.queries.args...)...)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]string, 0, len(res.Target))
+	for _, target := range res.Target {
+		switch {
+		case target.Rule != nil:
+			targets = append(targets, target.Rule.GetName())
+		case target.SourceFile != nil:
+			targets = append(targets, target.SourceFile.GetName())
+		case target.GeneratedFile != nil:
+			targets = append(targets, target.GeneratedFile.GetName())
+		}
+	}
+	return targets, nil
+}
+
+// targetsExpression strips the functions that only the cquery or aquery
+// command knows from around a query expression, leaving what bazel query can
+// evaluate.
+func targetsExpression(command string, expression string) string {
+	for {
+		name, args, ok := splitCall(expression)
+		if !ok {
+			return expression
+		}
+		n, ok := queryFilterArgs[command][name]
+		if !ok {
+			return expression
+		}
+		if n < 0 {
+			n += len(args)
+		}
+		if n < 0 || n >= len(args) {
+			return expression
+		}
+		expression = args[n]
+	}
+}
+
+// splitCall splits an expression that is a single function call, such as
+// "mnemonic('GoCompile', deps(//foo))", into the name of the function and its
+// arguments.
+func splitCall(expression string) (string, []string, bool) {
+	expression = strings.TrimSpace(expression)
+	open := strings.Index(expression, "(")
+	if open <= 0 || !strings.HasSuffix(expression, ")") {
+		return "", nil, false
+	}
+	name := strings.TrimSpace(expression[:open])
+	if strings.ContainsAny(name, " \t\n") {
+		return "", nil, false
+	}
+
+	var args []string
+	depth := 0
+	var quote rune
+	start := open + 1
+	for n, c := range expression[open:] {
+		n += open
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				if n != len(expression)-1 {
+					// The call is only part of the expression.
+					return "", nil, false
+				}
+				args = append(args, strings.TrimSpace(expression[start:n]))
+			}
+		case c == ',' && depth == 1:
+			args = append(args, strings.TrimSpace(expression[start:n]))
+			start = n + 1
+		}
+	}
+	return name, args, depth == 0 && quote == 0
+}
@@ -0,0 +1,211 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// requery is a query of the files to watch that follows a change to the build
+// graph. It runs in the background once the command was run, so the build
+// isn't held up by it.
+type requery struct {
+	// When the build graph changed. Newly watched files modified since then
+	// are treated as changed.
+	changed time.Time
+	// Cancels the query once it started.
+	cancel context.CancelFunc
+	// Changes to files that weren't watched while the query was pending, which
+	// may be part of the new watch set.
+	missed []missedEvent
+	// The BUILD and .bzl files that changed.
+	graphChanges []string
+}
+
+type missedEvent struct {
+	watcher fSNotifyWatcher
+	name    string
+}
+
+// requeryResult is the outcome of the queries of a requery. The watch set is
+// left alone when a query failed.
+type requeryResult struct {
+	requery *requery
+	// Set when only the files the changed packages can affect were queried.
+	incremental *incrementalQuery
+
+	buildQuery string
+	buildFiles []string
+	buildErr   error
+
+	sourceQuery string
+	sourceFiles []string
+	sourceErr   error
+}
+
+// scheduleRequery queries for the files to watch once the command was run.
+// The query that is already running, if any, is superseded.
+func (i *IBazel) scheduleRequery() {
+	q := &requery{changed: time.Now(), graphChanges: i.graphChanges}
+	if i.requery != nil {
+		if i.requery.cancel != nil {
+			i.requery.cancel()
+		}
+		q.changed = i.requery.changed
+		q.missed = i.requery.missed
+		q.graphChanges = append(i.requery.graphChanges, q.graphChanges...)
+	}
+	i.requery = q
+	i.graphChanges = nil
+}
+
+// startRequery starts the scheduled query, if any.
+func (i *IBazel) startRequery(ctx context.Context, targets []string, joinedTargets string) {
+	q := i.requery
+	if q == nil || q.cancel != nil {
+		return
+	}
+	ctx, q.cancel = context.WithCancel(ctx)
+
+	incremental := i.incrementalQuery && len(q.graphChanges) > 0 && incrementalChanges(q.graphChanges) && time.Since(i.lastFullQuery) < i.fullQueryInterval
+	log.Logf("Querying for files to watch in the background...")
+	go func() {
+		r := requeryResult{requery: q}
+		if incremental {
+			if err := i.queryIncrementally(ctx, &r, q.graphChanges, targets); err != nil {
+				log.Logf("Incremental query failed, querying for all files to watch: %v", err)
+				r = requeryResult{requery: q}
+				incremental = false
+			}
+		}
+		if !incremental {
+			r.buildQuery = i.queries.buildQuery(joinedTargets)
+			r.sourceQuery = i.queries.sourceQuery(joinedTargets)
+			r.buildFiles, r.buildErr = i.queryForSourceFiles(ctx, r.buildQuery)
+			r.sourceFiles, r.sourceErr = i.querySourceFiles(ctx, r.sourceQuery)
+		}
+		select {
+		case i.requeryResults <- r:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// cancelRequery stops the query that is running, if any.
+func (i *IBazel) cancelRequery() {
+	if i.requery != nil && i.requery.cancel != nil {
+		i.requery.cancel()
+	}
+	i.requery = nil
+}
+
+// watched reports whether a change to name matters to w. While a requery is
+// pending, changes to other files are kept until its result is known.
+func (i *IBazel) watched(w fSNotifyWatcher, e fsnotify.Event) bool {
+	if i.filesWatched[w].contains(e.Name) {
+		return true
+	}
+	if e.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		// The files of a deleted directory are gone too, and the directory
+		// needs watching again if it comes back.
+		dir := filepath.Clean(e.Name) + string(filepath.Separator)
+		if i.filesWatched[w].hasDir(dir) {
+			if i.removedDirs[w] == nil {
+				i.removedDirs[w] = map[string]struct{}{}
+			}
+			i.removedDirs[w][dir] = struct{}{}
+			return true
+		}
+	}
+	if i.requery != nil && e.Op&modifyingEvents != 0 {
+		i.requery.missed = append(i.requery.missed, missedEvent{w, e.Name})
+	}
+	return false
+}
+
+// finishRequery swaps in the new watch set, then acts on the changes to its
+// files that happened while the query was pending.
+func (i *IBazel) finishRequery(targets []string, r requeryResult) {
+	if r.requery != i.requery {
+		// Superseded by a newer query.
+		return
+	}
+	q := i.requery
+	i.requery = nil
+
+	before := map[fSNotifyWatcher]*watchSet{
+		i.buildFileWatcher:  i.filesWatched[i.buildFileWatcher],
+		i.sourceFileWatcher: i.filesWatched[i.sourceFileWatcher],
+	}
+	if r.incremental != nil {
+		r.buildFiles = i.mergeBuildFiles(r.buildFiles)
+		r.sourceFiles = i.mergeSourceFiles(r.incremental, r.sourceFiles)
+	} else if r.buildErr == nil && r.sourceErr == nil {
+		i.lastFullQuery = time.Now()
+	}
+	if r.buildErr == nil {
+		i.watchFiles(r.buildQuery, r.buildFiles, i.buildFileWatcher)
+	}
+	if r.sourceErr == nil {
+		i.watchFiles(r.sourceQuery, r.sourceFiles, i.sourceFileWatcher, i.watchPathEntries()...)
+	}
+	if r.buildErr == nil && r.sourceErr == nil {
+		i.saveQueryCache(targets)
+	}
+
+	changed := map[fSNotifyWatcher][]string{}
+	seen := map[string]bool{}
+	add := func(w fSNotifyWatcher, name string) {
+		if !seen[name] {
+			seen[name] = true
+			changed[w] = append(changed[w], name)
+		}
+	}
+	for _, m := range q.missed {
+		if i.filesWatched[m.watcher].contains(m.name) {
+			add(m.watcher, m.name)
+		}
+	}
+	// Files in directories that weren't watched before didn't send any event.
+	for w, files := range before {
+		i.filesWatched[w].each(func(file string) {
+			if files.contains(file) {
+				return
+			}
+			if info, err := os.Stat(file); err == nil && info.ModTime().After(q.changed) {
+				add(w, file)
+			}
+		})
+	}
+
+	for _, name := range changed[i.buildFileWatcher] {
+		log.Logf("Build graph changed: %q. Requerying...", name)
+		i.changeDetected(targets, "graph", name)
+		i.state = DEBOUNCE_QUERY
+	}
+	for _, name := range changed[i.sourceFileWatcher] {
+		log.Logf("Changed: %q. Rebuilding...", name)
+		i.changeDetected(targets, "source", name)
+		if i.state != DEBOUNCE_QUERY {
+			i.state = DEBOUNCE_RUN
+		}
+	}
+}
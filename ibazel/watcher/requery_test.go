@@ -0,0 +1,119 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/bazel-watcher/bazel"
+	"github.com/fsnotify/fsnotify"
+
+	blaze_query "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
+)
+
+func TestIBazelRequery(t *testing.T) {
+	dir := testWorkspace(t, "pkg/BUILD", "pkg/a.go", "pkg/new.go", "other/b.go", "other/c.go")
+	defer os.RemoveAll(dir)
+	// b.go was written while the query was pending, c.go long before.
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "other", "c.go"), past, past); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "other", "b.go"), future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	i := newIBazel(t)
+	defer i.Cleanup()
+	i.workspaceFinder = &workspaceFinder{dir}
+	i.sourceEventHandler.SourceFileEvents = make(chan fsnotify.Event, 1)
+	i.filesWatched[i.sourceFileWatcher] = newWatchSet(filepath.Join(dir, "pkg", "a.go"))
+
+	release := make(chan struct{})
+	oldBazelNew := bazelNew
+	defer func() { bazelNew = oldBazelNew }()
+	bazelNew = func() bazel.Bazel {
+		<-release
+		b := oldBazelNew()
+		mockBazel.AddQueryResponse(i.queries.buildQuery("//pkg:target"), &blaze_query.QueryResult{
+			Target: []*blaze_query.Target{sourceFileTarget("//pkg:BUILD")},
+		})
+		mockBazel.AddQueryResponse(i.queries.sourceQuery("//pkg:target"), &blaze_query.QueryResult{
+			Target: []*blaze_query.Target{
+				sourceFileTarget("//pkg:a.go"),
+				sourceFileTarget("//pkg:new.go"),
+				sourceFileTarget("//other:b.go"),
+				sourceFileTarget("//other:c.go"),
+			},
+		})
+		return b
+	}
+
+	step := func() {
+		i.iteration(context.Background(), "build", nil, []string{"//pkg:target"}, "//pkg:target")
+	}
+
+	i.state = WAIT
+	i.scheduleRequery()
+	i.startRequery(context.Background(), []string{"//pkg:target"}, "//pkg:target")
+	defer i.cancelRequery()
+
+	// A change to a file that isn't watched yet is kept while the query runs.
+	i.sourceEventHandler.SourceFileEvents <- fsnotify.Event{Op: fsnotify.Write, Name: filepath.Join(dir, "pkg", "new.go")}
+	step()
+	assertEqual(t, WAIT, i.state, "State while the query runs")
+	assertEqual(t, []string(nil), i.changes, "Changes while the query runs")
+
+	close(release)
+	step()
+	if i.requery != nil {
+		t.Errorf("Expected the query to be done")
+	}
+	if !i.filesWatched[i.sourceFileWatcher].contains(filepath.Join(dir, "pkg", "new.go")) {
+		t.Errorf("Expected the new watch set to be swapped in")
+	}
+	assertEqual(t, DEBOUNCE_RUN, i.state, "State once the query is done")
+	assertEqual(t, []string{
+		filepath.Join(dir, "pkg", "new.go"),
+		filepath.Join(dir, "other", "b.go"),
+	}, i.changes, "Changes merged once the query is done")
+}
+
+func TestIBazelRequery_superseded(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+
+	i.scheduleRequery()
+	first := i.requery
+	i.requery.missed = []missedEvent{{i.sourceFileWatcher, "/path/to/foo"}}
+	cancelled := false
+	i.requery.cancel = func() { cancelled = true }
+
+	i.scheduleRequery()
+	if !cancelled {
+		t.Errorf("Expected the running query to be cancelled")
+	}
+	assertEqual(t, first.missed, i.requery.missed, "Missed changes of the superseded query")
+
+	i.filesWatched[i.sourceFileWatcher] = newWatchSet("/path/to/foo")
+	i.state = WAIT
+	i.finishRequery([]string{"//path/to:target"}, requeryResult{requery: first})
+	assertEqual(t, WAIT, i.state, "The result of a superseded query is ignored")
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+)
+
+// resolveEnvFiles makes the paths of env files absolute. Relative paths are
+// relative to the workspace root.
+func (i *IBazel) resolveEnvFiles(paths []string) []string {
+	workspacePath, err := i.workspaceFinder.FindWorkspace()
+	if err != nil {
+		log.Errorf("Error finding workspace: %v", err)
+		return paths
+	}
+
+	resolved := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(workspacePath, p)
+		}
+		resolved = append(resolved, p)
+	}
+	return resolved
+}
+
+// ibazelEnv returns the variables iBazel exports to the run target.
+func (i *IBazel) ibazelEnv() []string {
+	workspacePath, _ := i.workspaceFinder.FindWorkspace()
+	env := []string{
+		fmt.Sprintf("IBAZEL_ITERATION=%d", i.iterations),
+		"IBAZEL_CHANGED_FILES=" + strings.Join(i.changes, string(os.PathListSeparator)),
+		"IBAZEL_WORKSPACE_ROOT=" + workspacePath,
+	}
+	if url := i.proxy.URL(); url != "" {
+		env = append(env, "IBAZEL_PROXY_URL="+url)
+	}
+	return env
+}
@@ -12,35 +12,64 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package watcher
 
 import (
+	"sync"
+
 	"github.com/fsnotify/fsnotify"
 )
 
 type SourceEventHandler struct {
 	SourceFileEvents  chan fsnotify.Event
 	SourceFileWatcher *fsnotify.Watcher
+
+	watcher fSNotifyWatcher
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func (s *SourceEventHandler) Listen() {
 	for {
 		select {
-		case event := <-s.SourceFileWatcher.Events:
-			s.SourceFileEvents <- event
+		case event, ok := <-s.watcher.Events():
+			if !ok {
+				return
+			}
+			select {
+			case s.SourceFileEvents <- event:
+			case <-s.done:
+				return
+			}
 
 			switch event.Op {
 			case fsnotify.Remove, fsnotify.Rename:
-				s.SourceFileWatcher.Add(event.Name)
+				s.watcher.Add(event.Name)
 			}
+		case <-s.done:
+			return
 		}
 	}
 }
 
+// Close stops forwarding events. The watcher is closed separately.
+func (s *SourceEventHandler) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
 func NewSourceEventHandler(sourceFileWatcher *fsnotify.Watcher) *SourceEventHandler {
+	return newSourceEventHandler(&realFSNotifyWatcher{w: sourceFileWatcher})
+}
+
+// newSourceEventHandler forwards the events of any watcher, such as the
+// polling one.
+func newSourceEventHandler(sourceFileWatcher fSNotifyWatcher) *SourceEventHandler {
 	handler := &SourceEventHandler{
-		make(chan fsnotify.Event),
-		sourceFileWatcher,
+		SourceFileEvents:  make(chan fsnotify.Event),
+		SourceFileWatcher: sourceFileWatcher.Watcher(),
+		watcher:           sourceFileWatcher,
+		done:              make(chan struct{}),
 	}
 	go handler.Listen()
 	return handler
@@ -0,0 +1,59 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestSourceEventHandler_close(t *testing.T) {
+	listen := func(w *fakeFSNotifyWatcher) (*SourceEventHandler, chan struct{}) {
+		h := &SourceEventHandler{
+			SourceFileEvents: make(chan fsnotify.Event),
+			watcher:          w,
+			done:             make(chan struct{}),
+		}
+		exited := make(chan struct{})
+		go func() {
+			h.Listen()
+			close(exited)
+		}()
+		return h, exited
+	}
+	assertExited := func(exited chan struct{}, msg string) {
+		t.Helper()
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Expected the handler to stop %s", msg)
+		}
+	}
+
+	// Nobody reads the event any more.
+	w := &fakeFSNotifyWatcher{EventChan: make(chan fsnotify.Event)}
+	h, exited := listen(w)
+	w.EventChan <- fsnotify.Event{Op: fsnotify.Write, Name: "/path/to/foo"}
+	h.Close()
+	h.Close()
+	assertExited(exited, "once closed")
+
+	w = &fakeFSNotifyWatcher{EventChan: make(chan fsnotify.Event)}
+	_, exited = listen(w)
+	close(w.EventChan)
+	assertExited(exited, "once the watcher is closed")
+}
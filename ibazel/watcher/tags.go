@@ -0,0 +1,79 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"net"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/command"
+	"github.com/bazelbuild/bazel-watcher/ibazel/process_group"
+	"github.com/bazelbuild/bazel-watcher/ibazel/target_config"
+)
+
+// TagKeys is implemented by lifecycle listeners that read their own
+// ibazel_<key> tags, so the tags are recognized and validated along with
+// iBazel's.
+type TagKeys interface {
+	TagKeys() []target_config.Key
+}
+
+// The tags iBazel reads itself.
+var builtinTagKeys = []target_config.Key{
+	{Name: "notify_changes", Kind: target_config.Flag},
+	{Name: "control", Kind: target_config.Flag},
+	{Name: "pty", Kind: target_config.Flag},
+	{Name: "listen", Kind: target_config.List, Validate: validateAddr},
+	{Name: "notify_protocol", Kind: target_config.String, Validate: func(v string) error {
+		_, err := command.ParseNotifyProtocol(v)
+		return err
+	}},
+	{Name: "notify_delivery", Kind: target_config.String, Validate: func(v string) error {
+		_, err := command.ParseNotifyDelivery(v)
+		return err
+	}},
+	{Name: "debounce", Kind: target_config.Duration},
+	{Name: "watch", Kind: target_config.List, Validate: validateWatchPath},
+	{Name: "env_file", Kind: target_config.List},
+	{Name: "restart_signal", Kind: target_config.String, Validate: func(v string) error {
+		_, err := process_group.ParseSignal(v)
+		return err
+	}},
+	{Name: "grace_period", Kind: target_config.Duration},
+	{Name: "readiness_probe", Kind: target_config.String, Validate: func(v string) error {
+		_, err := command.ParseReadinessProbe(v)
+		return err
+	}},
+}
+
+func validateAddr(addr string) error {
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
+
+// newTagRegistry registers iBazel's tags and those of the listeners.
+func newTagRegistry(listeners []Lifecycle) (*target_config.Registry, error) {
+	r := target_config.NewRegistry()
+	if err := r.Register(builtinTagKeys...); err != nil {
+		return nil, err
+	}
+	for _, l := range listeners {
+		if t, ok := l.(TagKeys); ok {
+			if err := r.Register(t.TagKeys()...); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// isWatchLimit reports whether err means that the inotify limits are
+// reached: ENOSPC when there are too many watches, EMFILE when there are too
+// many instances.
+func isWatchLimit(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE)
+}
+
+// fallbackWatcher watches with fsnotify, and polls the directories that can't
+// be watched because the inotify limits are reached.
+type fallbackWatcher struct {
+	fSNotifyWatcher
+	poll *pollingWatcher
+
+	events chan fsnotify.Event
+	errors chan error
+
+	lock   sync.Mutex // guards polled
+	polled map[string]struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ fSNotifyWatcher = &fallbackWatcher{}
+
+func newFallbackWatcher(w fSNotifyWatcher, poll *pollingWatcher) *fallbackWatcher {
+	f := &fallbackWatcher{
+		fSNotifyWatcher: w,
+		poll:            poll,
+		events:          make(chan fsnotify.Event),
+		errors:          make(chan error),
+		polled:          map[string]struct{}{},
+		done:            make(chan struct{}),
+	}
+	go f.forward()
+	return f
+}
+
+func (w *fallbackWatcher) Add(name string) error {
+	err := w.fSNotifyWatcher.Add(name)
+	if !isWatchLimit(err) {
+		return err
+	}
+	if err := w.poll.Add(name); err != nil {
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.polled[filepath.Clean(name)] = struct{}{}
+	return nil
+}
+
+func (w *fallbackWatcher) Remove(name string) error {
+	w.lock.Lock()
+	_, ok := w.polled[filepath.Clean(name)]
+	delete(w.polled, filepath.Clean(name))
+	w.lock.Unlock()
+	if ok {
+		return w.poll.Remove(name)
+	}
+	return w.fSNotifyWatcher.Remove(name)
+}
+
+// polledDirectories returns how many directories are polled.
+func (w *fallbackWatcher) polledDirectories() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.polled)
+}
+
+func (w *fallbackWatcher) Close() error {
+	w.closeOnce.Do(func() { close(w.done) })
+	w.poll.Close()
+	return w.fSNotifyWatcher.Close()
+}
+
+func (w *fallbackWatcher) Events() chan fsnotify.Event { return w.events }
+func (w *fallbackWatcher) Errors() chan error          { return w.errors }
+
+// forward merges the events and errors of both watchers.
+func (w *fallbackWatcher) forward() {
+	defer close(w.events)
+	defer close(w.errors)
+
+	events, pollEvents := w.fSNotifyWatcher.Events(), w.poll.Events()
+	errs, pollErrs := w.fSNotifyWatcher.Errors(), w.poll.Errors()
+	for events != nil || pollEvents != nil {
+		var e fsnotify.Event
+		var err error
+		ok := true
+		select {
+		case e, ok = <-events:
+			if !ok {
+				events = nil
+			}
+		case e, ok = <-pollEvents:
+			if !ok {
+				pollEvents = nil
+			}
+		case err, ok = <-errs:
+			if !ok {
+				errs = nil
+			}
+		case err, ok = <-pollErrs:
+			if !ok {
+				pollErrs = nil
+			}
+		case <-w.done:
+			return
+		}
+		if !ok {
+			continue
+		}
+
+		if err != nil {
+			select {
+			case w.errors <- err:
+			case <-w.done:
+				return
+			}
+			continue
+		}
+		select {
+		case w.events <- e:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// polledDirectories returns how many of the directories of w are polled
+// because of the inotify limits.
+func polledDirectories(w fSNotifyWatcher) int {
+	if f, ok := w.(*fallbackWatcher); ok {
+		return f.polledDirectories()
+	}
+	return 0
+}
+
+// reportWatchLimit explains what to do when there are more directories to
+// watch than inotify allows.
+func reportWatchLimit(needed, polled int) {
+	log.Errorf("iBazel needs to watch %d directories, but fs.inotify.max_user_watches only allows %s watches for all programs. Polling %d of them instead, which notices changes later.", needed, inotifyLimitString("max_user_watches"), polled)
+	suggested := 524288
+	for suggested < 2*needed {
+		suggested *= 2
+	}
+	log.Errorf("To raise the limit, run:\n\n  sudo sysctl fs.inotify.max_user_watches=%d\n\nand add \"fs.inotify.max_user_watches=%d\" to /etc/sysctl.conf to keep it after a restart.", suggested, suggested)
+}
+
+// inotifyLimitString returns the value of an inotify limit for messages.
+func inotifyLimitString(name string) string {
+	limit, ok := inotifyLimit(name)
+	if !ok {
+		return "unknown"
+	}
+	return strconv.Itoa(limit)
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// limitedWatcher fails to watch some directories as if the inotify watch
+// limit was reached.
+type limitedWatcher struct {
+	recordingWatcher
+	limited map[string]bool
+}
+
+func (w *limitedWatcher) Add(name string) error {
+	if w.limited[name] {
+		return syscall.ENOSPC
+	}
+	return w.recordingWatcher.Add(name)
+}
+
+func TestIsWatchLimit(t *testing.T) {
+	assertEqual(t, true, isWatchLimit(syscall.ENOSPC), "ENOSPC")
+	assertEqual(t, true, isWatchLimit(fmt.Errorf("adding a watch: %w", syscall.EMFILE)), "Wrapped EMFILE")
+	assertEqual(t, false, isWatchLimit(syscall.ENOENT), "ENOENT")
+	assertEqual(t, false, isWatchLimit(nil), "No error")
+}
+
+func TestFallbackWatcher(t *testing.T) {
+	dir := testWorkspace(t)
+	defer os.RemoveAll(dir)
+
+	primary := &limitedWatcher{limited: map[string]bool{dir: true}}
+	primary.EventChan = make(chan fsnotify.Event)
+	primary.ErrorChan = make(chan error)
+	w := newFallbackWatcher(primary, newPollingWatcher(10*time.Millisecond, false))
+
+	if err := w.Add(dir); err != nil {
+		t.Fatalf("Expected the directory to be polled, got %v", err)
+	}
+	if err := w.Add("/elsewhere"); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, 1, polledDirectories(w), "Polled directories")
+	assertEqual(t, []string{"/elsewhere"}, primary.added, "Directories watched with inotify")
+
+	// Events of both watchers are delivered.
+	file := filepath.Join(dir, "a.go")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-w.Events():
+		assertEqual(t, fsnotify.Event{Name: file, Op: fsnotify.Create}, e, "Polled event")
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected an event from the polled directory")
+	}
+	primary.EventChan <- fsnotify.Event{Name: "/elsewhere/b.go", Op: fsnotify.Write}
+	assertEqual(t, fsnotify.Event{Name: "/elsewhere/b.go", Op: fsnotify.Write}, <-w.Events(), "inotify event")
+
+	if err := w.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Remove("/elsewhere"); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, 0, polledDirectories(w), "Polled directories")
+	assertEqual(t, []string{"/elsewhere"}, primary.removed, "Directories unwatched with inotify")
+
+	w.Close()
+	for range w.Events() {
+	}
+}
+
+func TestIBazelWatchFiles_watchLimit(t *testing.T) {
+	dir := testWorkspace(t, "a/", "b/")
+	defer os.RemoveAll(dir)
+
+	i := newIBazel(t)
+	defer i.Cleanup()
+	primary := &limitedWatcher{limited: map[string]bool{filepath.Join(dir, "b") + string(filepath.Separator): true}}
+	w := newFallbackWatcher(primary, newPollingWatcher(time.Hour, false))
+	defer w.Close()
+
+	files := []string{filepath.Join(dir, "a", "1.go"), filepath.Join(dir, "b", "1.go")}
+	i.watchFiles("query", files, w)
+	assertEqual(t, files, i.filesWatched[w].files(), "Every file is watched")
+	assertEqual(t, 1, polledDirectories(w), "Polled directories")
+}
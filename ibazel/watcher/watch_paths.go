@@ -0,0 +1,110 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/bazelbuild/bazel-watcher/ibazel/log"
+)
+
+// validateWatchPath checks that path is a valid file, directory or glob.
+func validateWatchPath(path string) error {
+	_, err := filepath.Match(path, "")
+	return err
+}
+
+// addWatchPaths makes changes to the files, directories or globs restart the
+// run target without rebuilding it. Relative paths are relative to the
+// workspace root. Directories cover the files directly inside them.
+func (i *IBazel) addWatchPaths(paths ...string) {
+	workspacePath, err := i.workspaceFinder.FindWorkspace()
+	if err != nil {
+		log.Errorf("Error finding workspace: %v", err)
+		return
+	}
+
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(workspacePath, p)
+		}
+		if info, err := os.Stat(p); err == nil && info.IsDir() {
+			p = filepath.Join(p, "*")
+		}
+		i.watchPaths = append(i.watchPaths, p)
+	}
+}
+
+// watchPathEntries returns what needs to be watched for the watch paths: the
+// files currently matching them, and the directories they are in so that new
+// matches are noticed too. Directories end in a separator, so that watchFiles
+// watches the directory itself and not its parent.
+func (i *IBazel) watchPathEntries() []string {
+	var entries []string
+	for _, pattern := range i.watchPaths {
+		dirs, _ := filepath.Glob(filepath.Dir(pattern))
+		for _, dir := range dirs {
+			entries = append(entries, dir+string(filepath.Separator))
+		}
+		files, _ := filepath.Glob(pattern)
+		entries = append(entries, files...)
+	}
+	return entries
+}
+
+// watchWatchPaths starts watching the watch paths without querying again.
+func (i *IBazel) watchWatchPaths() {
+	watched := i.filesWatched[i.sourceFileWatcher]
+	if watched == nil {
+		watched = newWatchSet()
+		i.filesWatched[i.sourceFileWatcher] = watched
+	}
+	if i.extraWatched[i.sourceFileWatcher] == nil {
+		i.extraWatched[i.sourceFileWatcher] = map[string]struct{}{}
+	}
+
+	for _, entry := range i.watchPathEntries() {
+		if watched.contains(entry) {
+			continue
+		}
+		parentDirectory, _ := filepath.Split(entry)
+		if !watched.hasDir(parentDirectory) {
+			if err := i.sourceFileWatcher.Add(parentDirectory); err != nil {
+				log.Errorf("Error watching %q error: %v", entry, err)
+				continue
+			}
+		}
+		watched.add(entry)
+		i.extraWatched[i.sourceFileWatcher][entry] = struct{}{}
+	}
+}
+
+// isRestartOnly returns whether a change to the file should only restart the
+// run target, because it matches a watch path and isn't part of the build.
+func (i *IBazel) isRestartOnly(name string) bool {
+	if _, ok := i.extraWatched[i.sourceFileWatcher][name]; ok {
+		return true
+	}
+	if i.filesWatched[i.sourceFileWatcher].contains(name) {
+		return false
+	}
+	for _, pattern := range i.watchPaths {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
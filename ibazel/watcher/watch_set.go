@@ -0,0 +1,117 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"path/filepath"
+	"sort"
+)
+
+// watchSet is the set of files watched by one watcher, indexed by the
+// directory that is watched for them. Directories end in a separator, as
+// returned by filepath.Split.
+type watchSet struct {
+	dirs map[string]map[string]struct{}
+	size int
+}
+
+func newWatchSet(files ...string) *watchSet {
+	s := &watchSet{dirs: map[string]map[string]struct{}{}}
+	for _, file := range files {
+		s.add(file)
+	}
+	return s
+}
+
+// contains reports whether file is in the set. A nil set is empty.
+func (s *watchSet) contains(file string) bool {
+	if s == nil {
+		return false
+	}
+	dir, base := filepath.Split(file)
+	_, ok := s.dirs[dir][base]
+	return ok
+}
+
+// hasDir reports whether any file of dir is in the set.
+func (s *watchSet) hasDir(dir string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.dirs[dir]
+	return ok
+}
+
+func (s *watchSet) add(file string) {
+	dir, base := filepath.Split(file)
+	bases, ok := s.dirs[dir]
+	if !ok {
+		bases = map[string]struct{}{}
+		s.dirs[dir] = bases
+	}
+	if _, ok := bases[base]; ok {
+		return
+	}
+	// Copy the name so that the set doesn't keep the whole path in memory.
+	bases[string([]byte(base))] = struct{}{}
+	s.size++
+}
+
+func (s *watchSet) len() int {
+	if s == nil {
+		return 0
+	}
+	return s.size
+}
+
+// dirCount returns how many directories the set has files in.
+func (s *watchSet) dirCount() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.dirs)
+}
+
+// each calls f with every file of the set, in no particular order.
+func (s *watchSet) each(f func(file string)) {
+	if s == nil {
+		return
+	}
+	for dir, bases := range s.dirs {
+		for base := range bases {
+			f(dir + base)
+		}
+	}
+}
+
+// eachDir calls f with every directory of the set, in no particular order.
+func (s *watchSet) eachDir(f func(dir string)) {
+	if s == nil {
+		return
+	}
+	for dir := range s.dirs {
+		f(dir)
+	}
+}
+
+// files returns the files of the set in order.
+func (s *watchSet) files() []string {
+	files := make([]string, 0, s.len())
+	s.each(func(file string) {
+		files = append(files, file)
+	})
+	sort.Strings(files)
+	return files
+}
@@ -0,0 +1,236 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type recordingWatcher struct {
+	fakeFSNotifyWatcher
+	added   []string
+	removed []string
+}
+
+func (w *recordingWatcher) Add(name string) error {
+	w.added = append(w.added, name)
+	return nil
+}
+
+func (w *recordingWatcher) Remove(name string) error {
+	w.removed = append(w.removed, name)
+	return nil
+}
+
+func TestWatchSet(t *testing.T) {
+	a := filepath.FromSlash("/ws/a/")
+	s := newWatchSet(a+"x.go", a+"y.go", a+"x.go", a)
+	assertEqual(t, 3, s.len(), "Size")
+	assertEqual(t, []string{a, a + "x.go", a + "y.go"}, s.files(), "Files")
+	if !s.contains(a+"x.go") || !s.contains(a) || s.contains(a+"z.go") {
+		t.Errorf("Unexpected contents: %v", s.files())
+	}
+	if !s.hasDir(a) || s.hasDir(filepath.FromSlash("/ws/b/")) {
+		t.Errorf("Unexpected directories")
+	}
+
+	var empty *watchSet
+	if empty.contains(a) || empty.hasDir(a) || empty.len() != 0 {
+		t.Errorf("Expected a nil set to be empty")
+	}
+}
+
+func TestIBazelWatchFiles(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+	file := func(path string) string { return filepath.FromSlash(path) }
+	w := &recordingWatcher{}
+
+	i.watchFiles("query", []string{file("/ws/a/1.go"), file("/ws/a/2.go"), file("/ws/b/1.go")}, w, file("/ws/c/"), file("/ws/a/1.go"))
+	assertEqual(t, []string{file("/ws/a/"), file("/ws/b/"), file("/ws/c/")}, w.added, "Directories watched")
+	assertEqual(t, []string(nil), w.removed, "Directories unwatched")
+	assertEqual(t, map[string]struct{}{file("/ws/c/"): struct{}{}}, i.extraWatched[w], "Extra files")
+
+	// Only the differences reach the watcher.
+	w.added = nil
+	i.watchFiles("query", []string{file("/ws/b/1.go"), file("/ws/b/2.go"), file("/ws/d/1.go")}, w)
+	assertEqual(t, []string{file("/ws/d/")}, w.added, "Directories watched")
+	assertEqual(t, []string{file("/ws/a/"), file("/ws/c/")}, sortedStrings(w.removed), "Directories unwatched")
+	assertEqual(t, []string{file("/ws/b/1.go"), file("/ws/b/2.go"), file("/ws/d/1.go")}, i.filesWatched[w].files(), "Files watched")
+}
+
+func TestIBazelWatchFiles_removedDirectory(t *testing.T) {
+	i := newIBazel(t)
+	defer i.Cleanup()
+	file := func(path string) string { return filepath.FromSlash(path) }
+	w := &recordingWatcher{}
+
+	files := []string{file("/ws/a/1.go"), file("/ws/b/1.go")}
+	i.watchFiles("query", files, w)
+	if !i.watched(w, fsnotify.Event{Op: fsnotify.Remove, Name: file("/ws/a")}) {
+		t.Errorf("Expected the removal of a watched directory to matter")
+	}
+
+	// The watcher dropped the deleted directory, so it is added again.
+	w.added = nil
+	i.watchFiles("query", files, w)
+	assertEqual(t, []string{file("/ws/a/")}, w.added, "Directories watched")
+	assertEqual(t, []string(nil), w.removed, "Directories unwatched")
+
+	w.added = nil
+	i.watchFiles("query", files, w)
+	assertEqual(t, []string(nil), w.added, "Directories watched")
+}
+
+func TestIBazelWatchFiles_recreatedDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Watched directories can't be deleted on Windows")
+	}
+	i := newIBazel(t)
+	defer i.Cleanup()
+	dir := testWorkspace(t)
+	defer os.RemoveAll(dir)
+	pkg := filepath.Join(dir, "pkg")
+	source := filepath.Join(pkg, "a.go")
+	write := func() {
+		if err := os.MkdirAll(pkg, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(source, []byte("package pkg"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &realFSNotifyWatcher{w: fw}
+	defer w.Close()
+	waitFor := func(name string, op fsnotify.Op) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e := <-w.Events():
+				i.watched(w, e)
+				if e.Name == name && e.Op&op != 0 {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("No %v event for %q", op, name)
+			}
+		}
+	}
+
+	write()
+	i.watchFiles("query", []string{source}, w)
+	if err := os.RemoveAll(pkg); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(pkg, fsnotify.Remove)
+
+	write()
+	i.watchFiles("query", []string{source}, w)
+	if err := ioutil.WriteFile(source, []byte("package pkg // changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(source, fsnotify.Write)
+}
+
+func sortedStrings(l []string) []string {
+	sort.Strings(l)
+	return l
+}
+
+// benchmarkFiles returns a watch set as large as those of big monorepos:
+// 500k files in 25k directories. Only the first one exists.
+func benchmarkFiles(b *testing.B) []string {
+	dir := testWorkspace(b, "BUILD")
+	files := []string{filepath.Join(dir, "BUILD")}
+	for d := 0; d < 25000; d++ {
+		pkg := filepath.Join(dir, fmt.Sprintf("pkg%d", d/100), fmt.Sprintf("sub%d", d%100))
+		for f := 0; f < 20; f++ {
+			files = append(files, filepath.Join(pkg, fmt.Sprintf("file%d.go", f)))
+		}
+	}
+	return files
+}
+
+func BenchmarkWatchFiles(b *testing.B) {
+	i := newIBazel(b)
+	defer i.Cleanup()
+	files := benchmarkFiles(b)
+	defer os.RemoveAll(filepath.Dir(files[0]))
+	w := &fakeFSNotifyWatcher{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i.filesWatched[w] = nil
+		i.watchFiles("query", files, w)
+	}
+}
+
+func BenchmarkWatchFiles_requery(b *testing.B) {
+	i := newIBazel(b)
+	defer i.Cleanup()
+	files := benchmarkFiles(b)
+	defer os.RemoveAll(filepath.Dir(files[0]))
+	w := &fakeFSNotifyWatcher{}
+	i.watchFiles("query", files, w)
+	// A package moved between queries.
+	moved := append([]string{}, files[:len(files)-20]...)
+	for f := 0; f < 20; f++ {
+		moved = append(moved, filepath.Join(filepath.Dir(files[0]), "moved", fmt.Sprintf("file%d.go", f)))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if n%2 == 0 {
+			i.watchFiles("query", moved, w)
+		} else {
+			i.watchFiles("query", files, w)
+		}
+	}
+}
+
+func BenchmarkWatched(b *testing.B) {
+	i := newIBazel(b)
+	defer i.Cleanup()
+	files := benchmarkFiles(b)
+	defer os.RemoveAll(filepath.Dir(files[0]))
+	w := &fakeFSNotifyWatcher{}
+	i.watchFiles("query", files, w)
+	events := []fsnotify.Event{
+		{Op: fsnotify.Write, Name: files[len(files)/2]},
+		{Op: fsnotify.Write, Name: filepath.Join(filepath.Dir(files[1]), "unwatched.go")},
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i.watched(w, events[n%len(events)])
+	}
+}
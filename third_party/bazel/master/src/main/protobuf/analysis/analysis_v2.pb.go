@@ -0,0 +1,128 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: third_party/bazel/master/src/main/protobuf/analysis/analysis_v2.proto
+
+package analysis
+
+import (
+	fmt "fmt"
+	protobuf "github.com/bazelbuild/bazel-watcher/third_party/bazel/master/src/main/protobuf"
+	proto "github.com/golang/protobuf/proto"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type ConfiguredTarget struct {
+	Target               *protobuf.Target `protobuf:"bytes,1,opt,name=target,proto3" json:"target,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
+func (m *ConfiguredTarget) Reset()         { *m = ConfiguredTarget{} }
+func (m *ConfiguredTarget) String() string { return proto.CompactTextString(m) }
+func (*ConfiguredTarget) ProtoMessage()    {}
+func (*ConfiguredTarget) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f2123e9c70505ec8, []int{0}
+}
+
+func (m *ConfiguredTarget) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ConfiguredTarget.Unmarshal(m, b)
+}
+func (m *ConfiguredTarget) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ConfiguredTarget.Marshal(b, m, deterministic)
+}
+func (m *ConfiguredTarget) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ConfiguredTarget.Merge(m, src)
+}
+func (m *ConfiguredTarget) XXX_Size() int {
+	return xxx_messageInfo_ConfiguredTarget.Size(m)
+}
+func (m *ConfiguredTarget) XXX_DiscardUnknown() {
+	xxx_messageInfo_ConfiguredTarget.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ConfiguredTarget proto.InternalMessageInfo
+
+func (m *ConfiguredTarget) GetTarget() *protobuf.Target {
+	if m != nil {
+		return m.Target
+	}
+	return nil
+}
+
+type CqueryResult struct {
+	Results              []*ConfiguredTarget `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}            `json:"-"`
+	XXX_unrecognized     []byte              `json:"-"`
+	XXX_sizecache        int32               `json:"-"`
+}
+
+func (m *CqueryResult) Reset()         { *m = CqueryResult{} }
+func (m *CqueryResult) String() string { return proto.CompactTextString(m) }
+func (*CqueryResult) ProtoMessage()    {}
+func (*CqueryResult) Descriptor() ([]byte, []int) {
+	return fileDescriptor_f2123e9c70505ec8, []int{1}
+}
+
+func (m *CqueryResult) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CqueryResult.Unmarshal(m, b)
+}
+func (m *CqueryResult) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CqueryResult.Marshal(b, m, deterministic)
+}
+func (m *CqueryResult) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CqueryResult.Merge(m, src)
+}
+func (m *CqueryResult) XXX_Size() int {
+	return xxx_messageInfo_CqueryResult.Size(m)
+}
+func (m *CqueryResult) XXX_DiscardUnknown() {
+	xxx_messageInfo_CqueryResult.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CqueryResult proto.InternalMessageInfo
+
+func (m *CqueryResult) GetResults() []*ConfiguredTarget {
+	if m != nil {
+		return m.Results
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*ConfiguredTarget)(nil), "analysis.ConfiguredTarget")
+	proto.RegisterType((*CqueryResult)(nil), "analysis.CqueryResult")
+}
+
+func init() {
+	proto.RegisterFile("third_party/bazel/master/src/main/protobuf/analysis/analysis_v2.proto", fileDescriptor_f2123e9c70505ec8)
+}
+
+var fileDescriptor_f2123e9c70505ec8 = []byte{
+	// 235 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x90, 0x3f, 0x4b, 0x03, 0x41,
+	0x10, 0xc5, 0x39, 0x84, 0x28, 0x1b, 0x8b, 0x70, 0x36, 0x21, 0x55, 0x48, 0x21, 0x01, 0x61, 0x17,
+	0x4e, 0xb1, 0x15, 0x93, 0xd8, 0xcb, 0x21, 0x16, 0x36, 0xc7, 0x6e, 0x6e, 0x72, 0x2e, 0xec, 0xdd,
+	0xc6, 0x99, 0xd9, 0xc0, 0xe5, 0xd3, 0x8b, 0x7b, 0x7f, 0x0a, 0xbb, 0x74, 0x3f, 0xe6, 0x3d, 0xde,
+	0xbc, 0x19, 0xf1, 0xc6, 0xdf, 0x16, 0xcb, 0xe2, 0xa8, 0x91, 0x5b, 0x65, 0xf4, 0x19, 0x9c, 0xaa,
+	0x35, 0x31, 0xa0, 0x22, 0xdc, 0xab, 0x5a, 0xdb, 0x46, 0x1d, 0xd1, 0xb3, 0x37, 0xe1, 0xa0, 0x74,
+	0xa3, 0x5d, 0x4b, 0x96, 0x46, 0x28, 0x4e, 0x99, 0x8c, 0x6a, 0x7a, 0x33, 0x8c, 0x16, 0xcf, 0x17,
+	0x04, 0x9a, 0x60, 0x5d, 0xd9, 0x25, 0xac, 0x5e, 0xc4, 0x6c, 0xeb, 0x9b, 0x83, 0xad, 0x02, 0x42,
+	0xf9, 0xa1, 0xb1, 0x02, 0x4e, 0x1f, 0xc4, 0x84, 0x23, 0xcd, 0x93, 0x65, 0xb2, 0x9e, 0x66, 0x77,
+	0xd2, 0x38, 0x7d, 0x86, 0xe2, 0x27, 0x00, 0xb6, 0xb2, 0x33, 0xe5, 0xbd, 0x65, 0xb5, 0x13, 0xb7,
+	0xdb, 0x28, 0xe4, 0x40, 0xc1, 0x71, 0xfa, 0x24, 0xae, 0x31, 0x12, 0xcd, 0x93, 0xe5, 0xd5, 0x7a,
+	0x9a, 0x2d, 0xe4, 0x50, 0x52, 0xfe, 0xdf, 0x94, 0x0f, 0xd6, 0xcd, 0x4e, 0xdc, 0xef, 0x7d, 0x2d,
+	0x2b, 0xef, 0x2b, 0x07, 0xb2, 0x84, 0x13, 0x7b, 0xef, 0x48, 0x76, 0x4d, 0x9d, 0x35, 0x63, 0xc6,
+	0x66, 0xf6, 0xda, 0xd3, 0xfb, 0x5f, 0x7f, 0xfa, 0xcc, 0xbe, 0xc6, 0x27, 0x98, 0x49, 0xbc, 0xe9,
+	0xf1, 0x77, 0x00, 0x42, 0xc2, 0xb6, 0xfb, 0x5e, 0x01, 0x00, 0x00,
+}